@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// document is an open document, with the results of analysing its text.
+type document struct {
+	uri  string
+	path string
+	text string
+	// lines are the offsets at which the lines of the text start
+	lines []int
+
+	tokens       []parser.Token
+	declarations []declaration
+	diagnostics  []diagnostic
+}
+
+// declaration is the declaration of a fact, act, duty, event, predicate or
+// placeholder, in the document itself or in a file it includes.
+type declaration struct {
+	name    string
+	keyword string
+	// location is the location of the name in the declaration
+	location location
+	// extent is the range of the whole declaration
+	extent textRange
+	// phrase is the declaration itself, if the document could be parsed
+	phrase *eflint.Phrase
+}
+
+// declaringKeywords are the keywords that start a declaration, unless they
+// follow Extend.
+var declaringKeywords = map[string]bool{
+	"Fact":        true,
+	"Act":         true,
+	"Duty":        true,
+	"Event":       true,
+	"Predicate":   true,
+	"Invariant":   true,
+	"Placeholder": true,
+}
+
+// analyze parses and typechecks the text of a document, and collects its
+// declarations.
+func analyze(uri string, text string) *document {
+	d := &document{uri: uri, path: uriToPath(uri), text: text, lines: []int{0}}
+	for offset, char := range text {
+		if char == '\n' {
+			d.lines = append(d.lines, offset+1)
+		}
+	}
+
+	// Text that cannot be split into tokens is reported by the parser as well
+	d.tokens, _ = parser.Tokenize(d.path, strings.NewReader(text))
+
+	ini, diagnostics := parser.ParseWith(d.path, strings.NewReader(text), parser.OpenFile)
+	for _, diagnostic := range diagnostics {
+		d.report(&eflint.Position{File: diagnostic.Pos.Filename, Line: diagnostic.Pos.Line, Column: diagnostic.Pos.Column}, eflint.ErrParse.Id, diagnostic.Message)
+	}
+
+	var phrases []eflint.Phrase
+	if ini != nil && len(diagnostics) == 0 {
+		phrases = parser.Convert(ini).Phrases
+		for _, failure := range eflint.NewEngine().TypecheckPhrases(phrases) {
+			d.report(failure.Position, failure.Id, failure.Message)
+		}
+	}
+
+	d.declare(phrases)
+
+	return d
+}
+
+// report adds a diagnostic at the token at a position. Problems in other
+// files, such as included ones, are reported at the start of the document.
+func (d *document) report(at *eflint.Position, code string, message string) {
+	problem := diagnostic{Severity: severityError, Code: code, Source: "eflint", Message: message}
+
+	if at != nil && at.Line > 0 && at.File != d.path {
+		problem.Message = fmt.Sprintf("%s:%d:%d: %s", at.File, at.Line, at.Column, message)
+	} else if at != nil && at.Line > 0 {
+		start := d.locate(at.Line, at.Column)
+		problem.Range = textRange{Start: start, End: start}
+		if token, ok := d.tokenAt(start); ok {
+			problem.Range = d.tokenRange(token)
+		}
+	}
+
+	d.diagnostics = append(d.diagnostics, problem)
+}
+
+// declare collects the declarations of the document from its tokens, so that
+// they are known even if the document cannot be parsed. The declarations of
+// included files can only be found in the parsed phrases.
+func (d *document) declare(phrases []eflint.Phrase) {
+	// The phrases of the document itself, by their position
+	own := make(map[position]*eflint.Phrase)
+	starts := make([]position, 0)
+	for i, phrase := range phrases {
+		if phrase.Position == nil {
+			continue
+		}
+
+		if phrase.Position.File == d.path {
+			start := d.locate(phrase.Position.Line, phrase.Position.Column)
+			own[start] = &phrases[i]
+			starts = append(starts, start)
+			continue
+		}
+
+		if keyword := declaringKeyword(phrase); keyword != "" {
+			start := position{Line: phrase.Position.Line - 1, Character: phrase.Position.Column - 1}
+			at := textRange{Start: start, End: start}
+			d.declarations = append(d.declarations, declaration{
+				name:     declaredName(phrase),
+				keyword:  keyword,
+				location: location{URI: pathToURI(phrase.Position.File), Range: at},
+				extent:   at,
+				phrase:   &phrases[i],
+			})
+		}
+	}
+
+	for i, token := range d.tokens {
+		if !declaringKeywords[token.Type] || (i > 0 && d.tokens[i-1].Type == "Extend") || i+1 == len(d.tokens) {
+			continue
+		}
+
+		name, ok := d.tokens[i+1].Identifier()
+		if !ok {
+			continue
+		}
+
+		start := d.tokenRange(token).Start
+		declared := declaration{
+			name:     name,
+			keyword:  token.Type,
+			location: location{URI: d.uri, Range: d.tokenRange(d.tokens[i+1])},
+			extent:   textRange{Start: start, End: d.tokenRange(d.tokens[i+1]).End},
+			phrase:   own[start],
+		}
+
+		// The declaration extends to the last token before the next phrase
+		if declared.phrase != nil {
+			next, hasNext := position{}, false
+			for _, candidate := range starts {
+				if before(start, candidate) {
+					next, hasNext = candidate, true
+					break
+				}
+			}
+
+			for _, following := range d.tokens[i+1:] {
+				if hasNext && !before(d.tokenRange(following).Start, next) {
+					break
+				}
+				declared.extent.End = d.tokenRange(following).End
+			}
+		}
+
+		d.declarations = append(d.declarations, declared)
+	}
+}
+
+// lookup finds the declaration of a name. Names that are decorated with
+// digits or primes, like person1, refer to the fact without them.
+func (d *document) lookup(name string) *declaration {
+	for _, candidate := range []string{name, strings.TrimRight(name, "'0123456789")} {
+		for i := range d.declarations {
+			if d.declarations[i].name == candidate {
+				return &d.declarations[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// tokenAt finds the token at a position, or right before it.
+func (d *document) tokenAt(at position) (parser.Token, bool) {
+	for _, token := range d.tokens {
+		tokenAt := d.tokenRange(token)
+		if tokenAt.Start.Line == at.Line && tokenAt.Start.Character <= at.Character && at.Character <= tokenAt.End.Character {
+			return token, true
+		}
+	}
+
+	return parser.Token{}, false
+}
+
+// declaringKeyword returns the keyword with which a phrase declares a fact, or
+// nothing if it is not a declaration.
+func declaringKeyword(phrase eflint.Phrase) string {
+	switch phrase.Kind {
+	case "afact", "cfact":
+		return "Fact"
+	case "predicate":
+		if phrase.IsInvariant {
+			return "Invariant"
+		}
+		return "Predicate"
+	}
+
+	return map[string]string{"act": "Act", "duty": "Duty", "event": "Event", "placeholder": "Placeholder"}[phrase.Kind]
+}
+
+func declaredName(phrase eflint.Phrase) string {
+	if names, ok := phrase.Name.([]string); ok && len(names) > 0 {
+		return names[0]
+	}
+
+	return fmt.Sprint(phrase.Name)
+}
+
+// tokenRange returns the range of a token in the document, including the
+// quotes of strings and the brackets of escaped identifiers.
+func (d *document) tokenRange(token parser.Token) textRange {
+	return textRange{Start: d.position(token.Pos.Offset), End: d.position(token.Pos.Offset + len(token.Value))}
+}
+
+// position converts an offset in the text to a position in the document,
+// counting the characters of the line in UTF-16 code units.
+func (d *document) position(offset int) position {
+	line := sort.Search(len(d.lines), func(i int) bool { return d.lines[i] > offset }) - 1
+
+	character := 0
+	for _, char := range d.text[d.lines[line]:offset] {
+		if char >= 0x10000 {
+			character += 2
+		} else {
+			character += 1
+		}
+	}
+
+	return position{Line: line, Character: character}
+}
+
+// locate converts a line and column of the parser, which count from one and
+// count the characters of the line in code points, to a position in the
+// document.
+func (d *document) locate(line int, column int) position {
+	if line < 1 || line > len(d.lines) {
+		return position{Line: line - 1, Character: column - 1}
+	}
+
+	offset := d.lines[line-1]
+	for ; column > 1 && offset < len(d.text) && d.text[offset] != '\n'; column-- {
+		_, size := utf8.DecodeRuneInString(d.text[offset:])
+		offset += size
+	}
+
+	return d.position(offset)
+}
+
+func before(a position, b position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
+
+func uriToPath(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return uri
+	}
+
+	return filepath.FromSlash(parsed.Path)
+}
+
+func pathToURI(path string) string {
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const specification = `Fact person Identified by String.
+Fact [natural person] Identified by String.
+Fact lent Identified by person * book.
+Fact book Identified by String.
+Act borrow Actor person Related to book
+  Holds when !lent(person, book)
+  Creates lent(person, book).
+Event close
+  Terminates lent(person1, book).
++animal(Rex).`
+
+// exchange sends requests to a server and returns the messages it sent back.
+func exchange(t *testing.T, requests ...string) []message {
+	var in bytes.Buffer
+	for _, request := range requests {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(request), request)
+	}
+
+	var out bytes.Buffer
+	if !newServer(&out).serve(&in) {
+		t.Error("Expected the server to be shut down before exiting")
+	}
+
+	responses := make([]message, 0)
+	reader := bufio.NewReader(&out)
+	for {
+		msg, err := readMessage(reader)
+		if err == io.EOF {
+			return responses
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, msg)
+	}
+}
+
+func request(id int, method string, params string) string {
+	return fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "method": %q, "params": %s}`, id, method, params)
+}
+
+func at(line int, character int) string {
+	return fmt.Sprintf(`{"textDocument": {"uri": "file:///specs/library.eflint"}, "position": {"line": %d, "character": %d}}`, line, character)
+}
+
+func TestLanguageServer(t *testing.T) {
+	text, _ := json.Marshal(specification)
+	responses := exchange(t,
+		request(1, "initialize", `{"capabilities": {}}`),
+		`{"jsonrpc": "2.0", "method": "initialized", "params": {}}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "file:///specs/library.eflint", "languageId": "eflint", "version": 1, "text": `+string(text)+`}}}`,
+		request(2, "textDocument/definition", at(2, 34)),
+		request(3, "textDocument/definition", at(8, 20)),
+		request(4, "textDocument/hover", at(5, 15)),
+		request(5, "textDocument/completion", at(9, 1)),
+		request(6, "textDocument/documentSymbol", `{"textDocument": {"uri": "file:///specs/library.eflint"}}`),
+		request(7, "textDocument/rename", at(0, 5)),
+		request(8, "shutdown", `null`),
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+	)
+
+	if len(responses) != 9 {
+		t.Fatalf("Expected 9 messages, got %d", len(responses))
+	}
+
+	var published publishDiagnosticsParams
+	json.Unmarshal(responses[1].Params, &published)
+	if len(published.Diagnostics) != 1 || published.Diagnostics[0].Code != "unknown-fact" || published.Diagnostics[0].Range != (textRange{Start: position{9, 0}, End: position{9, 1}}) {
+		t.Error("Expected the unknown fact animal to be reported, got", published.Diagnostics)
+	}
+
+	var definition location
+	json.Unmarshal(responses[2].Result, &definition)
+	if definition.URI != "file:///specs/library.eflint" || definition.Range.Start != (position{3, 5}) {
+		t.Error("Expected book to be declared at 3:5, got", definition)
+	}
+
+	json.Unmarshal(responses[3].Result, &definition)
+	if definition.Range.Start != (position{0, 5}) {
+		t.Error("Expected person1 to refer to person, got", definition)
+	}
+
+	var hovered hover
+	json.Unmarshal(responses[4].Result, &hovered)
+	if !strings.Contains(hovered.Contents.Value, "Fact lent Identified by person * book.") {
+		t.Error("Expected the hover to show the declaration of lent, got", hovered.Contents.Value)
+	}
+
+	var items []completionItem
+	json.Unmarshal(responses[5].Result, &items)
+	labels := make(map[string]int)
+	for _, item := range items {
+		labels[item.Label] = item.Kind
+	}
+	if labels["[natural person]"] != completionClass || labels["borrow"] != completionFunction || labels["Holds when"] != completionKeyword {
+		t.Error("Expected the declared names and keywords to be completed, got", items)
+	}
+
+	var symbols []documentSymbol
+	json.Unmarshal(responses[6].Result, &symbols)
+	if len(symbols) != 6 || symbols[4].Name != "borrow" || symbols[4].Kind != symbolFunction || symbols[4].Range != (textRange{Start: position{4, 0}, End: position{6, 29}}) {
+		t.Error("Expected a symbol for every declaration, got", symbols)
+	}
+
+	if responses[7].Error == nil || responses[7].Error.Code != errMethodNotFound {
+		t.Error("Expected unsupported requests to fail, got", responses[7])
+	}
+	if responses[8].Error != nil || string(responses[8].Result) != "null" {
+		t.Error("Expected shutdown to succeed, got", responses[8])
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	responses := exchange(t,
+		`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "file:///specs/broken.eflint", "text": "Fact person Identified by String.\nFact lent Identified by person * (."}}}`,
+		request(1, "textDocument/definition", `{"textDocument": {"uri": "file:///specs/broken.eflint"}, "position": {"line": 1, "character": 25}}`),
+		request(2, "shutdown", `null`),
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+	)
+
+	var published publishDiagnosticsParams
+	json.Unmarshal(responses[0].Params, &published)
+	if len(published.Diagnostics) != 1 || published.Diagnostics[0].Code != "parse-error" || published.Diagnostics[0].Range.Start != (position{1, 33}) {
+		t.Error("Expected the syntax error to be reported, got", published.Diagnostics)
+	}
+
+	// Declarations are still found in a document that cannot be parsed
+	var definition location
+	json.Unmarshal(responses[1].Result, &definition)
+	if definition.Range.Start != (position{0, 5}) {
+		t.Error("Expected person to be declared at 0:5, got", definition)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	// The characters of a line are counted in UTF-16 code units, in which 😀
+	// takes two
+	source := "Fact person Identified by String.\n+person(\"😀é\"). +animal(Rex). ?person(Bob)."
+	text, _ := json.Marshal(source)
+	responses := exchange(t,
+		`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "file:///specs/ranges.eflint", "text": `+string(text)+`}}}`,
+		request(1, "textDocument/hover", `{"textDocument": {"uri": "file:///specs/ranges.eflint"}, "position": {"line": 1, "character": 33}}`),
+		request(2, "shutdown", `null`),
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+	)
+
+	var published publishDiagnosticsParams
+	json.Unmarshal(responses[0].Params, &published)
+	if len(published.Diagnostics) != 1 || published.Diagnostics[0].Range != (textRange{Start: position{1, 16}, End: position{1, 17}}) {
+		t.Error("Expected the unknown fact animal to be reported at 1:16, got", published.Diagnostics)
+	}
+
+	var hovered hover
+	json.Unmarshal(responses[1].Result, &hovered)
+	if hovered.Range == nil || *hovered.Range != (textRange{Start: position{1, 31}, End: position{1, 37}}) {
+		t.Error("Expected the hover to cover person at 1:31, got", hovered.Range)
+	}
+
+	// Strings include their quotes
+	d := analyze("file:///specs/ranges.eflint", source)
+	for _, token := range d.tokens {
+		if token.Type == "QuotedString" && d.tokenRange(token) != (textRange{Start: position{1, 8}, End: position{1, 13}}) {
+			t.Error("Expected the string to range from 1:8 to 1:13, got", d.tokenRange(token))
+		}
+	}
+}
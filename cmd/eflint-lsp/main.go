@@ -0,0 +1,19 @@
+// Command eflint-lsp is a language server for eFLINT, which editors start and
+// communicate with over the standard input and output.
+//
+//	eflint-lsp
+//
+// It reports the syntax and type errors of the documents that are opened, and
+// offers go-to-definition, hovers, completion and document symbols for the
+// names they declare.
+package main
+
+import (
+	"os"
+)
+
+func main() {
+	if !newServer(os.Stdout).serve(os.Stdin) {
+		os.Exit(1)
+	}
+}
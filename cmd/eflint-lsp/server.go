@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"io"
+	"log"
+	"sort"
+)
+
+// keywords are completed in addition to the declared names.
+var keywords = []string{
+	"Fact", "Identified by", "Derived from", "Holds when", "Conditioned by",
+	"Placeholder", "For", "Predicate", "Invariant", "When",
+	"Event", "Act", "Duty", "Actor", "Recipient", "Holder", "Claimant",
+	"Related to", "Syncs with", "Creates", "Terminates", "Obfuscates",
+	"Violated when", "Extend", "Holds", "Enabled", "Violated", "Present",
+	"Absent", "Not", "Exists", "Forall", "Foreach", "Count", "Sum", "Max",
+	"Min", "Abs", "If", "Then", "Else",
+	"True", "False", "String", "Int", "#include", "#require",
+}
+
+// server answers the requests of a client about the documents it has opened.
+type server struct {
+	out       io.Writer
+	documents map[string]*document
+	shutdown  bool
+}
+
+func newServer(out io.Writer) *server {
+	return &server{out: out, documents: make(map[string]*document)}
+}
+
+// serve handles messages until the client exits, and returns whether it shut
+// the server down first.
+func (s *server) serve(in io.Reader) bool {
+	reader := bufio.NewReader(in)
+	for {
+		msg, err := readMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println(err)
+			}
+			return false
+		}
+
+		if msg.Method == "exit" {
+			return s.shutdown
+		}
+
+		if msg.ID == nil {
+			s.notify(msg.Method, msg.Params)
+			continue
+		}
+
+		result, failure := s.request(msg.Method, msg.Params)
+		response := message{ID: msg.ID, Error: failure}
+		if failure == nil {
+			response.Result, _ = json.Marshal(result)
+		}
+		if err := writeMessage(s.out, response); err != nil {
+			log.Println(err)
+			return false
+		}
+	}
+}
+
+// notify handles a notification, which has no response.
+func (s *server) notify(method string, params json.RawMessage) {
+	switch method {
+	case "textDocument/didOpen":
+		var opened didOpenParams
+		if json.Unmarshal(params, &opened) == nil {
+			s.update(opened.TextDocument.URI, opened.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var changed didChangeParams
+		if json.Unmarshal(params, &changed) == nil && len(changed.ContentChanges) > 0 {
+			// The server only asks for full documents
+			s.update(changed.TextDocument.URI, changed.ContentChanges[len(changed.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var closed didCloseParams
+		if json.Unmarshal(params, &closed) == nil {
+			delete(s.documents, closed.TextDocument.URI)
+			s.publish(closed.TextDocument.URI, []diagnostic{})
+		}
+	}
+}
+
+// update analyses the new text of a document and publishes its diagnostics.
+func (s *server) update(uri string, text string) {
+	d := analyze(uri, text)
+	s.documents[uri] = d
+
+	diagnostics := d.diagnostics
+	if diagnostics == nil {
+		diagnostics = []diagnostic{}
+	}
+	s.publish(uri, diagnostics)
+}
+
+func (s *server) publish(uri string, diagnostics []diagnostic) {
+	params, _ := json.Marshal(publishDiagnosticsParams{URI: uri, Diagnostics: diagnostics})
+	if err := writeMessage(s.out, message{Method: "textDocument/publishDiagnostics", Params: params}); err != nil {
+		log.Println(err)
+	}
+}
+
+// request handles a request and returns its result.
+func (s *server) request(method string, params json.RawMessage) (interface{}, *responseError) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1,
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]interface{}{},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "eflint-lsp"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		var at textDocumentPositionParams
+		if err := json.Unmarshal(params, &at); err != nil {
+			return nil, &responseError{Code: errInvalidParams, Message: err.Error()}
+		}
+
+		d := s.documents[at.TextDocument.URI]
+		if d == nil {
+			return nil, nil
+		}
+
+		switch method {
+		case "textDocument/definition":
+			return d.definition(at.Position), nil
+		case "textDocument/hover":
+			return d.hover(at.Position), nil
+		default:
+			return d.completion(), nil
+		}
+	case "textDocument/documentSymbol":
+		var symbols documentSymbolParams
+		if err := json.Unmarshal(params, &symbols); err != nil {
+			return nil, &responseError{Code: errInvalidParams, Message: err.Error()}
+		}
+
+		d := s.documents[symbols.TextDocument.URI]
+		if d == nil {
+			return []documentSymbol{}, nil
+		}
+
+		return d.symbols(), nil
+	}
+
+	return nil, &responseError{Code: errMethodNotFound, Message: "method not found: " + method}
+}
+
+// definition returns the location of the declaration of the name at a
+// position.
+func (d *document) definition(at position) *location {
+	token, ok := d.tokenAt(at)
+	if !ok {
+		return nil
+	}
+
+	name, ok := token.Identifier()
+	if !ok {
+		return nil
+	}
+
+	if declared := d.lookup(name); declared != nil {
+		return &declared.location
+	}
+
+	return nil
+}
+
+// hover shows the declaration of the name at a position.
+func (d *document) hover(at position) *hover {
+	token, ok := d.tokenAt(at)
+	if !ok {
+		return nil
+	}
+
+	name, ok := token.Identifier()
+	if !ok {
+		return nil
+	}
+
+	declared := d.lookup(name)
+	if declared == nil {
+		return nil
+	}
+
+	text := declared.keyword + " " + eflint.FormatExpression(eflint.Expression{Value: []string{declared.name}})
+	if declared.phrase != nil {
+		if formatted, err := eflint.FormatPhrase(*declared.phrase); err == nil {
+			text = formatted
+		}
+	}
+
+	span := d.tokenRange(token)
+	return &hover{Contents: markupContent{Kind: "markdown", Value: "```eflint\n" + text + "\n```"}, Range: &span}
+}
+
+// completion lists the declared names and the keywords.
+func (d *document) completion() []completionItem {
+	kinds := map[string]int{
+		"Fact":        completionClass,
+		"Act":         completionFunction,
+		"Duty":        completionInterface,
+		"Event":       completionEvent,
+		"Predicate":   completionClass,
+		"Invariant":   completionClass,
+		"Placeholder": completionVariable,
+	}
+
+	items := make([]completionItem, 0, len(d.declarations)+len(keywords))
+	seen := make(map[string]bool)
+	for _, declared := range d.declarations {
+		if seen[declared.name] {
+			continue
+		}
+		seen[declared.name] = true
+
+		items = append(items, completionItem{
+			Label:  eflint.FormatExpression(eflint.Expression{Value: []string{declared.name}}),
+			Kind:   kinds[declared.keyword],
+			Detail: declared.keyword,
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+
+	for _, keyword := range keywords {
+		items = append(items, completionItem{Label: keyword, Kind: completionKeyword})
+	}
+
+	return items
+}
+
+// symbols lists the facts, acts, duties and events that are declared in the
+// document itself.
+func (d *document) symbols() []documentSymbol {
+	kinds := map[string]int{
+		"Fact":  symbolStruct,
+		"Act":   symbolFunction,
+		"Duty":  symbolInterface,
+		"Event": symbolEvent,
+	}
+
+	symbols := make([]documentSymbol, 0)
+	for _, declared := range d.declarations {
+		if kinds[declared.keyword] == 0 || declared.location.URI != d.uri {
+			continue
+		}
+
+		symbols = append(symbols, documentSymbol{
+			Name:           declared.name,
+			Detail:         declared.keyword,
+			Kind:           kinds[declared.keyword],
+			Range:          declared.extent,
+			SelectionRange: declared.location.Range,
+		})
+	}
+
+	return symbols
+}
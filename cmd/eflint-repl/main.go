@@ -0,0 +1,27 @@
+// Command eflint-repl interprets eFLINT phrases interactively. Files given as
+// arguments are loaded first.
+//
+//	eflint-repl [file.eflint...]
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	r := newREPL(os.Stdout)
+
+	for _, path := range os.Args[1:] {
+		r.command(":load " + path)
+	}
+
+	// The prompt is only shown when the phrases are typed in
+	interactive := false
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+		fmt.Println("eFLINT REPL, type :help for the meta-commands")
+	}
+
+	r.run(os.Stdin, interactive)
+}
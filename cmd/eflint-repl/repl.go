@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"io"
+	"os"
+	"strings"
+)
+
+// repl reads phrases in eFLINT syntax and meta-commands, and interprets them
+// in an engine of its own.
+type repl struct {
+	engine *eflint.Engine
+	out    io.Writer
+	trace  bool
+}
+
+func newREPL(out io.Writer) *repl {
+	engine := eflint.NewEngine()
+	engine.EnableHistory()
+
+	return &repl{engine: engine, out: out}
+}
+
+const help = `Phrases are interpreted as they are entered. Meta-commands:
+  :load <file>        interpret the phrases in a file
+  :facts              list the declared facts
+  :instances <fact>   list the instances of a fact
+  :undo               undo the last phrase that changed the state
+  :violations         list the duties and invariants that are violated
+  :trace              turn tracing of the interpreter on or off
+  :help               show this help
+  :quit               exit`
+
+// run reads lines until the input ends or the user quits. A phrase may span
+// multiple lines: the lines are interpreted together once a line ends with a
+// dot, or when an empty line is entered.
+func (r *repl) run(in io.Reader, interactive bool) {
+	scanner := bufio.NewScanner(in)
+	pending := ""
+
+	prompt := func() {
+		if !interactive {
+			return
+		}
+
+		if pending == "" {
+			fmt.Fprint(r.out, "> ")
+		} else {
+			fmt.Fprint(r.out, "| ")
+		}
+	}
+
+	for prompt(); scanner.Scan(); prompt() {
+		line := scanner.Text()
+
+		if pending == "" && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			if quit := r.command(strings.TrimSpace(line)); quit {
+				return
+			}
+			continue
+		}
+
+		if pending != "" {
+			pending += "\n"
+		}
+		pending += line
+
+		code, _, _ := strings.Cut(line, "//")
+		code = strings.TrimSpace(code)
+		if code != "" && !strings.HasSuffix(code, ".") {
+			continue
+		}
+
+		if strings.TrimSpace(pending) != "" {
+			if phrases, err := parsePhrases("repl", pending); err != nil {
+				fmt.Fprintln(r.out, "error:", err)
+			} else {
+				r.interpret(phrases)
+			}
+		}
+		pending = ""
+	}
+}
+
+func parsePhrases(name string, source string) ([]eflint.Phrase, error) {
+	ini, diagnostics := parser.Parse(name, strings.NewReader(source))
+	if len(diagnostics) > 0 {
+		return nil, diagnostics[0]
+	}
+
+	return parser.Convert(ini).Phrases, nil
+}
+
+// command handles a meta-command and returns whether the REPL should stop.
+func (r *repl) command(line string) bool {
+	name, argument, _ := strings.Cut(line, " ")
+	argument = strings.TrimSpace(argument)
+
+	switch name {
+	case ":load", ":l":
+		data, err := os.ReadFile(argument)
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+
+		phrases, err := parsePhrases(argument, string(data))
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+
+		r.interpret(phrases)
+	case ":facts", ":f":
+		for _, fact := range r.engine.Facts() {
+			fmt.Fprintln(r.out, describeFact(fact))
+		}
+	case ":instances", ":i":
+		if argument == "" {
+			fmt.Fprintln(r.out, "error: expected the name of a fact")
+			return false
+		}
+
+		instances, err := r.engine.Query(eflint.Expression{Value: []string{argument}})
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+
+		for _, instance := range instances {
+			fmt.Fprintln(r.out, eflint.FormatExpression(instance))
+		}
+	case ":undo", ":u":
+		if err := r.engine.Undo(); err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+
+		history, _ := r.engine.History()
+		fmt.Fprintf(r.out, "reverted to state %d\n", history.Current)
+	case ":violations", ":v":
+		violations, err := r.engine.Violations()
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return false
+		}
+
+		if len(violations) == 0 {
+			fmt.Fprintln(r.out, "no violations")
+		}
+		for _, violation := range violations {
+			fmt.Fprintln(r.out, describeViolation(violation))
+		}
+	case ":trace", ":t":
+		r.trace = !r.trace
+		if r.trace {
+			r.engine.SetTrace(r.out)
+			fmt.Fprintln(r.out, "tracing on")
+		} else {
+			r.engine.SetTrace(nil)
+			fmt.Fprintln(r.out, "tracing off")
+		}
+	case ":help", ":h", ":?":
+		fmt.Fprintln(r.out, help)
+	case ":quit", ":q":
+		return true
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, see :help\n", name)
+	}
+
+	return false
+}
+
+// interpret typechecks and interprets the phrases, and prints their results.
+func (r *repl) interpret(phrases []eflint.Phrase) {
+	if failures := r.engine.TypecheckPhrases(phrases); len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Fprintln(r.out, "error:", failure.Message)
+		}
+		return
+	}
+
+	for _, result := range r.engine.Interpret(phrases, true) {
+		r.printResult(result)
+	}
+}
+
+func (r *repl) printResult(result eflint.PhraseResult) {
+	for _, failure := range result.Errors {
+		fmt.Fprintln(r.out, "error:", failure.Message)
+	}
+
+	switch {
+	case result.IsBquery:
+		fmt.Fprintln(r.out, result.Result)
+		return
+	case result.IsIquery:
+		if len(result.Results) == 0 {
+			fmt.Fprintln(r.out, "no instances")
+		}
+		for _, instance := range result.Results {
+			fmt.Fprintln(r.out, eflint.FormatExpression(instance))
+		}
+		return
+	}
+
+	prefixes := map[string]string{"create": "+", "terminate": "-", "obfuscate": "~"}
+	for _, change := range result.Changes {
+		if prefix, ok := prefixes[change.Kind]; ok && change.Operand != nil {
+			fmt.Fprintln(r.out, prefix+eflint.FormatExpression(*change.Operand))
+		}
+	}
+
+	for _, violation := range result.Violations {
+		fmt.Fprintln(r.out, describeViolation(violation))
+	}
+}
+
+func describeViolation(violation eflint.Violation) string {
+	if violation.Kind == "invariant" {
+		witnesses := make([]string, 0, len(violation.Witnesses))
+		for _, witness := range violation.Witnesses {
+			instances := make([]string, 0, len(witness))
+			for _, instance := range witness {
+				instances = append(instances, eflint.FormatExpression(instance))
+			}
+			witnesses = append(witnesses, strings.Join(instances, ", "))
+		}
+
+		if len(witnesses) == 0 {
+			return "violated invariant: " + violation.Identifier
+		}
+		return "violated invariant: " + violation.Identifier + " for " + strings.Join(witnesses, "; ")
+	}
+
+	instance := eflint.FormatExpression(eflint.Expression{Identifier: violation.Identifier, Operands: violation.Operands})
+	switch {
+	case violation.Kind == "act":
+		return "disabled action: " + instance
+	case violation.Change == "unviolated":
+		return "no longer violated " + violation.Kind + ": " + instance
+	}
+
+	return "violated " + violation.Kind + ": " + instance
+}
+
+// describeFact formats the declaration of a fact, without its clauses.
+func describeFact(fact eflint.Phrase) string {
+	name := fmt.Sprint(fact.Name)
+	related := ""
+	if len(fact.RelatedTo) > 0 {
+		related = " Related to " + strings.Join(fact.RelatedTo, ", ")
+	}
+
+	switch fact.Kind {
+	case "afact":
+		if len(fact.Range) > 0 {
+			values := make([]string, 0, len(fact.Range))
+			for _, value := range fact.Range {
+				values = append(values, eflint.FormatExpression(value))
+			}
+			return "Fact " + name + " Identified by " + strings.Join(values, ", ")
+		}
+		return "Fact " + name + " Identified by " + fact.Type
+	case "cfact":
+		return "Fact " + name + " Identified by " + strings.Join(fact.IdentifiedBy, " * ")
+	case "predicate":
+		return "Predicate " + name + " When " + eflint.FormatExpression(*fact.Expression)
+	case "event":
+		return "Event " + name + related
+	case "act":
+		return "Act " + name + " Actor " + fact.Actor + related
+	case "duty":
+		return "Duty " + name + " Holder " + fact.Holder + " Claimant " + fact.Claimant + related
+	}
+
+	return fact.Kind + " " + name
+}
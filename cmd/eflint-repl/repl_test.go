@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	input := `Fact person Identified by String.
+Fact book Identified by String.
+Fact lent Identified by person * book.
+Act borrow Actor person Related to book
+  Creates lent(person, book)
+  Holds when !lent(person, book).
++person(Alice).
++book(Dune).
+borrow(Alice, Dune).
+?lent(Alice, Dune).
+:instances lent
+:undo
+?-lent.
+borrow(Bob, Dune).
+:facts
++magazine(Wired).
+:bogus
+:quit
+?lent(Alice, Dune).
+`
+
+	var output bytes.Buffer
+	newREPL(&output).run(strings.NewReader(input), false)
+
+	expected := `+person("Alice")
++book("Dune")
++borrow(person("Alice"),book("Dune"))
+~borrow(person("Alice"),book("Dune"))
++lent(person("Alice"),book("Dune"))
+true
+lent(person("Alice"),book("Dune"))
+reverted to state 6
+no instances
++lent(person("Bob"),book("Dune"))
+disabled action: borrow(person("Bob"),book("Dune"))
+Fact book Identified by String
+Act borrow Actor person Related to book
+Fact lent Identified by person * book
+Fact person Identified by String
+error: phrase 1: fact magazine does not exist
+unknown command :bogus, see :help
+`
+	if output.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, output.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	// Tracing one REPL does not trace the engines of others
+	var traced, untraced bytes.Buffer
+	newREPL(&traced).run(strings.NewReader(":trace\nFact person Identified by String.\n?person(Alice).\n"), false)
+	newREPL(&untraced).run(strings.NewReader("Fact person Identified by String.\n?person(Alice).\n"), false)
+
+	if !strings.Contains(traced.String(), "query failed") {
+		t.Error("Expected the query to be traced, got", traced.String())
+	}
+
+	if strings.Contains(untraced.String(), "query failed") {
+		t.Error("Expected the query not to be traced, got", untraced.String())
+	}
+}
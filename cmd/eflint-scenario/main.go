@@ -0,0 +1,63 @@
+// Command eflint-scenario runs scenarios against eFLINT specifications and
+// reports whether every step had the expected outcome, in TAP or JUnit XML.
+//
+//	eflint-scenario [-format tap|junit] scenario.json...
+//
+// The exit status is 1 if any test case failed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	format := flag.String("format", "tap", "format of the report, tap or junit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: eflint-scenario [-format tap|junit] scenario.json...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*format != "tap" && *format != "junit") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	reports := make([]report, 0, flag.NArg())
+	failed := false
+
+	for _, path := range flag.Args() {
+		var r report
+		if loaded, err := loadScenario(path); err != nil {
+			// A scenario that cannot be read is reported as a failure, so that
+			// it does not go unnoticed in CI
+			name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			r = report{Scenario: name, Outcomes: []outcome{{Name: "load", Failures: []string{err.Error()}}}}
+		} else {
+			r = report{Scenario: loaded.Name, Outcomes: loaded.run()}
+		}
+
+		for _, o := range r.Outcomes {
+			failed = failed || !o.passed()
+		}
+		reports = append(reports, r)
+	}
+
+	write := writeTAP
+	if *format == "junit" {
+		write = writeJUnit
+	}
+
+	if err := write(os.Stdout, reports); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// report is the outcome of all test cases of a scenario.
+type report struct {
+	Scenario string
+	Outcomes []outcome
+}
+
+// writeTAP writes the reports in the Test Anything Protocol, version 13. The
+// failures of a test case are listed in its YAML block.
+func writeTAP(w io.Writer, reports []report) error {
+	total := 0
+	for _, r := range reports {
+		total += len(r.Outcomes)
+	}
+
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", total); err != nil {
+		return err
+	}
+
+	number := 0
+	for _, r := range reports {
+		for _, o := range r.Outcomes {
+			number++
+
+			status := "ok"
+			if !o.passed() {
+				status = "not ok"
+			}
+
+			directive := ""
+			if o.Skipped {
+				directive = " # SKIP earlier failure"
+			}
+
+			if _, err := fmt.Fprintf(w, "%s %d - %s: %s%s\n", status, number, r.Scenario, o.Name, directive); err != nil {
+				return err
+			}
+
+			if o.passed() {
+				continue
+			}
+
+			lines := []string{"  ---", "  failures:"}
+			for _, failure := range o.Failures {
+				lines = append(lines, "    - "+quoteYAML(failure))
+			}
+			lines = append(lines, "  ...")
+
+			if _, err := fmt.Fprintln(w, strings.Join(lines, "\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// quoteYAML quotes a string for a YAML block. Strings in double quotes are
+// escaped like JSON strings.
+func quoteYAML(value string) string {
+	return fmt.Sprintf("%q", value)
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the reports as JUnit XML, with a test suite for every
+// scenario.
+func writeJUnit(w io.Writer, reports []report) error {
+	var suites junitSuites
+
+	for _, r := range reports {
+		suite := junitSuite{Name: r.Scenario}
+		seconds := 0.0
+
+		for _, o := range r.Outcomes {
+			testCase := junitCase{
+				Name:      o.Name,
+				Classname: r.Scenario,
+				Time:      fmt.Sprintf("%.3f", o.Duration.Seconds()),
+			}
+			seconds += o.Duration.Seconds()
+
+			switch {
+			case o.Skipped:
+				testCase.Skipped = &struct{}{}
+				suite.Skipped++
+			case !o.passed():
+				testCase.Failure = &junitFailure{
+					Message: o.Failures[0],
+					Text:    strings.Join(o.Failures, "\n"),
+				}
+				suite.Failures++
+			}
+
+			suite.Cases = append(suite.Cases, testCase)
+			suite.Tests++
+		}
+
+		suite.Time = fmt.Sprintf("%.3f", seconds)
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
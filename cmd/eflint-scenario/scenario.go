@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scenario is a specification with a sequence of steps that are interpreted
+// after it, each with the outcome it is expected to have.
+type scenario struct {
+	Name string `json:"name"`
+
+	// Path of the specification, relative to the scenario file. It is either
+	// an .eflint file or a .json file with a phrases request.
+	Specification string `json:"specification"`
+
+	Steps []step `json:"steps"`
+
+	dir string
+}
+
+// step is a part of a scenario. Its phrases are written in eFLINT syntax.
+type step struct {
+	Name    string      `json:"name"`
+	Phrases string      `json:"phrases"`
+	Expect  expectation `json:"expect"`
+}
+
+// expectation is the expected outcome of a step. Only the parts that are
+// given are checked, but a step always fails if one of its phrases fails
+// while no errors are expected.
+type expectation struct {
+	// Ids of the errors of the phrases, such as "unknown-fact"
+	Errors []string `json:"errors"`
+
+	// Results of the queries, in order: a boolean for every bquery and a list
+	// of instances for every iquery
+	Queries []json.RawMessage `json:"queries"`
+
+	// All violations and triggers of the phrases
+	Violations []expectedViolation `json:"violations"`
+	Triggers   []expectedTrigger   `json:"triggers"`
+
+	// Instances that are created or terminated by the phrases, among any
+	// other changes. Instances that no longer hold count as terminated.
+	Created    []string `json:"created"`
+	Terminated []string `json:"terminated"`
+}
+
+// expectedViolation is a violation of an act, duty or invariant. The instance
+// is optional, e.g. greet(Alice, Bob).
+type expectedViolation struct {
+	Kind       string `json:"kind"`
+	Identifier string `json:"identifier"`
+	Instance   string `json:"instance,omitempty"`
+}
+
+// expectedTrigger is an act, event or duty that is triggered.
+type expectedTrigger struct {
+	Kind       string `json:"kind"`
+	Identifier string `json:"identifier"`
+}
+
+// outcome is the outcome of a single test case of a scenario.
+type outcome struct {
+	Name     string
+	Failures []string
+	Skipped  bool
+	Duration time.Duration
+}
+
+// passed returns whether the test case met all expectations.
+func (o outcome) passed() bool {
+	return len(o.Failures) == 0
+}
+
+// loadScenario reads a scenario from a file.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded scenario
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&loaded); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if loaded.Name == "" {
+		loaded.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	loaded.dir = filepath.Dir(path)
+
+	return &loaded, nil
+}
+
+// parsePhrases parses phrases in eFLINT syntax.
+func parsePhrases(name string, source io.Reader) ([]eflint.Phrase, error) {
+	ini, diagnostics := parser.Parse(name, source)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics[0]
+	}
+
+	return parser.Convert(ini).Phrases, nil
+}
+
+// loadSpecification reads the phrases of the specification of the scenario.
+func (s *scenario) loadSpecification() ([]eflint.Phrase, error) {
+	if s.Specification == "" {
+		return nil, nil
+	}
+
+	path := filepath.Join(s.dir, s.Specification)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if filepath.Ext(path) != ".json" {
+		return parsePhrases(path, file)
+	}
+
+	var input eflint.Input
+	if err := json.NewDecoder(file).Decode(&input); err != nil {
+		return nil, err
+	}
+	if err := eflint.Typecheck(input); err != nil {
+		return nil, err
+	}
+
+	return input.Phrases, nil
+}
+
+// run interprets the specification and the steps of the scenario in a fresh
+// engine. The specification is the first test case, followed by one test case
+// for every step. Once the specification fails or the phrases of a step cannot
+// be parsed, the remaining steps are skipped, as their outcome would not mean
+// anything.
+func (s *scenario) run() []outcome {
+	engine := eflint.NewEngine()
+	outcomes := make([]outcome, 0, len(s.Steps)+1)
+
+	start := time.Now()
+	specification := outcome{Name: "specification"}
+	if phrases, err := s.loadSpecification(); err != nil {
+		specification.Failures = append(specification.Failures, err.Error())
+	} else {
+		specification.Failures = interpret(engine, phrases, expectation{}).Failures
+	}
+	specification.Duration = time.Since(start)
+	outcomes = append(outcomes, specification)
+
+	broken := !specification.passed()
+	for i, step := range s.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+
+		if broken {
+			outcomes = append(outcomes, outcome{Name: name, Skipped: true})
+			continue
+		}
+
+		start := time.Now()
+		var result outcome
+		if phrases, err := parsePhrases(name, strings.NewReader(step.Phrases)); err != nil {
+			result.Failures = []string{err.Error()}
+			broken = true
+		} else {
+			result = interpret(engine, phrases, step.Expect)
+		}
+		result.Name = name
+		result.Duration = time.Since(start)
+
+		outcomes = append(outcomes, result)
+	}
+
+	return outcomes
+}
+
+// interpret interprets the phrases and compares their results with the
+// expectation.
+func interpret(engine *eflint.Engine, phrases []eflint.Phrase, expect expectation) outcome {
+	var result outcome
+	fail := func(format string, a ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, a...))
+	}
+
+	errors := make([]string, 0)
+	if failures := engine.TypecheckPhrases(phrases); len(failures) > 0 {
+		for _, failure := range failures {
+			errors = append(errors, failure.Id)
+			if expect.Errors == nil {
+				fail("%s", failure.Message)
+			}
+		}
+		if expect.Errors != nil {
+			compareSets(fail, "errors", expect.Errors, errors)
+		}
+		return result
+	}
+
+	results := engine.Interpret(phrases, true)
+
+	queries := make([]string, 0)
+	violations := make([]string, 0)
+	triggers := make([]string, 0)
+	created := make(map[string]bool)
+	terminated := make(map[string]bool)
+
+	for i, phrase := range results {
+		for _, failure := range phrase.Errors {
+			errors = append(errors, failure.Id)
+			if expect.Errors == nil {
+				fail("phrase %d: %s", i+1, failure.Message)
+			}
+		}
+
+		switch {
+		case phrase.IsBquery:
+			queries = append(queries, fmt.Sprint(phrase.Result))
+		case phrase.IsIquery:
+			instances := make([]string, 0, len(phrase.Results))
+			for _, instance := range phrase.Results {
+				instances = append(instances, instanceKey(instance))
+			}
+			queries = append(queries, formatSet(instances))
+		}
+
+		for _, violation := range phrase.Violations {
+			// Duties that are no longer violated are not violations
+			if violation.Change == "unviolated" {
+				continue
+			}
+
+			instance := eflint.Expression{Identifier: violation.Identifier, Operands: violation.Operands}
+			violations = append(violations, violation.Kind+" "+violation.Identifier+" "+instanceKey(instance))
+		}
+
+		for _, trigger := range phrase.Triggers {
+			triggers = append(triggers, trigger.Kind+" "+trigger.Identifier)
+		}
+
+		for _, change := range phrase.Changes {
+			if change.Operand == nil {
+				continue
+			}
+
+			switch change.Kind {
+			case "create":
+				created[instanceKey(*change.Operand)] = true
+				delete(terminated, instanceKey(*change.Operand))
+			case "terminate", "obfuscate":
+				terminated[instanceKey(*change.Operand)] = true
+				delete(created, instanceKey(*change.Operand))
+			}
+		}
+	}
+
+	if expect.Errors != nil {
+		compareSets(fail, "errors", expect.Errors, errors)
+	}
+
+	if expect.Queries != nil {
+		if len(expect.Queries) != len(queries) {
+			fail("expected %d query results, got %d", len(expect.Queries), len(queries))
+		}
+
+		for i := 0; i < len(expect.Queries) && i < len(queries); i++ {
+			expected, err := expectedQuery(engine, expect.Queries[i])
+			if err != nil {
+				fail("query %d: %v", i+1, err)
+			} else if expected != queries[i] {
+				fail("query %d: expected %s, got %s", i+1, expected, queries[i])
+			}
+		}
+	}
+
+	if expect.Violations != nil {
+		compareViolations(engine, fail, expect.Violations, violations)
+	}
+
+	if expect.Triggers != nil {
+		expected := make([]string, 0, len(expect.Triggers))
+		for _, trigger := range expect.Triggers {
+			expected = append(expected, trigger.Kind+" "+trigger.Identifier)
+		}
+		compareSets(fail, "triggers", expected, triggers)
+	}
+
+	for _, instance := range expect.Created {
+		if key, err := parseInstance(engine, instance); err != nil {
+			fail("created instance %s: %v", instance, err)
+		} else if !created[key] {
+			fail("expected %s to be created", instance)
+		}
+	}
+
+	for _, instance := range expect.Terminated {
+		if key, err := parseInstance(engine, instance); err != nil {
+			fail("terminated instance %s: %v", instance, err)
+		} else if !terminated[key] {
+			fail("expected %s to be terminated", instance)
+		}
+	}
+
+	return result
+}
+
+// instanceKey formats an instance, so that instances can be compared.
+func instanceKey(instance eflint.Expression) string {
+	return eflint.FormatExpression(instance)
+}
+
+// parseInstance parses an instance in eFLINT syntax, such as greet(Alice,
+// Bob), and formats it the way the engine reports it.
+func parseInstance(engine *eflint.Engine, source string) (string, error) {
+	phrases, err := parsePhrases("instance", strings.NewReader("?"+source+"."))
+	if err != nil {
+		return "", err
+	}
+	if len(phrases) != 1 || phrases[0].Expression == nil {
+		return "", fmt.Errorf("not an instance")
+	}
+
+	instance, err := engine.Instance(*phrases[0].Expression)
+	if err != nil {
+		return "", err
+	}
+
+	return instanceKey(instance), nil
+}
+
+// expectedQuery formats the expected result of a query the same way as the
+// actual results are formatted.
+func expectedQuery(engine *eflint.Engine, raw json.RawMessage) (string, error) {
+	var result bool
+	if err := json.Unmarshal(raw, &result); err == nil {
+		return fmt.Sprint(result), nil
+	}
+
+	var sources []string
+	if err := json.Unmarshal(raw, &sources); err != nil {
+		return "", fmt.Errorf("expected a boolean or a list of instances")
+	}
+
+	instances := make([]string, 0, len(sources))
+	for _, source := range sources {
+		instance, err := parseInstance(engine, source)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", source, err)
+		}
+		instances = append(instances, instance)
+	}
+
+	return formatSet(instances), nil
+}
+
+func compareViolations(engine *eflint.Engine, fail func(string, ...interface{}), expected []expectedViolation, actual []string) {
+	remaining := append([]string{}, actual...)
+
+	for _, violation := range expected {
+		prefix := violation.Kind + " " + violation.Identifier + " "
+		if violation.Instance != "" {
+			instance, err := parseInstance(engine, violation.Instance)
+			if err != nil {
+				fail("violation %s: %v", violation.Instance, err)
+				continue
+			}
+			prefix += instance
+		}
+
+		found := false
+		for i, candidate := range remaining {
+			if strings.HasPrefix(candidate, prefix) {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			fail("expected violation %s", strings.TrimSpace(prefix))
+		}
+	}
+
+	for _, violation := range remaining {
+		fail("unexpected violation %s", violation)
+	}
+}
+
+// compareSets fails if the expected and actual values differ, regardless of
+// their order.
+func compareSets(fail func(string, ...interface{}), name string, expected []string, actual []string) {
+	if formatSet(expected) != formatSet(actual) {
+		fail("expected %s %s, got %s", name, formatSet(expected), formatSet(actual))
+	}
+}
+
+func formatSet(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+
+	return "[" + strings.Join(sorted, ", ") + "]"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScenario(t *testing.T) {
+	loaded, err := loadScenario("testdata/borrowing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := loaded.run()
+	if len(outcomes) != len(loaded.Steps)+1 {
+		t.Fatalf("Expected a test case for the specification and every step, got %d", len(outcomes))
+	}
+
+	for _, o := range outcomes {
+		if !o.passed() || o.Skipped {
+			t.Errorf("Expected %s to pass, got %v", o.Name, o.Failures)
+		}
+	}
+}
+
+func TestScenarioFailures(t *testing.T) {
+	dir := t.TempDir()
+	spec, _ := os.ReadFile("testdata/borrowing.eflint")
+	os.WriteFile(filepath.Join(dir, "borrowing.eflint"), spec, 0o644)
+	os.WriteFile(filepath.Join(dir, "failing.json"), []byte(`{
+		"specification": "borrowing.eflint",
+		"steps": [
+			{"name": "wrong outcome", "phrases": "borrow(Bob, Dune).\n?lent(Bob, Dune).", "expect": {
+				"queries": [false],
+				"violations": [],
+				"created": ["lent(Alice, Dune)"]
+			}},
+			{"name": "syntax error", "phrases": "borrow(Alice"},
+			{"name": "skipped", "phrases": "borrow(Alice, Dune)."}
+		]
+	}`), 0o644)
+
+	loaded, err := loadScenario(filepath.Join(dir, "failing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := loaded.run()
+	if loaded.Name != "failing" || len(outcomes) != 4 {
+		t.Fatalf("Expected 4 test cases of scenario failing, got %d of %s", len(outcomes), loaded.Name)
+	}
+
+	expected := []string{
+		"query 1: expected false, got true",
+		`unexpected violation act borrow borrow(person("Bob"),book("Dune"))`,
+		"expected lent(Alice, Dune) to be created",
+	}
+	if strings.Join(outcomes[1].Failures, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the failures:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(outcomes[1].Failures, "\n"))
+	}
+	if outcomes[2].passed() || !outcomes[3].Skipped {
+		t.Error("Expected the steps after a syntax error to be skipped")
+	}
+
+	reports := []report{{Scenario: loaded.Name, Outcomes: outcomes}}
+
+	var tap bytes.Buffer
+	if err := writeTAP(&tap, reports); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1..4", "ok 1 - failing: specification", "not ok 2 - failing: wrong outcome",
+		`    - "query 1: expected false, got true"`, "ok 4 - failing: skipped # SKIP"} {
+		if !strings.Contains(tap.String(), line+"\n") && !strings.Contains(tap.String(), line+" ") {
+			t.Errorf("Expected %q in the TAP report:\n%s", line, tap.String())
+		}
+	}
+
+	var junit bytes.Buffer
+	if err := writeJUnit(&junit, reports); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(junit.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 4 || suites.Failures != 2 || suites.Skipped != 1 || suites.Suites[0].Cases[1].Failure == nil {
+		t.Errorf("Expected 4 tests with 2 failures and 1 skipped, got:\n%s", junit.String())
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/session"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// These tests are meant to be run with the race detector enabled:
+//
+//	go test -race ./cmd/eflint-server
+
+func serve(handler http.Handler, method string, path string, body []byte) (int, map[string]interface{}, error) {
+	request, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	response := httptest.NewRecorder()
+
+	handler.ServeHTTP(response, request)
+
+	var result map[string]interface{}
+	if response.Code == http.StatusOK {
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			return response.Code, nil, err
+		}
+	}
+
+	return response.Code, result, nil
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	handler := newServeMux()
+	inputs := make(map[string][]byte)
+
+	filepath.WalkDir("tests/correctness", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		data, err := parser.ParseFile(path, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inputs[path] = data
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 4*len(inputs))
+
+	for i := 0; i < 4; i++ {
+		for path, data := range inputs {
+			wg.Add(1)
+			go func(path string, data []byte) {
+				defer wg.Done()
+
+				_, result, err := serve(handler, "POST", "/", data)
+				if err != nil {
+					errors <- err
+					return
+				}
+
+				if result["success"] != true {
+					errors <- fmt.Errorf("%s: expected success to be true", path)
+					return
+				}
+
+				// Every phrase of the request needs exactly one result
+				var input map[string]interface{}
+				json.Unmarshal(data, &input)
+
+				if len(result["results"].([]interface{})) != len(input["phrases"].([]interface{})) {
+					errors <- fmt.Errorf("%s: expected a result for every phrase", path)
+				}
+			}(path, data)
+		}
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	useSessions(t, session.NewManager())
+	handler := newServeMux()
+	ids := []string{"concurrent-1", "concurrent-2", "concurrent-3", "concurrent-4"}
+	requests := 25
+
+	for _, id := range ids {
+		if code, _, _ := serve(handler, "POST", "/sessions", []byte(`{"id": "`+id+`"}`)); code != http.StatusCreated {
+			t.Fatal("Could not create session", id)
+		}
+
+		serve(handler, "POST", "/", []byte(`{"version": "0.1.0", "kind": "phrases", "session": "`+id+`", "phrases": [
+			{"kind": "afact", "name": "counter", "type": "Int"}
+		]}`))
+	}
+
+	var wg sync.WaitGroup
+
+	for _, id := range ids {
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(id string, i int) {
+				defer wg.Done()
+
+				serve(handler, "POST", "/", []byte(fmt.Sprintf(`{"version": "0.1.0", "kind": "phrases", "session": "%s", "phrases": [
+					{"kind": "create", "operand": {"identifier": "counter", "operands": [%d]}}
+				]}`, id, i)))
+			}(id, i)
+		}
+
+		// Listing the sessions should not interfere with the requests
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handler, "GET", "/sessions", nil)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, id := range ids {
+		_, result, err := serve(handler, "POST", "/", []byte(`{"version": "0.1.0", "kind": "phrases", "session": "`+id+`", "phrases": [
+			{"kind": "iquery", "expression": ["counter"]}
+		]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		instances := result["results"].([]interface{})[0].(map[string]interface{})["result"].([]interface{})
+		if len(instances) != requests {
+			t.Errorf("%s: expected %d instances, got %d", id, requests, len(instances))
+		}
+	}
+}
+
+func TestConcurrentDelete(t *testing.T) {
+	dir := t.TempDir()
+	openSessions(t, dir)
+	handler := newServeMux()
+
+	if code, _, _ := serve(handler, "POST", "/sessions", []byte(`{"id": "deleted"}`)); code != http.StatusCreated {
+		t.Fatal("Could not create session")
+	}
+	serve(handler, "POST", "/", []byte(`{"version": "0.1.0", "kind": "phrases", "session": "deleted", "phrases": [
+		{"kind": "afact", "name": "counter", "type": "Int"}
+	]}`))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 50)
+
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			code, _, _ := serve(handler, "POST", "/", []byte(fmt.Sprintf(`{"version": "0.1.0", "kind": "phrases", "session": "deleted", "phrases": [
+				{"kind": "create", "operand": {"identifier": "counter", "operands": [%d]}}
+			]}`, i)))
+			codes <- code
+		}(i)
+
+		if i == cap(codes)/2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if code, _, _ := serve(handler, "DELETE", "/sessions/deleted", nil); code != http.StatusNoContent {
+					t.Error("Could not delete session, got", code)
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+	close(codes)
+
+	// Requests either finish before the session is deleted or fail cleanly
+	for code := range codes {
+		if code != http.StatusOK && code != http.StatusNotFound {
+			t.Error("Expected the request to succeed or the session to be unknown, got", code)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "deleted")); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be stored for the deleted session, got", err)
+	}
+}
@@ -4,20 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
 	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/session"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestServer(t *testing.T) {
-	// Go over all the files in the test directory
-	// and run the tests
+	// Go over all the files in the test directories
+	// and run the tests. The deviations are cases in which this
+	// implementation used to differ from the reference reasoner.
+	for _, directory := range []string{"tests/correctness", "tests/deviations"} {
+		testDirectory(t, directory)
+	}
+}
 
-	filepath.WalkDir("tests/correctness", func(path string, d os.DirEntry, err error) error {
+func testDirectory(t *testing.T, directory string) {
+	filepath.WalkDir(directory, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -175,3 +186,949 @@ func BenchmarkHaskellDimensionality(b *testing.B) {
 func BenchmarkServerCombinatorial(b *testing.B) {
 	benchmarkDirectoryServer(b, "tests/performance/combinatorial")
 }
+
+func sendPhrases(t *testing.T, session string, phrases string) map[string]interface{} {
+	body := `{"version": "0.1.0", "kind": "phrases", "updates": true, "session": "` + session + `", "phrases": [` + phrases + `]}`
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(body)))
+	response := httptest.NewRecorder()
+
+	eFLINTHandler(response, request)
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	return result
+}
+
+// useSessions replaces the sessions of the server until the end of the test.
+func useSessions(t *testing.T, manager *session.Manager) {
+	previous := sessions
+	sessions = manager
+	t.Cleanup(func() { sessions = previous })
+}
+
+func TestSessions(t *testing.T) {
+	useSessions(t, session.NewManager())
+
+	for _, id := range []string{"first", "second"} {
+		request, _ := http.NewRequest("POST", "/sessions", bytes.NewReader([]byte(`{"id": "`+id+`"}`)))
+		response := httptest.NewRecorder()
+		sessionsHandler(response, request)
+
+		if response.Code != http.StatusCreated {
+			t.Fatal("Could not create session:", response.Body.String())
+		}
+	}
+
+	sendPhrases(t, "first", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+	first, _ := sessions.Get("first")
+	sendPhrases(t, "second", `{"kind": "afact", "name": "person", "type": "String"}`)
+
+	query := `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Alice"]}}`
+
+	result := sendPhrases(t, "first", query)
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the first session to keep its instances")
+	}
+
+	result = sendPhrases(t, "second", query)
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != false {
+		t.Fatal("Expected the second session to be isolated from the first")
+	}
+
+	request, _ := http.NewRequest("DELETE", "/sessions/first", nil)
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Could not delete session:", response.Body.String())
+	}
+
+	if _, err := sessions.Get("first"); err == nil {
+		t.Fatal("Expected the session to be deleted")
+	}
+
+	// Requests that got hold of the session before cannot use it anymore
+	if err := first.Lock(); !errors.Is(err, session.ErrSessionClosed) {
+		t.Fatal("Expected the deleted session to be closed, got", err)
+	}
+
+	// Failures are reported in the same form as those of phrases
+	for _, failing := range []struct {
+		method, path, body string
+		status             int
+		id                 string
+	}{
+		{"POST", "/sessions", `{"id": "second"}`, http.StatusConflict, "session-exists"},
+		{"POST", "/sessions", `{"name": "third"}`, http.StatusBadRequest, "parse-error"},
+		{"GET", "/sessions/first", "", http.StatusNotFound, "unknown-session"},
+		{"DELETE", "/sessions/first", "", http.StatusNotFound, "unknown-session"},
+	} {
+		request, _ := http.NewRequest(failing.method, failing.path, strings.NewReader(failing.body))
+		response := httptest.NewRecorder()
+		sessionsHandler(response, request)
+
+		var output eflint.Output
+		if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+			t.Fatal(err, response.Body.String())
+		}
+
+		if response.Code != failing.status || output.Success || len(output.Errors) != 1 || output.Errors[0].Id != failing.id {
+			t.Errorf("Expected %s %s to fail with %d and %s, got %d and %s", failing.method, failing.path, failing.status, failing.id, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	useSessions(t, session.NewManager())
+	if _, err := sessions.Create("methods", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, disallowed := range []struct {
+		method, path, allow string
+	}{
+		{"PUT", "/sessions", "GET, POST"},
+		{"POST", "/sessions/methods", "GET, DELETE"},
+		{"DELETE", "/sessions/methods/snapshot", "GET, PUT"},
+		{"POST", "/sessions/methods/history", "GET"},
+		{"POST", "/sessions/methods/history/graph", "GET"},
+		{"GET", "/sessions/methods/history/undo", "POST"},
+	} {
+		request, _ := http.NewRequest(disallowed.method, disallowed.path, nil)
+		response := httptest.NewRecorder()
+		sessionsHandler(response, request)
+
+		var output eflint.Output
+		if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+			t.Fatal(err, response.Body.String())
+		}
+
+		if response.Code != http.StatusMethodNotAllowed || len(output.Errors) != 1 || output.Errors[0].Id != "method-not-allowed" {
+			t.Errorf("Expected %s %s to be a method-not-allowed, got %d and %s", disallowed.method, disallowed.path, response.Code, response.Body.String())
+		}
+
+		if allow := response.Header().Get("Allow"); allow != disallowed.allow {
+			t.Errorf("Expected %s %s to allow %s, got %s", disallowed.method, disallowed.path, disallowed.allow, allow)
+		}
+	}
+}
+
+func TestStateless(t *testing.T) {
+	phrases := `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "create", "stateless": true, "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Alice"]}}`
+
+	// The changes of stateless phrases are reported, also when the updates
+	// are not requested
+	for _, updates := range []string{"true", "false"} {
+		body := `{"version": "0.1.0", "kind": "phrases", "updates": ` + updates + `, "phrases": [` + phrases + `]}`
+		request, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		response := httptest.NewRecorder()
+
+		eFLINTHandler(response, request)
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Fatal(err, response.Body.String())
+		}
+
+		results := result["results"].([]interface{})
+
+		changes, _ := results[1].(map[string]interface{})["changes"].([]interface{})
+		if len(changes) != 1 || changes[0].(map[string]interface{})["kind"] != "create" {
+			t.Fatal("Expected the stateless create to be reported with updates", updates)
+		}
+
+		if results[2].(map[string]interface{})["result"] != false {
+			t.Fatal("Expected the stateless create not to be committed with updates", updates)
+		}
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	result := sendPhrases(t, "", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+
+	results := result["results"].([]interface{})
+
+	// The declaration is reported as it was sent
+	declared := results[0].(map[string]interface{})["changes"].([]interface{})
+	if _, ok := declared[0].(map[string]interface{})["updates"]; len(declared) != 1 || ok {
+		t.Error("Expected the declaration to be reported as it was sent, got", declared)
+	}
+
+	// A phrase that changes nothing still has a list of changes
+	unchanged, ok := results[2].(map[string]interface{})["changes"].([]interface{})
+	if !ok || len(unchanged) != 0 {
+		t.Error("Expected an empty list of changes, got", results[2])
+	}
+}
+
+func sendEFLINT(t *testing.T, target string, source string) map[string]interface{} {
+	request, _ := http.NewRequest("POST", target, strings.NewReader(source))
+	request.Header.Set("Content-Type", "text/x-eflint; charset=utf-8")
+	response := httptest.NewRecorder()
+
+	eFLINTHandler(response, request)
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	return result
+}
+
+func TestEFLINTSyntax(t *testing.T) {
+	useSessions(t, session.NewManager())
+	sessions.Create("syntax", false)
+
+	sendEFLINT(t, "/?session=syntax", "Fact person Identified by String.\n+person(Alice).")
+	result := sendEFLINT(t, "/?session=syntax", "?person(Alice).")
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the phrases in eFLINT syntax to be interpreted in the session, got", result)
+	}
+
+	result = sendEFLINT(t, "/", "Fact person Identified by String.\n+person(Alice")
+	if result["success"] != false {
+		t.Fatal("Expected a parse error, got", result)
+	}
+
+	failure := result["errors"].([]interface{})[0].(map[string]interface{})
+	position, _ := failure["position"].(map[string]interface{})
+	if failure["id"] != "parse-error" || position["line"] != 2.0 || position["column"] != 14.0 {
+		t.Fatal("Expected a parse error at line 2, column 14, got", failure)
+	}
+
+	result = sendEFLINT(t, "/", `Fact [natural person] Identified by String.
+Fact art6-consent Identified by [natural person] * purpose.
+Fact purpose Identified by String.
+Fact person Identified by String.
+Fact knows Identified by person * person'.
+Predicate acquainted When Exists person, person' : knows(person, person').
++art6-consent("Alice Smith", "GDPR-Art.6").
++person("Alice Smith").
++person(Bob).
++knows("Alice Smith", Bob).
+?art6-consent("Alice Smith", "GDPR-Art.6").
+?acquainted.`)
+	results := result["results"].([]interface{})
+	if result["success"] != true || results[10].(map[string]interface{})["result"] != true || results[11].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected quoted strings, escaped identifiers and primed variables to be interpreted, got", result)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	result := sendEFLINT(t, "/", `#include "definitions.eflint".`)
+	if failure := result["errors"].([]interface{})[0].(map[string]interface{}); failure["id"] != "parse-error" {
+		t.Fatal("Expected includes to fail without a library, got", result)
+	}
+
+	library = parser.Library(fstest.MapFS{
+		"definitions.eflint": {Data: []byte("Fact person Identified by String.")},
+	})
+	defer func() { library = nil }()
+
+	result = sendEFLINT(t, "/", "#require \"definitions.eflint\".\n+person(Alice).\n?person(Alice).")
+	results := result["results"].([]interface{})
+	if len(results) != 3 || results[2].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the included phrases to be interpreted, got", result)
+	}
+
+	result = sendEFLINT(t, "/", `#include "../main.go".`)
+	failure := result["errors"].([]interface{})[0].(map[string]interface{})
+	if failure["message"] != "cannot include ../main.go: the file is outside of the library" {
+		t.Fatal("Expected files outside of the library to be refused, got", failure)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	result := sendEFLINT(t, "/", "Fact person Identified by String.\n?person(Alice) && animal(Bob).")
+	failure := result["errors"].([]interface{})[0].(map[string]interface{})
+	if failure["id"] != "unknown-fact" || failure["position"].(map[string]interface{})["column"] != 19.0 {
+		t.Fatal("Expected the error to be located at the unknown fact, got", failure)
+	}
+
+	// The positions of expressions survive the conversion to JSON
+	data, err := parser.ParseFile("case.eflint", strings.NewReader("Fact person Identified by String.\n?person(Alice) && animal(Bob)."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+	eFLINTHandler(response, request)
+
+	var located map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &located); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+	failure = located["errors"].([]interface{})[0].(map[string]interface{})
+	position := failure["position"].(map[string]interface{})
+	if failure["id"] != "unknown-fact" || position["file"] != "case.eflint" || position["line"] != 2.0 || position["column"] != 19.0 {
+		t.Fatal("Expected the error in the JSON to be located at the unknown fact, got", failure)
+	}
+
+	request, _ = http.NewRequest("POST", "/", strings.NewReader(`Fact person Identified by String.
+Event wake Related to person Syncs with greet(person, person).
+Act greet Actor person Related to recipient Holds when False.
+Placeholder recipient For person.
++person(Alice).
+wake(Alice).`))
+	request.Header.Set("Content-Type", "text/x-eflint")
+	response = httptest.NewRecorder()
+	eFLINTHandler(response, request)
+
+	var output eflint.Output
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	// Triggers and violations are located at the declaration of their fact
+	triggered := output.Results[5]
+	if len(triggered.Triggers) != 2 || *triggered.Triggers[0].Position != (eflint.Position{Line: 2, Column: 1}) ||
+		triggered.Triggers[1].Parent != "wake" || *triggered.Triggers[1].Position != (eflint.Position{Line: 3, Column: 1}) {
+		t.Fatal("Expected the triggers of wake and greet, got", triggered.Triggers)
+	}
+	if len(triggered.Violations) != 1 || *triggered.Violations[0].Position != (eflint.Position{Line: 3, Column: 1}) {
+		t.Fatal("Expected the disabled act to be located at its declaration, got", triggered.Violations)
+	}
+}
+
+func TestViolations(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"version": "0.1.0", "kind": "handshake"}`))
+	response := httptest.NewRecorder()
+	eFLINTHandler(response, request)
+	if !strings.Contains(response.Body.String(), `"shares_violations":true`) {
+		t.Fatal("Expected the handshake to advertise violations, got", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("POST", "/", strings.NewReader(`Fact person Identified by String.
+Fact late Identified by person.
+Duty pay Holder person Claimant recipient Violated when late(person).
+Placeholder recipient For person.
+Invariant everyone-on-time When Forall person : !late(person).
++person(Alice).
++person(Bob).
++pay(Alice, Bob).
++late(Alice).
++late(Bob).
+-pay(Alice, Bob).`))
+	request.Header.Set("Content-Type", "text/x-eflint")
+	response = httptest.NewRecorder()
+	eFLINTHandler(response, request)
+
+	var output eflint.Output
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	describe := func(violations []eflint.Violation) string {
+		descriptions := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			instance := eflint.FormatExpression(eflint.Expression{Identifier: violation.Identifier, Operands: violation.Operands})
+			for _, witness := range violation.Witnesses {
+				instance += " " + eflint.FormatExpression(witness[0])
+			}
+			descriptions = append(descriptions, strings.TrimSpace(violation.Kind+" "+instance+" "+violation.Change))
+		}
+		return strings.Join(descriptions, "; ")
+	}
+
+	expected := map[int]string{
+		7:  "",
+		8:  `invariant everyone-on-time() person("Alice"); duty pay(person("Alice"),person("Bob")) violated`,
+		9:  `invariant everyone-on-time() person("Alice") person("Bob"); duty pay(person("Alice"),person("Bob"))`,
+		10: `invariant everyone-on-time() person("Alice") person("Bob"); duty pay(person("Alice"),person("Bob")) unviolated`,
+	}
+	for index, description := range expected {
+		if actual := describe(output.Results[index].Violations); actual != description {
+			t.Errorf("Expected the violations of phrase %d to be %q, got %q", index+1, description, actual)
+		}
+	}
+
+	// Duties that are no longer violated do not make the phrase violated
+	request, _ = http.NewRequest("POST", "/", strings.NewReader(`Fact person Identified by String.
+Fact late Identified by person.
+Duty pay Holder person Claimant person Violated when late(person).
++person(Alice).
++late(Alice).
++pay(Alice, Alice).
+-pay(Alice, Alice).`))
+	request.Header.Set("Content-Type", "text/x-eflint")
+	response = httptest.NewRecorder()
+	eFLINTHandler(response, request)
+
+	output = eflint.Output{}
+	if err := json.Unmarshal(response.Body.Bytes(), &output); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+	if last := output.Results[6]; last.Violated || len(last.Violations) != 1 || last.Violations[0].Change != "unviolated" {
+		t.Error("Expected the terminated duty to be unviolated, got", last.Violated, last.Violations)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	// A triggered act is disabled exactly when Enabled is false for it, also
+	// when it holds but its conditions do not
+	result := sendEFLINT(t, "/", `Fact person Identified by String.
+Fact banned Identified by person.
+Act borrow Actor person Conditioned by !banned(person).
++person(Alice).
++person(Bob).
++banned(Bob).
++borrow(Alice).
++borrow(Bob).
+?Enabled(borrow(Alice)).
+?Enabled(borrow(Bob)).
+borrow(Alice).
+borrow(Bob).`)
+
+	results := result["results"].([]interface{})
+	for i, expected := range []bool{true, false} {
+		query := results[8+i].(map[string]interface{})
+		violations, _ := results[10+i].(map[string]interface{})["violations"].([]interface{})
+		if query["result"] != expected || (len(violations) == 0) != expected {
+			t.Errorf("Expected act %d to be enabled: %v, got %v and violations %v", i+1, expected, query["result"], violations)
+		}
+	}
+}
+
+func TestEnabledDeviations(t *testing.T) {
+	// Query Enabled before every triggered act of the deviations, and check
+	// that the trigger reports the act as disabled exactly when it is false
+	paths, _ := filepath.Glob("tests/deviations/*.eflint")
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			data, err := parser.ParseFile(path, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var input eflint.Input
+			if err := json.Unmarshal(data, &input); err != nil {
+				t.Fatal(err)
+			}
+
+			// Events are never disabled, so only the triggers of acts are checked
+			acts := make(map[string]bool)
+			phrases := make([]eflint.Phrase, 0, len(input.Phrases))
+			triggers := make([]int, 0)
+			for _, phrase := range input.Phrases {
+				if phrase.Kind == "act" {
+					acts[phrase.Name.(string)] = true
+				}
+
+				if phrase.Kind == "trigger" && acts[phrase.Operand.Identifier] {
+					phrases = append(phrases, eflint.Phrase{
+						Kind: "bquery",
+						Expression: &eflint.Expression{
+							Operator: "ENABLED",
+							Operands: []eflint.Expression{*phrase.Operand},
+						},
+					})
+					triggers = append(triggers, len(phrases))
+				}
+
+				phrases = append(phrases, phrase)
+			}
+
+			if len(triggers) == 0 {
+				t.Skip("No triggered acts")
+			}
+
+			input.Phrases = phrases
+			data, _ = json.Marshal(input)
+			request, _ := http.NewRequest("POST", "/", bytes.NewReader(data))
+			response := httptest.NewRecorder()
+
+			eFLINTHandler(response, request)
+
+			var result map[string]interface{}
+			if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+				t.Fatal(err, response.Body.String())
+			}
+
+			if result["success"] != true {
+				t.Fatal("Expected success to be true, got", result["errors"])
+			}
+
+			results := result["results"].([]interface{})
+			for _, index := range triggers {
+				trigger := phrases[index].Operand
+				enabled := results[index-1].(map[string]interface{})["result"] == true
+
+				disabled := false
+				violations, _ := results[index].(map[string]interface{})["violations"].([]interface{})
+				for _, violation := range violations {
+					violation := violation.(map[string]interface{})
+					disabled = disabled || violation["kind"] == "act" && violation["identifier"] == trigger.Identifier
+				}
+
+				if enabled == disabled {
+					t.Errorf("Expected %s to be disabled exactly when it is not enabled, got enabled %v and disabled %v",
+						eflint.FormatExpression(*trigger), enabled, disabled)
+				}
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	useSessions(t, session.NewManager())
+
+	// A failing phrase does not affect the other phrases
+	result := sendPhrases(t, "", `{"kind": "afact", "name": "person", "type": "String", "range": ["Bob"]},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Bob"]}}`)
+
+	if result["success"] != true {
+		t.Fatal("Expected the request to succeed")
+	}
+
+	results := result["results"].([]interface{})
+	failed := results[1].(map[string]interface{})
+	if failed["success"] != false {
+		t.Fatal("Expected the create of a value outside the range to fail")
+	}
+
+	errors := failed["errors"].([]interface{})
+	if len(errors) != 1 || errors[0].(map[string]interface{})["id"] != "range-violation" {
+		t.Fatal("Expected a range-violation error, got", errors)
+	}
+
+	if results[2].(map[string]interface{})["success"] != true {
+		t.Fatal("Expected the phrase after the error to succeed")
+	}
+
+	// Errors of the request itself are reported in the output
+	result = sendPhrases(t, "missing", `{"kind": "afact", "name": "person", "type": "String"}`)
+	if result["success"] != false || result["errors"].([]interface{})[0].(map[string]interface{})["id"] != "unknown-session" {
+		t.Fatal("Expected an unknown-session error, got", result)
+	}
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(`{"version": "0.1.0", "kind": "phrases", "phrases": [`)))
+	response := httptest.NewRecorder()
+	eFLINTHandler(response, request)
+
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result["success"] != false || result["errors"].([]interface{})[0].(map[string]interface{})["id"] != "parse-error" {
+		t.Fatal("Expected a parse-error, got", result)
+	}
+}
+
+func TestFailingExpressions(t *testing.T) {
+	result := sendPhrases(t, "", `{"kind": "afact", "name": "amount", "type": "Int"},
+		{"kind": "bquery", "expression": {"operator": "GT", "operands": [{"operator": "DIV", "operands": [1, 0]}, 0]}},
+		{"kind": "create", "operand": {"identifier": "amount", "operands": [3]}},
+		{"kind": "bquery", "expression": {"identifier": "amount", "operands": [3]}}`)
+
+	results := result["results"].([]interface{})
+	failed := results[1].(map[string]interface{})
+	if failed["success"] != false {
+		t.Fatal("Expected the division by zero to fail")
+	}
+
+	errors := failed["errors"].([]interface{})
+	if errors[0].(map[string]interface{})["id"] != "division-by-zero" {
+		t.Fatal("Expected a division-by-zero error, got", errors)
+	}
+
+	if results[3].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the phrases after the error to be interpreted")
+	}
+}
+
+func TestTypecheck(t *testing.T) {
+	useSessions(t, session.NewManager())
+	sessions.Create("typecheck", false)
+
+	declarations := `{"kind": "afact", "name": "amount", "type": "Int", "range": [1, 2]},
+		{"kind": "cfact", "name": "payment", "identified-by": ["person", "amount"]},
+		{"kind": "afact", "name": "person", "type": "String"}`
+
+	tests := map[string]string{
+		"unknown-fact":           `{"kind": "create", "operand": {"identifier": "animal", "operands": ["Rex"]}}`,
+		"arity-mismatch":         `{"kind": "create", "operand": {"identifier": "payment", "operands": ["Alice"]}}`,
+		"type-mismatch":          `{"kind": "create", "operand": {"identifier": "payment", "operands": [1, 2]}}`,
+		"non-integer-arithmetic": `{"kind": "bquery", "expression": {"operator": "LT", "operands": [{"identifier": "person", "operands": ["Alice"]}, 2]}}`,
+		"invalid-expression":     `{"kind": "bquery", "expression": {"operator": "HOLDS", "operands": [1]}}`,
+		"unknown-operator":       `{"kind": "bquery", "expression": {"operator": "XOR", "operands": [true, false]}}`,
+		"not-triggerable":        `{"kind": "trigger", "operand": {"identifier": "person", "operands": ["Alice"]}}`,
+		"range-violation":        `{"kind": "predicate", "name": "paid", "expression": {"identifier": "payment", "operands": ["Alice", 3]}}`,
+	}
+
+	for id, phrase := range tests {
+		result := sendPhrases(t, "typecheck", declarations+", "+phrase)
+
+		if result["success"] != false || result["results"] != nil {
+			t.Fatal("Expected", phrase, "to be rejected before interpretation")
+		}
+
+		failure := result["errors"].([]interface{})[0].(map[string]interface{})
+		if failure["id"] != id {
+			t.Fatal("Expected a", id, "error for", phrase, "got", failure)
+		}
+
+		if !strings.HasPrefix(failure["message"].(string), "phrase 4: ") {
+			t.Fatal("Expected the error to refer to phrase 4, got", failure["message"])
+		}
+	}
+
+	// Nothing was interpreted for the rejected requests
+	result := sendPhrases(t, "typecheck", `{"kind": "bquery", "expression": {"identifier": "amount", "operands": [1]}}`)
+	if result["success"] != false {
+		t.Fatal("Expected amount not to be declared, got", result)
+	}
+
+	// Queries may refer to values outside the range of a fact
+	result = sendPhrases(t, "typecheck", declarations+`,
+		{"kind": "bquery", "expression": {"identifier": "payment", "operands": ["Alice", 3]}}`)
+	if result["success"] != true {
+		t.Fatal("Expected the declarations to be accepted, got", result)
+	}
+}
+
+func TestSyncCycles(t *testing.T) {
+	// Acts and events that sync with each other are triggered once, instead of
+	// overflowing the stack of the server
+	result := sendEFLINT(t, "/", `Fact light Identified by On, Off.
+Event on Creates light(On) Syncs with off().
+Event off Creates light(Off) Syncs with on().
+Act toggle Actor light Syncs with toggle(light).
+on().
+?light(On) && light(Off).
+toggle(On).
+?light(On).`)
+
+	if result["success"] != true {
+		t.Fatal("Expected success to be true, got", result)
+	}
+
+	results := result["results"].([]interface{})
+	for i, expected := range map[int]int{4: 2, 6: 1} {
+		triggers := results[i].(map[string]interface{})["triggers"].([]interface{})
+		if len(triggers) != expected {
+			t.Errorf("Expected phrase %d to trigger %d instances, got %v", i+1, expected, triggers)
+		}
+	}
+
+	for _, i := range []int{5, 7} {
+		if results[i].(map[string]interface{})["result"] != true {
+			t.Error("Expected query", i+1, "to hold, got", results[i])
+		}
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	handler := recoverer(func(w http.ResponseWriter, r *http.Request) {
+		panic("bad phrase")
+	})
+
+	request, _ := http.NewRequest("POST", "/", nil)
+	response := httptest.NewRecorder()
+	handler(response, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatal("Expected status 500, got", response.Code)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result["errors"].([]interface{})[0].(map[string]interface{})["id"] != "internal-error" {
+		t.Fatal("Expected an internal-error, got", result)
+	}
+}
+
+func snapshotRequest(method string, id string, body []byte) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "/sessions/"+id+"/snapshot", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	return response
+}
+
+func TestSnapshot(t *testing.T) {
+	useSessions(t, session.NewManager())
+
+	for _, id := range []string{"source", "target"} {
+		if _, err := sessions.Create(id, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendPhrases(t, "source", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "afact", "name": "visitor", "type": "String"},
+		{"kind": "placeholder", "name": ["guest"], "for": "visitor"},
+		{"kind": "cfact", "name": "greeted", "identified-by": ["guest"]},
+		{"kind": "act", "name": "greet", "actor": "person", "related-to": ["guest"],
+			"creates": [{"identifier": "greeted", "operands": [["guest"]]}],
+			"holds-when": [{"operator": "NOT", "operands": [{"identifier": "greeted", "operands": [["guest"]]}]}]},
+		{"kind": "cfact", "name": "welcome", "identified-by": ["visitor"],
+			"derived-from": [{"iterator": "FOREACH", "binds": ["guest"], "expression": {"operator": "WHEN", "operands": [
+				{"identifier": "welcome", "operands": [["guest"]]}, {"identifier": "greeted", "operands": [["guest"]]}]}}]},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "create", "operand": {"identifier": "visitor", "operands": ["Bob"]}},
+		{"kind": "create", "operand": {"identifier": "visitor", "operands": ["Carol"]}},
+		{"kind": "trigger", "operand": {"identifier": "greet", "operands": ["Alice", "Bob"]}},
+		{"kind": "terminate", "operand": {"identifier": "visitor", "operands": ["Carol"]}}`)
+
+	exported := snapshotRequest("GET", "source", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatal("Could not export snapshot:", exported.Body.String())
+	}
+
+	if response := snapshotRequest("PUT", "target", exported.Body.Bytes()); response.Code != http.StatusOK {
+		t.Fatal("Could not import snapshot:", response.Body.String())
+	}
+
+	queries := map[string]bool{
+		`{"identifier": "greeted", "operands": ["Bob"]}`:                                               true,
+		`{"identifier": "welcome", "operands": ["Bob"]}`:                                               true,
+		`{"identifier": "visitor", "operands": ["Carol"]}`:                                             false,
+		`{"operator": "ENABLED", "operands": [{"identifier": "greet", "operands": ["Alice", "Bob"]}]}`: false,
+	}
+	for query, expected := range queries {
+		result := sendPhrases(t, "target", `{"kind": "bquery", "expression": `+query+`}`)
+		if result["results"].([]interface{})[0].(map[string]interface{})["result"] != expected {
+			t.Errorf("Expected %s to be %v after importing the snapshot", query, expected)
+		}
+	}
+
+	// Exporting the imported state gives the same snapshot
+	if reexported := snapshotRequest("GET", "target", nil); reexported.Body.String() != exported.Body.String() {
+		t.Errorf("Expected the same snapshot after importing it, got:\n%s\ninstead of:\n%s", reexported.Body.String(), exported.Body.String())
+	}
+
+	// A snapshot that cannot be interpreted does not change anything
+	invalid := `{"version": "0.1.0", "kind": "phrases", "phrases": [{"kind": "create", "operand": {"identifier": "animal", "operands": ["Rex"]}}]}`
+	response := snapshotRequest("PUT", "target", []byte(invalid))
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "unknown-fact") {
+		t.Fatal("Expected the invalid snapshot to be rejected, got:", response.Body.String())
+	}
+
+	result := sendPhrases(t, "target", `{"kind": "bquery", "expression": {"identifier": "greeted", "operands": ["Bob"]}}`)
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the state to be kept after a failed import")
+	}
+
+	if response := snapshotRequest("GET", "unknown", nil); response.Code != http.StatusNotFound {
+		t.Fatal("Expected a snapshot of an unknown session to be not found, got", response.Code)
+	}
+}
+
+func sendHistory(t *testing.T, id string, action string, body string) eflint.History {
+	method, path := "GET", "/sessions/"+id+"/history"
+	if action != "" {
+		method, path = "POST", path+"/"+action
+	}
+
+	request, _ := http.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Could not %s the history: %s", method, response.Body.String())
+	}
+
+	var history eflint.History
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+
+	return history
+}
+
+func TestHistory(t *testing.T) {
+	useSessions(t, session.NewManager())
+
+	if _, err := sessions.Create("history", true); err != nil {
+		t.Fatal(err)
+	}
+
+	holds := func(name string) bool {
+		result := sendPhrases(t, "history", `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["`+name+`"]}}`)
+		return result["results"].([]interface{})[0].(map[string]interface{})["result"] == true
+	}
+
+	// Queries and stateless phrases do not record a state
+	sendPhrases(t, "history", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "create", "stateless": true, "operand": {"identifier": "person", "operands": ["Carol"]}},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Bob"]}}`)
+
+	history := sendHistory(t, "history", "", "")
+	if history.Current != 3 || len(history.States) != 4 {
+		t.Fatalf("Expected states 0 to 3, got %+v", history)
+	}
+	if changes := history.States[2].Changes; len(changes) != 1 || changes[0].Kind != "create" {
+		t.Errorf("Expected state 2 to show the creation of Alice, got %+v", changes)
+	}
+
+	history = sendHistory(t, "history", "revert", `{"state": 1}`)
+	if history.Current != 1 || holds("Alice") || holds("Bob") {
+		t.Fatal("Expected the state after the declaration only")
+	}
+
+	history = sendHistory(t, "history", "redo", "")
+	if history.Current != 2 || !holds("Alice") || holds("Bob") {
+		t.Fatal("Expected the state after creating Alice")
+	}
+
+	// A new line of history keeps the old one, which can still be returned to
+	history = sendHistory(t, "history", "branch", `{"state": 1}`)
+	sendPhrases(t, "history", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Dave"]}}`)
+
+	history = sendHistory(t, "history", "", "")
+	if history.Line != 1 || len(history.Lines) != 2 || history.Current != 4 || history.States[2].Parent != 1 {
+		t.Fatalf("Expected a new line from state 1, got %+v", history)
+	}
+	if holds("Alice") || !holds("Dave") {
+		t.Fatal("Expected the state of the new line")
+	}
+
+	history = sendHistory(t, "history", "revert", `{"state": 3}`)
+	if history.Line != 0 || !holds("Bob") || holds("Dave") {
+		t.Fatal("Expected the state of the old line after reverting to it")
+	}
+
+	// Changing the state after an undo starts a new line, which keeps the
+	// states that were undone
+	sendHistory(t, "history", "undo", "")
+	sendPhrases(t, "history", `{"kind": "terminate", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+
+	history = sendHistory(t, "history", "", "")
+	if history.Line != 2 || len(history.Lines) != 3 || len(history.States) != 4 || history.States[3].Number != 5 || history.States[3].Parent != 2 {
+		t.Fatalf("Expected state 5 on a new line from state 2, got %+v", history)
+	}
+
+	request, _ := http.NewRequest("GET", "/sessions/history/history/graph", nil)
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	var graph eflint.Graph
+	if err := json.Unmarshal(response.Body.Bytes(), &graph); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+	if len(graph.States) != 6 || graph.Current != 5 || graph.States[3].Parent != 2 || graph.States[5].Parent != 2 {
+		t.Fatalf("Expected the undone state to be kept in the graph, got %+v", graph)
+	}
+
+	history = sendHistory(t, "history", "revert", `{"state": 3}`)
+	if history.Line != 0 || !holds("Alice") || !holds("Bob") {
+		t.Fatal("Expected the undone state to be restored")
+	}
+
+	request, _ = http.NewRequest("POST", "/sessions/history/history/revert", bytes.NewReader([]byte(`{"state": 42}`)))
+	response = httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "unknown-state") {
+		t.Fatal("Expected an unknown state to be unknown, got:", response.Body.String())
+	}
+
+	// The history is only recorded when it is asked for
+	if response := createSession("plain", false); response.Code != http.StatusCreated || strings.Contains(response.Body.String(), `"history":true`) {
+		t.Fatal("Could not create a session without history:", response.Body.String())
+	}
+	sendPhrases(t, "plain", `{"kind": "afact", "name": "person", "type": "String"}`)
+
+	request, _ = http.NewRequest("GET", "/sessions/plain/history", nil)
+	response = httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusConflict || !strings.Contains(response.Body.String(), "no-history") {
+		t.Fatal("Expected the history of a session without history to be unavailable, got:", response.Body.String())
+	}
+}
+
+func TestGraph(t *testing.T) {
+	useSessions(t, session.NewManager())
+
+	if _, err := sessions.Create("graph", true); err != nil {
+		t.Fatal(err)
+	}
+
+	sendPhrases(t, "graph", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "placeholder", "name": ["recipient"], "for": "person"},
+		{"kind": "cfact", "name": "greeted", "identified-by": ["recipient"]},
+		{"kind": "act", "name": "greet", "actor": "person", "related-to": ["recipient"],
+			"creates": [{"identifier": "greeted", "operands": [["recipient"]]}],
+			"holds-when": [{"operator": "NOT", "operands": [{"identifier": "greeted", "operands": [["recipient"]]}]}]},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Bob"]}},
+		{"kind": "create", "operand": {"identifier": "person", "operands": ["Carol"]}}`)
+	sendPhrases(t, "graph", `{"kind": "trigger", "operand": {"identifier": "greet", "operands": ["Alice", "Bob"]}}`)
+
+	// What if Alice greeted Carol instead?
+	sendHistory(t, "graph", "branch", `{"state": 7}`)
+	sendPhrases(t, "graph", `{"kind": "trigger", "operand": {"identifier": "greet", "operands": ["Alice", "Carol"]}}`)
+
+	request, _ := http.NewRequest("GET", "/sessions/graph/history/graph", nil)
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	var graph eflint.Graph
+	if err := json.Unmarshal(response.Body.Bytes(), &graph); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	if len(graph.States) != 10 || graph.Current != 9 || graph.States[8].Parent != 7 || graph.States[9].Parent != 7 {
+		t.Fatalf("Expected two alternatives after state 7, got %+v", graph)
+	}
+	if result := graph.States[9].Result; result == nil || !result.Success || result.Violated {
+		t.Error("Expected the result of the trigger on its edge, got", result)
+	}
+
+	request, _ = http.NewRequest("GET", "/sessions/graph/history/graph?format=dot", nil)
+	response = httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if !strings.Contains(response.Body.String(), `7 -> 9 [label="trigger greet(person(\"Alice\"),person(\"Carol\"))"]`) {
+		t.Error("Expected the trigger as an edge of the graph, got:", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/sessions/graph/history/compare?from=8&to=9", nil)
+	response = httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	var changes []eflint.Phrase
+	if err := json.Unmarshal(response.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err, response.Body.String())
+	}
+
+	found := make(map[string]bool)
+	for _, change := range changes {
+		operand, _ := json.Marshal(change.Operand)
+		found[change.Kind+" "+string(operand)] = true
+	}
+	if !found[`obfuscate {"identifier":"greeted","operands":[{"identifier":"person","operands":["Bob"]}]}`] ||
+		!found[`create {"identifier":"greeted","operands":[{"identifier":"person","operands":["Carol"]}]}`] {
+		t.Errorf("Expected greeted(Bob) to be replaced by greeted(Carol), got %v", found)
+	}
+
+	request, _ = http.NewRequest("GET", "/sessions/graph/history/compare?from=8&to=42", nil)
+	response = httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusNotFound {
+		t.Error("Expected comparing to an unknown state to fail, got", response.Code)
+	}
+}
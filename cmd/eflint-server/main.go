@@ -2,55 +2,147 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/session"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 )
 
-// handler for the root path
-func eFLINTHandler(w http.ResponseWriter, r *http.Request) {
+var sessions = session.NewManager()
+
+// library opens the files that are included by phrases in eFLINT syntax, which
+// cannot include any files if it is nil.
+var library parser.Loader
+
+// writeFailure responds with an unsuccessful output that explains why the
+// request failed.
+func writeFailure(w http.ResponseWriter, status int, failures ...eflint.Error) {
+	output, err := eflint.GenerateJSON(eflint.Output{Success: false, Errors: failures})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// decodeInput reads the input of a request. Requests with the text/x-eflint
+// content type contain phrases in eFLINT syntax, which are parsed on the
+// server. Their session is given by the session query parameter, and the
+// files they include are read from the library.
+func decodeInput(r *http.Request) (eflint.Input, []eflint.Error) {
 	var input eflint.Input
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&input)
 
-	// Check for parsing errors
-	if err != nil {
-		log.Println(err)
-		output, err := eflint.GenerateJSON(eflint.Output{Success: false})
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/x-eflint" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&input); err != nil {
+			// Errors of the input itself are reported as they are, anything
+			// else means that the request is not valid JSON
+			failure := eflint.ErrParse.Errorf("%v", err)
+			errors.As(err, &failure)
+			return input, []eflint.Error{failure}
+		}
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		return input, nil
+	}
+
+	ini, diagnostics := parser.ParseWith("", r.Body, library)
+	if len(diagnostics) > 0 {
+		failures := make([]eflint.Error, 0, len(diagnostics))
+		for _, diagnostic := range diagnostics {
+			failure := eflint.ErrParse.Errorf("%s", diagnostic.Message)
+			failure.Position = &eflint.Position{File: diagnostic.Pos.Filename, Line: diagnostic.Pos.Line, Column: diagnostic.Pos.Column}
+			failures = append(failures, failure)
 		}
+		return input, failures
+	}
+
+	input = parser.Convert(ini)
+	input.Session = r.URL.Query().Get("session")
+
+	return input, nil
+}
+
+// handler for the root path
+func eFLINTHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	input, failures := decodeInput(r)
 
-		w.Write(output)
+	// Check for parsing errors
+	if len(failures) > 0 {
+		log.Println(failures)
+		writeFailure(w, http.StatusOK, failures...)
 		return
 	}
 
-	err = eflint.Typecheck(input)
+	err := eflint.Typecheck(input)
 
 	// Check for typechecking errors
 	if err != nil {
 		log.Println(err)
-		output, err := eflint.GenerateJSON(eflint.Output{Success: false})
-
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.Write(output)
+		writeFailure(w, http.StatusOK, eflint.AsError(err))
 		return
 	}
 
 	//pp.Println(input)
 
 	// TODO: Do something with the input
+	var results []eflint.PhraseResult
 	switch input.Kind {
 	case "phrases":
-		eflint.InterpretPhrases(input.Phrases)
+		// Phrases without a session are interpreted in a fresh engine
+		engine := eflint.NewEngine()
+		var current *session.Session
+		if input.Session != "" {
+			current, err = sessions.Get(input.Session)
+			if err != nil {
+				writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+				return
+			}
+			// Requests for the same session are handled one at a time
+			if err := current.Lock(); err != nil {
+				writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+				return
+			}
+			defer current.Unlock()
+			engine = current.Engine
+		}
+
+		// Nothing is interpreted if any of the phrases is not correct
+		if failures := engine.TypecheckPhrases(input.Phrases); len(failures) > 0 {
+			writeFailure(w, http.StatusOK, failures...)
+			return
+		}
+
+		// The phrases are logged first, so that they are not lost when the
+		// server stops while they are interpreted
+		if current != nil {
+			if err := current.Log(input.Phrases); err != nil {
+				log.Println(err)
+				writeFailure(w, http.StatusInternalServerError, eflint.AsError(err))
+				return
+			}
+		}
+
+		results = engine.Interpret(input.Phrases, input.Updates)
+
+		if current != nil {
+			if err := current.Checkpoint(); err != nil {
+				// The phrases are logged already, so the session can still be
+				// recovered without the snapshot
+				log.Println("Could not store snapshot:", err)
+			}
+		}
 	case "handshake":
 		handshake, err := eflint.GenerateHandshake()
 		if err != nil {
@@ -62,12 +154,12 @@ func eFLINTHandler(w http.ResponseWriter, r *http.Request) {
 	case "ping":
 	default:
 		// TODO: This should have been handled by a typecheck function
-		http.Error(w, "Unknown kind", http.StatusBadRequest)
+		writeFailure(w, http.StatusBadRequest, eflint.ErrUnknownKind)
 		return
 	}
 
 	// Write the response
-	output, err := eflint.GenerateJSON(eflint.Output{Success: true})
+	output, err := eflint.GenerateJSON(eflint.Output{Success: true, Results: results})
 	//output, err := eflint.GenerateJSON(eflint.Output{Success: true, Phrases: input.Phrases})
 
 	if err != nil {
@@ -81,8 +173,55 @@ func eFLINTHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// recoverer turns a panic while handling a request into an internal error,
+// so a single bad request cannot take down the whole server.
+func recoverer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Println("Recovered from panic:", p)
+				writeFailure(w, http.StatusInternalServerError, eflint.ErrInternal.Errorf("internal error: %v", p))
+			}
+		}()
+
+		next(w, r)
+	}
+}
+
+// newServeMux creates the handler for all the paths of the server. Every
+// request is served in its own goroutine, so the handlers must not share
+// state without locking it.
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", recoverer(eFLINTHandler))
+	mux.HandleFunc("/sessions", recoverer(sessionsHandler))
+	mux.HandleFunc("/sessions/", recoverer(sessionsHandler))
+	return mux
+}
+
 func main() {
-	http.HandleFunc("/", eFLINTHandler)
+	dataDir := flag.String("data", "", "directory to persist sessions in, sessions are kept in memory only if empty")
+	snapshotInterval := flag.Int("snapshot-interval", 100, "number of requests to a session after which a snapshot of it is stored")
+	libraryDir := flag.String("library", "", "directory of the specifications that phrases in eFLINT syntax can include")
+	flag.Parse()
+
+	if *libraryDir != "" {
+		library = parser.Library(os.DirFS(*libraryDir))
+		log.Println("Including specifications from", *libraryDir)
+	}
+
+	if *dataDir != "" {
+		store, err := session.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if sessions, err = session.OpenManager(store, *snapshotInterval); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Persisting sessions in", *dataDir)
+	}
+
 	log.Println("Starting at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", newServeMux()))
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/session"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openSessions replaces the sessions of the server by the ones stored in dir,
+// as if the server was restarted.
+func openSessions(t *testing.T, dir string) {
+	store, err := session.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := session.OpenManager(store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSessions(t, manager)
+}
+
+func createSession(id string, history bool) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"id": %q, "history": %t}`, id, history)
+	request, _ := http.NewRequest("POST", "/sessions", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	return response
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	openSessions(t, dir)
+
+	if response := createSession("stored", false); response.Code != http.StatusCreated {
+		t.Fatal("Could not create session:", response.Body.String())
+	}
+
+	sendPhrases(t, "stored", `{"kind": "afact", "name": "person", "type": "String"},
+		{"kind": "placeholder", "name": ["someone"], "for": "person"}`)
+	sendPhrases(t, "stored", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+
+	// A snapshot is stored after every two requests, which replaces the log
+	if _, err := os.Stat(filepath.Join(dir, "stored", "snapshot.json")); err != nil {
+		t.Fatal("Expected a snapshot to be stored:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stored", "log.jsonl")); err == nil {
+		t.Fatal("Expected the log to be cleared after the snapshot")
+	}
+
+	sendPhrases(t, "stored", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Bob"]}},
+		{"kind": "terminate", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+	sendPhrases(t, "stored", `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Bob"]}},
+		{"kind": "create", "stateless": true, "operand": {"identifier": "person", "operands": ["Carol"]}}`)
+
+	openSessions(t, dir)
+
+	if _, err := sessions.Get("stored"); err != nil {
+		t.Fatal("Expected the session to be recovered:", err)
+	}
+
+	result := sendPhrases(t, "stored", `{"kind": "placeholder", "name": ["someone"], "for": "person"}`)
+	if result["errors"].([]interface{})[0].(map[string]interface{})["id"] != "duplicate-placeholder" {
+		t.Error("Expected the placeholder to be recovered")
+	}
+
+	expected := map[string]bool{"Alice": false, "Bob": true, "Carol": false}
+	for name, holds := range expected {
+		result = sendPhrases(t, "stored", `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["`+name+`"]}}`)
+		if result["results"].([]interface{})[0].(map[string]interface{})["result"] != holds {
+			t.Errorf("Expected person(%s) to be %v after recovering the session", name, holds)
+		}
+	}
+
+	// Deleted sessions are not recovered
+	request, _ := http.NewRequest("DELETE", "/sessions/stored", nil)
+	response := httptest.NewRecorder()
+	sessionsHandler(response, request)
+
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Could not delete session:", response.Body.String())
+	}
+
+	openSessions(t, dir)
+
+	if len(sessions.List()) != 0 {
+		t.Fatal("Expected the deleted session to be removed from the store")
+	}
+
+	// The id of a session is used as a directory name
+	if response := createSession("../outside", false); response.Code != http.StatusBadRequest {
+		t.Fatal("Expected an invalid session id to be rejected, got", response.Code)
+	}
+}
+
+func TestPersistenceIncompleteLog(t *testing.T) {
+	dir := t.TempDir()
+	openSessions(t, dir)
+
+	if response := createSession("crashed", false); response.Code != http.StatusCreated {
+		t.Fatal("Could not create session:", response.Body.String())
+	}
+
+	sendPhrases(t, "crashed", `{"kind": "afact", "name": "person", "type": "String"}`)
+
+	// The server stopped while writing the next request to the log
+	file, err := os.OpenFile(filepath.Join(dir, "crashed", "log.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"sequence": 2, "phrases": [{"kind": "cre`)
+	file.Close()
+
+	openSessions(t, dir)
+
+	sendPhrases(t, "crashed", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+
+	openSessions(t, dir)
+
+	result := sendPhrases(t, "crashed", `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Alice"]}}`)
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != true {
+		t.Fatal("Expected the requests after the incomplete one to be recovered")
+	}
+}
+
+func TestPersistenceHistory(t *testing.T) {
+	dir := t.TempDir()
+	openSessions(t, dir)
+
+	if response := createSession("reverted", true); response.Code != http.StatusCreated {
+		t.Fatal("Could not create session:", response.Body.String())
+	}
+
+	sendPhrases(t, "reverted", `{"kind": "afact", "name": "person", "type": "String"}`)
+	sendPhrases(t, "reverted", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}`)
+	sendPhrases(t, "reverted", `{"kind": "create", "operand": {"identifier": "person", "operands": ["Bob"]}}`)
+
+	// Reverting does not interpret any phrases, so the log no longer applies
+	sendHistory(t, "reverted", "revert", `{"state": 2}`)
+
+	openSessions(t, dir)
+
+	result := sendPhrases(t, "reverted", `{"kind": "bquery", "expression": {"identifier": "person", "operands": ["Bob"]}}`)
+	if result["results"].([]interface{})[0].(map[string]interface{})["result"] != false {
+		t.Fatal("Expected the reverted state to be recovered")
+	}
+
+	if history := sendHistory(t, "reverted", "", ""); len(history.States) != 1 {
+		t.Fatalf("Expected the history to start again from the recovered state, got %+v", history)
+	}
+}
+
+func TestPersistencePositions(t *testing.T) {
+	dir := t.TempDir()
+	openSessions(t, dir)
+
+	if response := createSession("located", false); response.Code != http.StatusCreated {
+		t.Fatal("Could not create session:", response.Body.String())
+	}
+
+	sendEFLINT(t, "/?session=located", "Fact person Identified by String.\nAct greet Actor person Holds when False.")
+	sendEFLINT(t, "/?session=located", "+person(Alice).")
+
+	// The declarations are only part of the snapshot
+	if _, err := os.Stat(filepath.Join(dir, "located", "log.jsonl")); err == nil {
+		t.Fatal("Expected the log to be cleared after the snapshot")
+	}
+
+	openSessions(t, dir)
+
+	result := sendEFLINT(t, "/?session=located", "greet(Alice).")
+	violations := result["results"].([]interface{})[0].(map[string]interface{})["violations"].([]interface{})
+	position, _ := violations[0].(map[string]interface{})["position"].(map[string]interface{})
+	if position["line"] != 2.0 || position["column"] != 1.0 {
+		t.Fatal("Expected the disabled act to be located at its declaration after recovering the session, got", violations)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/session"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type sessionRequest struct {
+	Id      string `json:"id"`
+	History bool   `json:"history"`
+}
+
+type historyRequest struct {
+	State *int `json:"state"`
+}
+
+// errMethodNotAllowed is returned when a path does not accept the method of a
+// request.
+var errMethodNotAllowed = eflint.Error{Id: "method-not-allowed", Message: "method not allowed"}
+
+// writeMethodNotAllowed responds that the method of a request is not allowed,
+// listing the methods that are.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeFailure(w, http.StatusMethodNotAllowed, errMethodNotAllowed.Errorf("%s %s is not allowed, use %s", r.Method, r.URL.Path, strings.Join(allowed, " or ")))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	output, err := json.Marshal(value)
+	if err != nil {
+		writeFailure(w, http.StatusInternalServerError, eflint.AsError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// handler for the session paths:
+//   - GET /sessions lists all sessions
+//   - POST /sessions creates a session, optionally with the id in the body and
+//     with "history": true to record the history of the session
+//   - DELETE /sessions/{id} deletes a session
+//   - GET /sessions/{id}/snapshot exports the state of a session
+//   - PUT /sessions/{id}/snapshot replaces the state of a session
+//   - GET /sessions/{id}/history lists the history of a session
+//   - GET /sessions/{id}/history/graph exports all states of a session
+//   - GET /sessions/{id}/history/compare compares two states of a session
+//   - POST /sessions/{id}/history/{action} moves through the history
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"), "/")
+	resource, action, _ := strings.Cut(resource, "/")
+
+	if resource == "snapshot" && action == "" {
+		snapshotHandler(w, r, id)
+		return
+	} else if resource == "history" {
+		historyHandler(w, r, id, action)
+		return
+	} else if resource != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, sessions.List())
+	case id == "" && r.Method == http.MethodPost:
+		var request sessionRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil && err != io.EOF {
+			writeFailure(w, http.StatusBadRequest, eflint.ErrParse.Errorf("%v", err))
+			return
+		}
+
+		created, err := sessions.Create(request.Id, request.History)
+		if errors.Is(err, session.ErrSessionExists) {
+			writeFailure(w, http.StatusConflict, eflint.AsError(err))
+			return
+		} else if errors.Is(err, session.ErrInvalidSession) {
+			writeFailure(w, http.StatusBadRequest, eflint.AsError(err))
+			return
+		} else if err != nil {
+			writeFailure(w, http.StatusInternalServerError, eflint.AsError(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, created)
+	case id != "" && r.Method == http.MethodGet:
+		found, err := sessions.Get(id)
+		if err != nil {
+			writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, found)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := sessions.Delete(id); err != nil {
+			// The session may exist, but fail to be removed from the store
+			status := http.StatusInternalServerError
+			if errors.Is(err, session.ErrUnknownSession) {
+				status = http.StatusNotFound
+			}
+			writeFailure(w, status, eflint.AsError(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case id == "":
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// snapshotHandler exports and imports the state of a session. A snapshot is a
+// phrases request that declares all facts and placeholders and creates or
+// terminates the instances, so it can also be sent to the server as it is.
+func snapshotHandler(w http.ResponseWriter, r *http.Request, id string) {
+	current, err := sessions.Get(id)
+	if err != nil {
+		writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+		return
+	}
+
+	if err := current.Lock(); err != nil {
+		writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+		return
+	}
+	defer current.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, eflint.Input{
+			Version: eflint.SupportedVersions[len(eflint.SupportedVersions)-1],
+			Kind:    "phrases",
+			Phrases: current.Engine.Export(),
+		})
+	case http.MethodPut:
+		var input eflint.Input
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&input); err != nil {
+			failure := eflint.ErrParse.Errorf("%v", err)
+			errors.As(err, &failure)
+			writeFailure(w, http.StatusBadRequest, failure)
+			return
+		}
+
+		if err := eflint.Typecheck(input); err != nil {
+			writeFailure(w, http.StatusBadRequest, eflint.AsError(err))
+			return
+		}
+		if input.Kind != "phrases" {
+			writeFailure(w, http.StatusBadRequest, eflint.ErrUnknownKind.Errorf("a snapshot must be of kind phrases, not %s", input.Kind))
+			return
+		}
+
+		if err := current.Import(input.Phrases); err != nil {
+			// Only errors of the phrases themselves are the fault of the client
+			status := http.StatusBadRequest
+			if failure := eflint.AsError(err); failure.Is(eflint.ErrInternal) {
+				status = http.StatusInternalServerError
+			}
+			writeFailure(w, status, eflint.AsError(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, eflint.Output{Success: true})
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut)
+	}
+}
+
+// historyHandler lists and moves through the history of a session. Every
+// action responds with the history after it:
+//   - revert restores the state in the body, e.g. {"state": 2}
+//   - undo and redo move one state back or forward on the current line
+//   - branch starts a new line of history from the state in the body
+func historyHandler(w http.ResponseWriter, r *http.Request, id string, action string) {
+	current, err := sessions.Get(id)
+	if err != nil {
+		writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+		return
+	}
+
+	if err := current.Lock(); err != nil {
+		writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+		return
+	}
+	defer current.Unlock()
+
+	if !current.Engine.RecordsHistory() {
+		writeFailure(w, http.StatusConflict, eflint.ErrNoHistory.Errorf("session %s does not record its history", id))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		switch action {
+		case "":
+			writeHistory(w, current)
+		case "graph":
+			graphHandler(w, r, current)
+		case "compare":
+			compareHandler(w, r, current)
+		case "revert", "undo", "redo", "branch":
+			writeMethodNotAllowed(w, r, http.MethodPost)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	} else if action == "" || action == "graph" || action == "compare" {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	} else if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	var request historyRequest
+	if action == "revert" || action == "branch" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil || request.State == nil {
+			writeFailure(w, http.StatusBadRequest, eflint.ErrParse.Errorf("expected the number of a state, e.g. {\"state\": 1}"))
+			return
+		}
+	}
+
+	switch action {
+	case "revert":
+		err = current.Revert(*request.State)
+	case "undo":
+		err = current.Undo()
+	case "redo":
+		err = current.Redo()
+	case "branch":
+		_, err = current.Branch(*request.State)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if failure := eflint.AsError(err); failure.Is(eflint.ErrUnknownState) {
+			status = http.StatusNotFound
+		}
+		writeFailure(w, status, eflint.AsError(err))
+		return
+	}
+
+	writeHistory(w, current)
+}
+
+func writeHistory(w http.ResponseWriter, current *session.Session) {
+	history, err := current.Engine.History()
+	if err != nil {
+		writeFailure(w, http.StatusInternalServerError, eflint.AsError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// graphHandler exports the tree of all states of a session, as JSON or, with
+// ?format=dot, in the DOT language of Graphviz.
+func graphHandler(w http.ResponseWriter, r *http.Request, current *session.Session) {
+	graph, err := current.Engine.Graph()
+	if err != nil {
+		writeFailure(w, http.StatusInternalServerError, eflint.AsError(err))
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, graph)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(graph.Dot()))
+	default:
+		writeFailure(w, http.StatusBadRequest, eflint.ErrParse.Errorf("unknown format: %s", r.URL.Query().Get("format")))
+	}
+}
+
+// compareHandler responds with the changes that lead from the state in the
+// from parameter to the state in the to parameter, e.g. ?from=2&to=5.
+func compareHandler(w http.ResponseWriter, r *http.Request, current *session.Session) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, eflint.ErrParse.Errorf("invalid state to compare from: %v", err))
+		return
+	}
+
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, eflint.ErrParse.Errorf("invalid state to compare to: %v", err))
+		return
+	}
+
+	changes, err := current.Engine.Compare(from, to)
+	if err != nil {
+		writeFailure(w, http.StatusNotFound, eflint.AsError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, changes)
+}
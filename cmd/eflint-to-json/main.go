@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
 	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
 	"os"
 )
@@ -13,16 +14,26 @@ func main() {
 	if len(os.Args) > 1 {
 		f, err := os.Open(os.Args[1])
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 		defer f.Close()
 		filename = os.Args[1]
 		file = f
 	}
 
-	result, err := parser.ParseFile(filename, file)
+	input, diagnostics := parser.Parse(filename, file)
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic)
+	}
+	if len(diagnostics) > 0 {
+		os.Exit(1)
+	}
+
+	result, err := eflint.MarshalLocated(parser.Convert(input), "  ")
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	fmt.Println(string(result))
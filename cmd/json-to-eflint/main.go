@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"os"
+)
+
+func main() {
+	file := os.Stdin
+	if len(os.Args) > 1 {
+		f, err := os.Open(os.Args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		file = f
+	}
+
+	var input eflint.Input
+	if err := json.NewDecoder(file).Decode(&input); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for i, phrase := range input.Phrases {
+		formatted, err := eflint.FormatPhrase(phrase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "phrase %d: %v\n", i+1, err)
+			os.Exit(1)
+		}
+
+		fmt.Println(formatted)
+	}
+}
@@ -4,53 +4,148 @@ import (
 	orderedmap "github.com/wk8/go-ordered-map/v2"
 )
 
-func DeriveFacts() {
+func (e *Engine) DeriveFacts() error {
 	changed := true
 
 	for changed {
-		changed = deriveFactsOnce()
+		var err error
+		if changed, err = e.deriveFactsOnce(); err != nil {
+			return err
+		}
 	}
 
-	CheckViolations()
-
 	//DerivePredicates()
+
+	return e.CheckViolations()
 }
 
-func CheckViolations() {
-	for factName, instances := range globalInstances {
-		fact := globalState["facts"][factName]
+// CheckViolations finds the duties that are violated by their violation
+// conditions, and the invariants that do not hold.
+func (e *Engine) CheckViolations() error {
+	for _, factName := range sortedFactNames(e.instances) {
+		instances := e.instances[factName]
+		fact := e.state["facts"][factName]
 		if cfact, ok := fact.(CompositeFact); ok && len(cfact.ViolatedWhen) > 0 {
 			for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
 				for _, violation := range cfact.ViolatedWhen {
-					clause := fillParameters(violation, cfact.IdentifiedBy, pair.Value.Operands)
-					signal := make(chan struct{})
+					clause, err := e.fillParameters(violation, cfact.IdentifiedBy, pair.Value.Operands)
+					if err != nil {
+						return err
+					}
+
+					expr, ok := e.first(clause)
 
-					expr, ok := <-handleExpression(clause, signal)
+					// A condition without any value refers to instances that
+					// do not hold
 					if !ok {
-						panic("Could not handle expression")
+						continue
 					}
 
-					eval, err := evaluateInstance(expr)
+					eval, err := e.evaluateInstance(expr)
 					if err != nil {
-						panic(err)
+						return err
 					}
 
 					if eval {
-						addViolation("duty", pair.Value)
+						instance := copyExpression(pair.Value)
+						e.addViolation(Violation{Kind: "duty", Identifier: instance.Identifier, Operands: instance.Operands})
+						break
 					}
-
-					close(signal)
 				}
 			}
 		} else if afact, ok := fact.(AtomicFact); ok && afact.IsInvariant {
 			if instances.Len() != 1 {
-				addViolation("invariant", Expression{Value: []string{factName}})
+				var witnesses [][]Expression
+				for _, condition := range afact.HoldsWhen {
+					found, err := e.invariantWitnesses(condition)
+					if err != nil {
+						return err
+					}
+					witnesses = append(witnesses, found...)
+				}
+
+				e.addViolation(Violation{Kind: "invariant", Identifier: factName, Operands: []Expression{}, Witnesses: witnesses})
 			}
 		}
 	}
+
+	return nil
+}
+
+// invariantWitnesses returns the instances for which the condition of an
+// invariant fails: the bindings of a Forall for which its body is false, or
+// of a negated Exists for which its body is true. Other conditions have no
+// witnesses.
+func (e *Engine) invariantWitnesses(condition Expression) ([][]Expression, error) {
+	if condition.Iterator == "FORALL" && condition.Expression != nil {
+		return e.witnesses(condition.Binds, *condition.Expression, false)
+	}
+
+	if condition.Operator == "NOT" && len(condition.Operands) == 1 {
+		if operand := condition.Operands[0]; operand.Iterator == "EXISTS" && operand.Expression != nil {
+			return e.witnesses(operand.Binds, *operand.Expression, true)
+		}
+	}
+
+	return nil, nil
+}
+
+// witnesses returns every combination of instances of the bound variables for
+// which the body evaluates to the given value.
+func (e *Engine) witnesses(binds []string, body Expression, value bool) ([][]Expression, error) {
+	if len(binds) == 0 {
+		// Variables that are not bound are quantified like in the iterator
+		iterator := "FORALL"
+		if value {
+			iterator = "EXISTS"
+		}
+
+		expr, ok := e.first(Expression{Iterator: iterator, Expression: &body})
+		if !ok {
+			return nil, nil
+		}
+
+		eval, err := e.evaluateInstance(expr)
+		if err != nil || eval != value {
+			return nil, err
+		}
+
+		return [][]Expression{{}}, nil
+	}
+
+	instances, err := e.iterateFact(binds[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// All instances are read first, as the evaluation of the body iterates
+	// over facts as well
+	values := make([]Expression, 0)
+	for instance := range instances {
+		values = append(values, Expression{Identifier: instance.Identifier, Operands: instance.Operands})
+	}
+
+	var result [][]Expression
+	for _, instance := range values {
+		bound := copyExpression(body)
+		for _, occurrence := range findOccurrences(&bound, binds[0]) {
+			*occurrence = instance
+		}
+
+		found, err := e.witnesses(binds[1:], bound, value)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, witness := range found {
+			result = append(result, append([]Expression{instance}, witness...))
+		}
+	}
+
+	return result, nil
 }
 
-func generateDerivationRules(fact interface{}) (string, []Expression) {
+func (e *Engine) generateDerivationRules(fact interface{}) (string, []Expression, error) {
 	var holdsWhen []Expression
 	var derivedFrom []Expression
 	var conditionedBy []Expression
@@ -67,13 +162,13 @@ func generateDerivationRules(fact interface{}) (string, []Expression) {
 		conditionedBy = cfact.ConditionedBy
 		name = cfact.Name
 	} else {
-		panic("Fact is neither atomic nor composite")
+		return "", nil, ErrInternal.Errorf("fact %v is neither atomic nor composite", fact)
 	}
 
 	rules := make([]Expression, 0, len(derivedFrom)+len(holdsWhen))
 	instance := Expression{Value: []string{name}}
 
-	if _, ok := globalState["facts"][name].(CompositeFact); ok {
+	if _, ok := e.state["facts"][name].(CompositeFact); ok {
 		instance = Expression{Identifier: name}
 	}
 
@@ -111,29 +206,38 @@ func generateDerivationRules(fact interface{}) (string, []Expression) {
 		}
 	}
 
-	return name, rules
+	return name, rules, nil
 }
 
-func deriveFactsOnce() bool {
+func (e *Engine) deriveFactsOnce() (bool, error) {
 	changed := false
 
-	for _, fact := range globalState["facts"] {
-		changed = deriveFact(fact) || changed
+	for _, fact := range e.state["facts"] {
+		derived, err := e.deriveFact(fact)
+		if err != nil {
+			return false, err
+		}
+
+		changed = derived || changed
 	}
 
-	return changed
+	return changed, nil
 }
 
-func deriveFact(fact interface{}) bool {
-	name, rules := generateDerivationRules(fact)
+func (e *Engine) deriveFact(fact interface{}) (bool, error) {
+	name, rules, err := e.generateDerivationRules(fact)
+	if err != nil {
+		return false, err
+	}
+
 	oldDerived := orderedmap.New[uint64, Expression]()
 
-	for pair := globalInstances[name].Oldest(); pair != nil; {
+	for pair := e.instances[name].Oldest(); pair != nil; {
 		next := pair.Next()
 
 		if pair.Value.IsDerived {
 			oldDerived.Set(pair.Key, pair.Value)
-			globalInstances[name].Delete(pair.Key)
+			e.instances[name].Delete(pair.Key)
 		}
 
 		pair = next
@@ -148,8 +252,14 @@ func deriveFact(fact interface{}) bool {
 		for _, rule := range rules {
 			// Go over all instances of the rule.
 			signal := make(chan struct{}, 1)
+			values := e.handleExpression(rule, signal)
+
+			for expr := range values {
+				if expr.err != nil {
+					stop(signal, values)
+					return false, expr.err
+				}
 
-			for expr := range handleExpression(rule, signal) {
 				//log.Println("Derived", name, "with", expr)
 				if expr.Identifier != name {
 					expr = Expression{
@@ -158,7 +268,7 @@ func deriveFact(fact interface{}) bool {
 					}
 				}
 
-				err := create(expr, true)
+				err := e.create(expr, true)
 
 				if err != nil {
 					//log.Println("Error deriving", name, "with", expr, ":", err)
@@ -175,21 +285,21 @@ func deriveFact(fact interface{}) bool {
 	}
 
 	for pair := oldDerived.Oldest(); pair != nil; pair = pair.Next() {
-		if _, ok := globalInstances[name].Get(pair.Key); !ok {
-			return true
+		if _, ok := e.instances[name].Get(pair.Key); !ok {
+			return true, nil
 		}
 	}
 
-	for pair := globalInstances[name].Oldest(); pair != nil; pair = pair.Next() {
+	for pair := e.instances[name].Oldest(); pair != nil; pair = pair.Next() {
 		//log.Printf("new: %v -> %v\n", pair.Key, pair.Value)
 		if !pair.Value.IsDerived {
 			continue
 		}
 
 		if _, ok := oldDerived.Get(pair.Key); !ok {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
@@ -26,11 +26,15 @@ func findReferences(expr Expression) []string {
 	return references
 }
 
-func DeriveFacts2() {
+func (e *Engine) DeriveFacts2() error {
 	dependencies := make(map[string]map[string]struct{})
 
-	for _, fact := range globalState["facts"] {
-		name, rules := generateDerivationRules(fact)
+	for _, fact := range e.state["facts"] {
+		name, rules, err := e.generateDerivationRules(fact)
+		if err != nil {
+			return err
+		}
+
 		dependencies[name] = make(map[string]struct{})
 
 		for _, rule := range rules {
@@ -57,7 +61,12 @@ func DeriveFacts2() {
 		name := queue[0]
 		queue = queue[1:]
 
-		if !deriveFact2(globalState["facts"][name]) {
+		changed, err := e.deriveFact2(e.state["facts"][name])
+		if err != nil {
+			return err
+		}
+
+		if !changed {
 			continue
 		}
 
@@ -66,19 +75,23 @@ func DeriveFacts2() {
 		}
 	}
 
-	CheckViolations()
+	return e.CheckViolations()
 }
 
-func deriveFact2(fact interface{}) bool {
-	name, rules := generateDerivationRules(fact)
+func (e *Engine) deriveFact2(fact interface{}) (bool, error) {
+	name, rules, err := e.generateDerivationRules(fact)
+	if err != nil {
+		return false, err
+	}
+
 	oldDerived := orderedmap.New[uint64, Expression]()
 
-	for pair := globalInstances[name].Oldest(); pair != nil; {
+	for pair := e.instances[name].Oldest(); pair != nil; {
 		next := pair.Next()
 
 		if pair.Value.IsDerived {
 			oldDerived.Set(pair.Key, pair.Value)
-			globalInstances[name].Delete(pair.Key)
+			e.instances[name].Delete(pair.Key)
 		}
 
 		pair = next
@@ -93,8 +106,14 @@ func deriveFact2(fact interface{}) bool {
 		for _, rule := range rules {
 			// Go over all instances of the rule.
 			signal := make(chan struct{}, 1)
+			values := e.handleExpression(rule, signal)
+
+			for expr := range values {
+				if expr.err != nil {
+					stop(signal, values)
+					return false, expr.err
+				}
 
-			for expr := range handleExpression(rule, signal) {
 				//log.Println("Derived", name, "with", expr)
 				if expr.Identifier != name {
 					expr = Expression{
@@ -103,7 +122,7 @@ func deriveFact2(fact interface{}) bool {
 					}
 				}
 
-				err := create(expr, true)
+				err := e.create(expr, true)
 
 				if err != nil {
 					//log.Println("Error deriving", name, "with", expr, ":", err)
@@ -120,21 +139,21 @@ func deriveFact2(fact interface{}) bool {
 	}
 
 	for pair := oldDerived.Oldest(); pair != nil; pair = pair.Next() {
-		if _, ok := globalInstances[name].Get(pair.Key); !ok {
-			return true
+		if _, ok := e.instances[name].Get(pair.Key); !ok {
+			return true, nil
 		}
 	}
 
-	for pair := globalInstances[name].Oldest(); pair != nil; pair = pair.Next() {
+	for pair := e.instances[name].Oldest(); pair != nil; pair = pair.Next() {
 		//log.Printf("new: %v -> %v\n", pair.Key, pair.Value)
 		if !pair.Value.IsDerived {
 			continue
 		}
 
 		if _, ok := oldDerived.Get(pair.Key); !ok {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
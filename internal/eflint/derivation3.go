@@ -12,30 +12,26 @@ type Assumptions struct {
 	Queue       []string
 }
 
-var tempAssumptions []*Assumptions
-var globalAssumptions map[uint64]*Assumptions
-var globalQueue []string
-
-func copyAssumptions() map[uint64]*Assumptions {
+func (e *Engine) copyAssumptions() map[uint64]*Assumptions {
 	newAssumptions := make(map[uint64]*Assumptions)
 
-	for name, assumptions := range globalAssumptions {
+	for name, assumptions := range e.assumptions {
 		newAssumptions[name] = assumptions
 	}
 
 	return newAssumptions
 }
 
-func copyQueue() []string {
-	newQueue := make([]string, len(globalQueue))
-	copy(newQueue, globalQueue)
+func (e *Engine) copyQueue() []string {
+	newQueue := make([]string, len(e.queue))
+	copy(newQueue, e.queue)
 	return newQueue
 }
 
-func copyKnowledge() map[string]*orderedmap.OrderedMap[uint64, Expression] {
+func (e *Engine) copyKnowledge() map[string]*orderedmap.OrderedMap[uint64, Expression] {
 	newKnowledge := make(map[string]*orderedmap.OrderedMap[uint64, Expression])
 
-	for name, knowledge := range globalInstances {
+	for name, knowledge := range e.instances {
 		newKnowledge[name] = orderedmap.New[uint64, Expression]()
 		for pair := knowledge.Oldest(); pair != nil; pair = pair.Next() {
 			newKnowledge[name].Set(pair.Key, pair.Value)
@@ -45,12 +41,20 @@ func copyKnowledge() map[string]*orderedmap.OrderedMap[uint64, Expression] {
 	return newKnowledge
 }
 
-func DeriveFacts3() {
+func (e *Engine) DeriveFacts3() error {
 	dependencies := make(map[string]map[string]struct{})
 
-	for _, fact := range globalState["facts"] {
-		name, rules := generateDerivationRules(fact)
-		dependencies[name] = make(map[string]struct{})
+	for _, fact := range e.state["facts"] {
+		name, rules, err := e.generateDerivationRules(fact)
+		if err != nil {
+			return err
+		}
+
+		// Facts that refer to this one may have been visited already, so their
+		// dependencies must not be overwritten
+		if _, ok := dependencies[name]; !ok {
+			dependencies[name] = make(map[string]struct{})
+		}
 
 		for _, rule := range rules {
 			for _, reference := range findReferences(rule) {
@@ -64,55 +68,70 @@ func DeriveFacts3() {
 		}
 	}
 
-	globalQueue = make([]string, len(dependencies))
+	e.queue = make([]string, len(dependencies))
 	i := 0
 
 	for name := range dependencies {
-		globalQueue[i] = name
+		e.queue[i] = name
 		i++
 	}
 
-	globalAssumptions = make(map[uint64]*Assumptions)
-	customDerivation = true
+	e.assumptions = make(map[uint64]*Assumptions)
+	e.customDerivation = true
+	defer func() {
+		e.customDerivation = false
+	}()
 
-	for len(globalQueue) > 0 {
-		name := globalQueue[0]
-		globalQueue = globalQueue[1:]
+	for len(e.queue) > 0 {
+		name := e.queue[0]
+		e.queue = e.queue[1:]
 
-		if !deriveFact3(globalState["facts"][name]) {
+		changed, err := e.deriveFact3(e.state["facts"][name])
+		if err != nil {
+			return err
+		}
+
+		if !changed {
 			continue
 		}
 
 		for dependency := range dependencies[name] {
-			globalQueue = append(globalQueue, dependency)
+			e.queue = append(e.queue, dependency)
 		}
 	}
 
-	CheckViolations()
-
-	customDerivation = false
+	return e.CheckViolations()
 }
 
-func deriveFactsOnce3() bool {
+func (e *Engine) deriveFactsOnce3() (bool, error) {
 	changed := false
 
-	for _, fact := range globalState["facts"] {
-		changed = deriveFact(fact) || changed
+	for _, fact := range e.state["facts"] {
+		derived, err := e.deriveFact(fact)
+		if err != nil {
+			return false, err
+		}
+
+		changed = derived || changed
 	}
 
-	return changed
+	return changed, nil
 }
 
-func deriveFact3(fact interface{}) bool {
-	name, rules := generateDerivationRules(fact)
+func (e *Engine) deriveFact3(fact interface{}) (bool, error) {
+	name, rules, err := e.generateDerivationRules(fact)
+	if err != nil {
+		return false, err
+	}
+
 	oldDerived := orderedmap.New[uint64, Expression]()
 
-	for pair := globalInstances[name].Oldest(); pair != nil; {
+	for pair := e.instances[name].Oldest(); pair != nil; {
 		next := pair.Next()
 
 		if pair.Value.IsDerived {
 			oldDerived.Set(pair.Key, pair.Value)
-			globalInstances[name].Delete(pair.Key)
+			e.instances[name].Delete(pair.Key)
 		}
 
 		pair = next
@@ -127,9 +146,15 @@ func deriveFact3(fact interface{}) bool {
 		for _, rule := range rules {
 			// Go over all instances of the rule.
 			signal := make(chan struct{}, 1)
-			tempAssumptions = make([]*Assumptions, 0)
+			e.tempAssumptions = make([]*Assumptions, 0)
+			values := e.handleExpression(rule, signal)
+
+			for expr := range values {
+				if expr.err != nil {
+					stop(signal, values)
+					return false, expr.err
+				}
 
-			for expr := range handleExpression(rule, signal) {
 				if expr.Identifier != name {
 					expr = Expression{
 						Identifier: name,
@@ -139,29 +164,32 @@ func deriveFact3(fact interface{}) bool {
 
 				//log.Println("Derived", name, "with", expr)
 
-				for _, assumptions := range tempAssumptions {
-					if _, ok := globalAssumptions[assumptions.Expression]; !ok {
-						globalAssumptions[assumptions.Expression] = assumptions
+				for _, assumptions := range e.tempAssumptions {
+					if _, ok := e.assumptions[assumptions.Expression]; !ok {
+						e.assumptions[assumptions.Expression] = assumptions
 					}
 				}
 
 				hash, err := hashstructure.Hash(expr, hashstructure.FormatV2, nil)
 
 				if err != nil {
-					panic(err)
+					stop(signal, values)
+					return false, err
 				}
 
-				if assumed, ok := globalAssumptions[hash]; ok {
+				if assumed, ok := e.assumptions[hash]; ok {
+					stop(signal, values)
+
 					// Need to revert the state
 					//log.Println("Reverting", name)
-					globalInstances = assumed.Knowledge
-					globalQueue = assumed.Queue
-					globalAssumptions = assumed.Assumptions
+					e.instances = assumed.Knowledge
+					e.queue = assumed.Queue
+					e.assumptions = assumed.Assumptions
 
-					return changed
+					return changed, nil
 				}
 
-				err = create(expr, true)
+				err = e.create(expr, true)
 
 				if err != nil {
 					//log.Println("Error deriving", name, "with", expr, ":", err)
@@ -178,21 +206,21 @@ func deriveFact3(fact interface{}) bool {
 	}
 
 	for pair := oldDerived.Oldest(); pair != nil; pair = pair.Next() {
-		if _, ok := globalInstances[name].Get(pair.Key); !ok {
-			return true
+		if _, ok := e.instances[name].Get(pair.Key); !ok {
+			return true, nil
 		}
 	}
 
-	for pair := globalInstances[name].Oldest(); pair != nil; pair = pair.Next() {
+	for pair := e.instances[name].Oldest(); pair != nil; pair = pair.Next() {
 		//log.Printf("new: %v -> %v\n", pair.Key, pair.Value)
 		if !pair.Value.IsDerived {
 			continue
 		}
 
 		if _, ok := oldDerived.Get(pair.Key); !ok {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
@@ -0,0 +1,180 @@
+package eflint
+
+import (
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"io"
+)
+
+// Engine interprets phrases in a knowledge base of its own. Engines do not
+// share any state, so multiple engines can be used within the same process.
+// A single engine must not be used by multiple goroutines at the same time.
+type Engine struct {
+	state        map[string]map[string]interface{}
+	instances    map[string]*orderedmap.OrderedMap[uint64, Expression]
+	nonInstances map[string]*orderedmap.OrderedMap[uint64, Expression]
+	violations   []Violation
+
+	// Duties that were violated after the last phrase, by their instance, or
+	// nil if they have to be checked again
+	violatedDuties map[string]Violation
+
+	results []PhraseResult
+
+	// Recorded states, nil if the history is not recorded
+	history *history
+
+	// Where the engine traces what it does, nil if it is not traced
+	trace io.Writer
+
+	// Bookkeeping for the derivation of facts
+	customDerivation bool
+	tempAssumptions  []*Assumptions
+	assumptions      map[uint64]*Assumptions
+	queue            []string
+}
+
+// State is a copy of the knowledge base of an engine. It holds the declared
+// facts and placeholders, and the known instances and non-instances.
+type State struct {
+	Facts        map[string]interface{}
+	Placeholders map[string]interface{}
+	Instances    map[string]*orderedmap.OrderedMap[uint64, Expression]
+	NonInstances map[string]*orderedmap.OrderedMap[uint64, Expression]
+}
+
+// NewEngine creates an engine with a knowledge base that only contains the
+// default facts.
+func NewEngine() *Engine {
+	e := &Engine{
+		state:        make(map[string]map[string]interface{}),
+		instances:    make(map[string]*orderedmap.OrderedMap[uint64, Expression]),
+		nonInstances: make(map[string]*orderedmap.OrderedMap[uint64, Expression]),
+		violations:   make([]Violation, 0),
+		results:      make([]PhraseResult, 0),
+	}
+
+	e.state["facts"] = make(map[string]interface{})
+	e.state["placeholders"] = make(map[string]interface{})
+
+	e.initializeFacts()
+
+	return e
+}
+
+// Query returns all instances the given expression evaluates to.
+func (e *Engine) Query(expression Expression) ([]Expression, error) {
+	instances, err := e.gatherExpressions(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Expression, 0, len(instances))
+	for _, instance := range instances {
+		results = append(results, copyExpression(instance))
+	}
+
+	return results, nil
+}
+
+// Instance returns the instance that the given constructor application stands
+// for, in the form in which it is kept in the knowledge base. For example,
+// greeted("Bob") becomes greeted(person("Bob")) if greeted is identified by a
+// person. The instance does not have to hold.
+func (e *Engine) Instance(expression Expression) (Expression, error) {
+	instances, err := e.gatherExpressions(expression)
+	if err != nil {
+		return Expression{}, err
+	}
+
+	if len(instances) != 1 || instances[0].Identifier == "" {
+		return Expression{}, ErrInvalidExpression.Errorf("%s is not a single instance", FormatExpression(expression))
+	}
+
+	return e.convertInstance(copyExpression(instances[0]))
+}
+
+// Snapshot returns a copy of the current knowledge base of the engine. Later
+// changes to the engine do not affect the snapshot.
+func (e *Engine) Snapshot() State {
+	return State{
+		Facts:        copyFacts(e.state["facts"]),
+		Placeholders: copyFacts(e.state["placeholders"]),
+		Instances:    copyInstances(e.instances),
+		NonInstances: copyInstances(e.nonInstances),
+	}
+}
+
+// Restore replaces the knowledge base of the engine by a copy of the given
+// snapshot.
+func (e *Engine) Restore(state State) {
+	e.state["facts"] = copyFacts(state.Facts)
+	e.state["placeholders"] = copyFacts(state.Placeholders)
+	e.instances = copyInstances(state.Instances)
+	e.nonInstances = copyInstances(state.NonInstances)
+	e.violatedDuties = nil
+}
+
+func copyExpressions(expressions []Expression) []Expression {
+	if expressions == nil {
+		return nil
+	}
+
+	result := make([]Expression, 0, len(expressions))
+	for _, expression := range expressions {
+		result = append(result, copyExpression(expression))
+	}
+
+	return result
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	return append(make([]string, 0, len(values)), values...)
+}
+
+func copyFacts(facts map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(facts))
+
+	for name, fact := range facts {
+		switch f := fact.(type) {
+		case AtomicFact:
+			f.Range = copyExpressions(f.Range)
+			f.DerivedFrom = copyExpressions(f.DerivedFrom)
+			f.HoldsWhen = copyExpressions(f.HoldsWhen)
+			f.ConditionedBy = copyExpressions(f.ConditionedBy)
+			result[name] = f
+		case CompositeFact:
+			f.IdentifiedBy = copyStrings(f.IdentifiedBy)
+			f.DerivedFrom = copyExpressions(f.DerivedFrom)
+			f.HoldsWhen = copyExpressions(f.HoldsWhen)
+			f.ConditionedBy = copyExpressions(f.ConditionedBy)
+			f.SyncsWith = copyExpressions(f.SyncsWith)
+			f.Creates = copyExpressions(f.Creates)
+			f.Terminates = copyExpressions(f.Terminates)
+			f.Obfuscates = copyExpressions(f.Obfuscates)
+			f.ViolatedWhen = copyExpressions(f.ViolatedWhen)
+			result[name] = f
+		default:
+			// Placeholders only refer to the name of a fact
+			result[name] = fact
+		}
+	}
+
+	return result
+}
+
+func copyInstances(instances map[string]*orderedmap.OrderedMap[uint64, Expression]) map[string]*orderedmap.OrderedMap[uint64, Expression] {
+	result := make(map[string]*orderedmap.OrderedMap[uint64, Expression], len(instances))
+
+	for factName, factInstances := range instances {
+		result[factName] = orderedmap.New[uint64, Expression]()
+		for pair := factInstances.Oldest(); pair != nil; pair = pair.Next() {
+			result[factName].Set(pair.Key, copyExpression(pair.Value))
+		}
+	}
+
+	return result
+}
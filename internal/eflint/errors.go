@@ -1,16 +1,117 @@
 package eflint
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
+
+// Error implements the error interface, so errors of the interpreter can be
+// returned as usual and reported to the client as they are.
+func (e Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether the target has the same id, so that errors.Is can match
+// an error against one of the errors below regardless of its message.
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Id == e.Id
+}
+
+// Errorf returns an error with the same id and a formatted message.
+func (e Error) Errorf(format string, a ...interface{}) Error {
+	return Error{
+		Id:      e.Id,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// AsError converts any error to an Error. Errors that do not originate from
+// the interpreter are reported as internal errors.
+func AsError(err error) Error {
+	var e Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return ErrInternal.Errorf("%v", err)
+}
+
+// locate adds a position to an error of the interpreter that does not have
+// one yet. Errors are located at the innermost expression that has a position,
+// and otherwise at their phrase.
+func locate(err error, position *Position) error {
+	var e Error
+	if position == nil || !errors.As(err, &e) || e.Position != nil {
+		return err
+	}
+
+	e.Position = position
+	return e
+}
 
 // ErrUnsupportedVersion is returned when the input version is not supported.
-var ErrUnsupportedVersion = errors.New("unsupported version")
+var ErrUnsupportedVersion = Error{Id: "unsupported-version", Message: "unsupported version"}
 
 // ErrUnsupportedFields is returned when the input contains fields that are not
 // expected.
-var ErrUnsupportedFields = errors.New("unsupported fields for this kind")
+var ErrUnsupportedFields = Error{Id: "unsupported-fields", Message: "unsupported fields for this kind"}
 
 // ErrUnknownKind is returned when an unknown kind is provided.
-var ErrUnknownKind = errors.New("unknown kind")
+var ErrUnknownKind = Error{Id: "unknown-kind", Message: "unknown kind"}
 
 // ErrUnknownType is returned when an unknown type is provided.
-var ErrUnknownType = errors.New("unknown type")
+var ErrUnknownType = Error{Id: "unknown-type", Message: "unknown type"}
+
+// ErrParse is returned when the input could not be parsed.
+var ErrParse = Error{Id: "parse-error", Message: "invalid input"}
+
+// ErrUnknownFact is returned when an expression refers to a fact that has not
+// been declared.
+var ErrUnknownFact = Error{Id: "unknown-fact", Message: "fact does not exist"}
+
+// ErrRangeViolation is returned when a value is not in the range of a fact.
+var ErrRangeViolation = Error{Id: "range-violation", Message: "value is not in the range of the fact"}
+
+// ErrArityMismatch is returned when a fact is applied to the wrong number of
+// operands.
+var ErrArityMismatch = Error{Id: "arity-mismatch", Message: "wrong number of operands"}
+
+// ErrNonIntegerArithmetic is returned when an arithmetic operator is applied
+// to values that are not integers.
+var ErrNonIntegerArithmetic = Error{Id: "non-integer-arithmetic", Message: "arithmetic on non-integer values"}
+
+// ErrNotTriggerable is returned when a trigger refers to a fact that is not an
+// event or an act.
+var ErrNotTriggerable = Error{Id: "not-triggerable", Message: "fact is not triggerable"}
+
+// ErrTypeMismatch is returned when a value cannot be converted to the type
+// that is expected.
+var ErrTypeMismatch = Error{Id: "type-mismatch", Message: "value has the wrong type"}
+
+// ErrDivisionByZero is returned when an integer is divided by zero.
+var ErrDivisionByZero = Error{Id: "division-by-zero", Message: "division by zero"}
+
+// ErrUnknownOperator is returned when an expression uses an operator or
+// iterator that is not supported.
+var ErrUnknownOperator = Error{Id: "unknown-operator", Message: "unknown operator"}
+
+// ErrInvalidExpression is returned when an expression cannot be evaluated,
+// for example because an operand evaluates to the wrong kind of value.
+var ErrInvalidExpression = Error{Id: "invalid-expression", Message: "invalid expression"}
+
+// ErrInvalidPhrase is returned when the fields of a phrase are malformed.
+var ErrInvalidPhrase = Error{Id: "invalid-phrase", Message: "invalid phrase"}
+
+// ErrDuplicatePlaceholder is returned when a placeholder is declared twice.
+var ErrDuplicatePlaceholder = Error{Id: "duplicate-placeholder", Message: "placeholder already exists"}
+
+// ErrInternal is returned when something unexpected went wrong.
+var ErrInternal = Error{Id: "internal-error", Message: "internal error"}
+
+// ErrNoHistory is returned when the history of an engine is used, while it
+// does not record its history.
+var ErrNoHistory = Error{Id: "no-history", Message: "history is not recorded"}
+
+// ErrUnknownState is returned when a state of the history does not exist.
+var ErrUnknownState = Error{Id: "unknown-state", Message: "unknown state"}
@@ -0,0 +1,247 @@
+package eflint
+
+import (
+	"sort"
+)
+
+// Export returns phrases that build up the knowledge base of the engine again
+// when they are interpreted in a new engine: the declarations of the facts and
+// placeholders, followed by the postulated instances and the non-instances.
+// Derived instances are left out, as they are derived again.
+//
+// Facts are declared before any of their clauses are added with an extend,
+// as the clauses may refer to facts that are declared later on. Placeholders
+// are declared right after the facts they stand for, as duties, predicates and
+// clauses may refer to them.
+func (e *Engine) Export() []Phrase {
+	names := e.factNames()
+
+	declarations := make([]Phrase, 0, len(names))
+	duties := make([]Phrase, 0)
+	predicates := make([]Phrase, 0)
+	extensions := make([]Phrase, 0)
+
+	for _, name := range names {
+		declaration, extension, ok := declarationPhrases(e.state["facts"][name])
+		if !ok {
+			continue
+		}
+
+		// Violation conditions cannot be added by an extend, so duties are
+		// declared after all other facts, and predicates need their expression
+		switch declaration.Kind {
+		case "duty":
+			duties = append(duties, declaration)
+		case "predicate":
+			predicates = append(predicates, declaration)
+		default:
+			declarations = append(declarations, declaration)
+		}
+
+		if extension != nil {
+			extensions = append(extensions, *extension)
+		}
+	}
+
+	phrases := append(declarations, e.placeholderPhrases()...)
+	phrases = append(phrases, duties...)
+	phrases = append(phrases, predicates...)
+	phrases = append(phrases, extensions...)
+
+	for _, name := range names {
+		for pair := e.instances[name].Oldest(); pair != nil; pair = pair.Next() {
+			if pair.Value.IsDerived {
+				continue
+			}
+
+			operand := copyExpression(pair.Value)
+			phrases = append(phrases, Phrase{Kind: "create", Operand: &operand})
+		}
+	}
+
+	for _, name := range names {
+		for pair := e.nonInstances[name].Oldest(); pair != nil; pair = pair.Next() {
+			operand := copyExpression(pair.Value)
+			phrases = append(phrases, Phrase{Kind: "terminate", Operand: &operand})
+		}
+	}
+
+	return phrases
+}
+
+// Facts returns the declarations of the facts in the knowledge base, ordered
+// by name. Their clauses are left out, and so are the default facts that are
+// not changed.
+func (e *Engine) Facts() []Phrase {
+	facts := make([]Phrase, 0, len(e.state["facts"]))
+
+	for _, name := range e.factNames() {
+		if declaration, _, ok := declarationPhrases(e.state["facts"][name]); ok {
+			facts = append(facts, declaration)
+		}
+	}
+
+	return facts
+}
+
+func (e *Engine) factNames() []string {
+	names := make([]string, 0, len(e.state["facts"]))
+	for name := range e.state["facts"] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Import replaces the knowledge base of the engine by the one that is built
+// up by the phrases, such as the ones returned by Export. The knowledge base
+// is left as it is if any of the phrases is not correct or fails. If the
+// history of the engine is recorded, it starts again from the new state.
+func (e *Engine) Import(phrases []Phrase) error {
+	imported := NewEngine()
+
+	if failures := imported.TypecheckPhrases(phrases); len(failures) > 0 {
+		return failures[0]
+	}
+
+	for i, result := range imported.Interpret(phrases, false) {
+		if !result.Success && len(result.Errors) > 0 {
+			failure := result.Errors[0]
+			return failure.Errorf("phrase %d: %s", i+1, failure.Message)
+		}
+	}
+
+	e.Restore(imported.Snapshot())
+
+	// The recorded states belong to the knowledge base that was replaced
+	if e.history != nil {
+		e.EnableHistory()
+	}
+
+	return nil
+}
+
+// declarationPhrases returns the phrase that declares the given fact, and an
+// extend that adds its clauses if it has any. Default facts that are not
+// changed are not declared again.
+func declarationPhrases(fact interface{}) (Phrase, *Phrase, bool) {
+	var declaration, extension Phrase
+
+	switch f := fact.(type) {
+	case AtomicFact:
+		if defaultType, ok := defaultFacts[f.Name]; ok && f.Type == defaultType && f.Range == nil &&
+			f.DerivedFrom == nil && f.HoldsWhen == nil && f.ConditionedBy == nil {
+			return declaration, nil, false
+		}
+
+		extension = Phrase{
+			DerivedFrom:   f.DerivedFrom,
+			HoldsWhen:     f.HoldsWhen,
+			ConditionedBy: f.ConditionedBy,
+		}
+
+		if f.IsInvariant && len(f.HoldsWhen) > 0 {
+			declaration = Phrase{
+				Kind:        "predicate",
+				Name:        f.Name,
+				IsInvariant: true,
+				Expression:  &f.HoldsWhen[0],
+			}
+			extension.HoldsWhen = f.HoldsWhen[1:]
+		} else {
+			declaration = Phrase{
+				Kind:  "afact",
+				Name:  f.Name,
+				Type:  f.Type,
+				Range: f.Range,
+			}
+		}
+		declaration.Position = f.Position
+	case CompositeFact:
+		declaration = Phrase{Name: f.Name, Position: f.Position}
+		extension = Phrase{
+			DerivedFrom:   f.DerivedFrom,
+			HoldsWhen:     f.HoldsWhen,
+			ConditionedBy: f.ConditionedBy,
+			SyncsWith:     f.SyncsWith,
+			Creates:       f.Creates,
+			Terminates:    f.Terminates,
+			Obfuscates:    f.Obfuscates,
+		}
+
+		switch {
+		case f.FactType == EventType:
+			declaration.Kind = "event"
+			declaration.RelatedTo = f.IdentifiedBy
+		case f.FactType == DutyType || (f.FactType == ActType && f.ViolatedWhen != nil):
+			// Duties are stored like acts, with the holder and claimant as the
+			// first parameters
+			declaration.Kind = "duty"
+			declaration.Holder = f.IdentifiedBy[0]
+			declaration.Claimant = f.IdentifiedBy[1]
+			declaration.RelatedTo = f.IdentifiedBy[2:]
+			declaration.ViolatedWhen = f.ViolatedWhen
+		case f.FactType == ActType:
+			declaration.Kind = "act"
+			declaration.Actor = f.IdentifiedBy[0]
+			declaration.RelatedTo = f.IdentifiedBy[1:]
+		default:
+			declaration.Kind = "cfact"
+			declaration.IdentifiedBy = f.IdentifiedBy
+		}
+	default:
+		return declaration, nil, false
+	}
+
+	if len(extension.DerivedFrom) == 0 && len(extension.HoldsWhen) == 0 && len(extension.ConditionedBy) == 0 &&
+		len(extension.SyncsWith) == 0 && len(extension.Creates) == 0 && len(extension.Terminates) == 0 &&
+		len(extension.Obfuscates) == 0 {
+		return declaration, nil, true
+	}
+
+	extension.Kind = "extend"
+	extension.Name = declaration.Name
+	extension.ParentKind = "fact"
+	if declaration.Kind == "event" || declaration.Kind == "act" {
+		extension.ParentKind = declaration.Kind
+	}
+
+	return declaration, &extension, true
+}
+
+// placeholderPhrases returns the declarations of the placeholders, where
+// placeholders for other placeholders come after the ones they refer to.
+func (e *Engine) placeholderPhrases() []Phrase {
+	pending := make([]string, 0, len(e.state["placeholders"]))
+	for name := range e.state["placeholders"] {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+
+	phrases := make([]Phrase, 0, len(pending))
+	declared := make(map[string]bool)
+
+	for len(pending) > 0 {
+		remaining := make([]string, 0, len(pending))
+
+		for _, name := range pending {
+			target := e.state["placeholders"][name].(string)
+			if _, ok := e.state["placeholders"][target]; ok && !declared[target] {
+				remaining = append(remaining, name)
+				continue
+			}
+
+			phrases = append(phrases, Phrase{Kind: "placeholder", Name: []string{name}, For: target})
+			declared[name] = true
+		}
+
+		// Placeholders that refer to each other cannot be declared in any order
+		if len(remaining) == len(pending) {
+			break
+		}
+		pending = remaining
+	}
+
+	return phrases
+}
@@ -1,7 +1,6 @@
 package eflint
 
 import (
-	orderedmap "github.com/wk8/go-ordered-map/v2"
 	"reflect"
 )
 
@@ -11,7 +10,7 @@ const Reasoner = "eflint"
 const ReasonerVersion = "3"
 const SharesUpdates = true
 const SharesTriggers = true
-const SharesViolations = false
+const SharesViolations = true
 
 var intType = reflect.TypeOf(int64(0))
 var stringType = reflect.TypeOf("")
@@ -30,15 +29,3 @@ var defaultFacts = map[string]string{
 	"ref":    "String",
 	"string": "String",
 }
-
-// TODO: Phrases can be stateless, so 1 global state is not enough.
-//       Can split into a global state and a local state.
-// TODO: Look into possibility of storing all the stateful phrases,
-//       and running those at the start of every request.
-var globalState = make(map[string]map[string]interface{})
-var globalInstances = make(map[string]*orderedmap.OrderedMap[uint64, Expression])
-var globalNonInstances = make(map[string]*orderedmap.OrderedMap[uint64, Expression])
-var globalViolations = make(map[string][]Expression)
-
-var globalResults = make([]PhraseResult, 0)
-var globalErrors = make([]Error, 0)
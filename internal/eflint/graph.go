@@ -0,0 +1,115 @@
+package eflint
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Graph is the tree of all recorded states, so that alternative courses of
+// action can be explored from any state with Branch. Every state except state
+// 0 is reached from its parent by its phrase, typically a trigger, create or
+// terminate.
+type Graph struct {
+	Current int            `json:"current"`
+	States  []HistoryEntry `json:"states"`
+}
+
+// Graph returns all recorded states, ordered by their number.
+func (e *Engine) Graph() (Graph, error) {
+	if e.history == nil {
+		return Graph{}, ErrNoHistory
+	}
+
+	graph := Graph{
+		Current: e.history.current,
+		States:  make([]HistoryEntry, 0, len(e.history.entries)),
+	}
+
+	for _, entry := range e.history.entries {
+		graph.States = append(graph.States, *entry)
+	}
+
+	sort.Slice(graph.States, func(i, j int) bool {
+		return graph.States[i].Number < graph.States[j].Number
+	})
+
+	return graph, nil
+}
+
+// Compare returns the changes that lead from one recorded state to another,
+// in the same form as the changes of a phrase. The states do not have to be
+// on the same line of history.
+func (e *Engine) Compare(from int, to int) ([]Phrase, error) {
+	if e.history == nil {
+		return nil, ErrNoHistory
+	}
+
+	if _, ok := e.history.entries[from]; !ok {
+		return nil, ErrUnknownState.Errorf("state %d does not exist", from)
+	}
+
+	if _, ok := e.history.entries[to]; !ok {
+		return nil, ErrUnknownState.Errorf("state %d does not exist", to)
+	}
+
+	before, after := e.history.stateOf(from), e.history.stateOf(to)
+	return diffInstances(before.Instances, after.Instances, after.NonInstances), nil
+}
+
+// Dot formats the graph in the DOT language of Graphviz. Every edge is
+// labelled with its phrase, edges of phrases that caused violations are red
+// and the current state is drawn with a double border.
+func (g Graph) Dot() string {
+	var builder strings.Builder
+
+	builder.WriteString("digraph states {\n")
+
+	for _, state := range g.States {
+		attributes := ""
+		if state.Number == g.Current {
+			attributes = " [peripheries=2]"
+		}
+		fmt.Fprintf(&builder, "  %d%s;\n", state.Number, attributes)
+	}
+
+	for _, state := range g.States {
+		if state.Phrase == nil {
+			continue
+		}
+
+		attributes := "label=" + strconv.Quote(describePhrase(*state.Phrase))
+		if state.Result != nil && state.Result.Violated {
+			attributes += ", color=red"
+		}
+		fmt.Fprintf(&builder, "  %d -> %d [%s];\n", state.Parent, state.Number, attributes)
+	}
+
+	builder.WriteString("}\n")
+
+	return builder.String()
+}
+
+// describePhrase returns a short description of a phrase that changes the
+// state, such as "trigger greet(Alice,Bob)".
+func describePhrase(phrase Phrase) string {
+	if phrase.Operand != nil {
+		return phrase.Kind + " " + FormatExpression(*phrase.Operand)
+	}
+
+	switch name := phrase.Name.(type) {
+	case string:
+		return phrase.Kind + " " + name
+	case []string:
+		return phrase.Kind + " " + strings.Join(name, ", ")
+	case []interface{}:
+		names := make([]string, 0, len(name))
+		for _, n := range name {
+			names = append(names, fmt.Sprint(n))
+		}
+		return phrase.Kind + " " + strings.Join(names, ", ")
+	}
+
+	return phrase.Kind
+}
@@ -0,0 +1,367 @@
+package eflint
+
+import (
+	"reflect"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// HistoryEntry is a numbered state of the knowledge base. Every phrase that
+// changes the state records a new entry with the changes it made, and the
+// rest of the result of the phrase. State 0 is the state in which the history
+// was started.
+type HistoryEntry struct {
+	Number  int           `json:"number"`
+	Parent  int           `json:"parent"`
+	Phrase  *Phrase       `json:"phrase,omitempty"`
+	Result  *PhraseResult `json:"result,omitempty"`
+	Changes []Phrase      `json:"changes"`
+
+	delta *delta
+}
+
+// History is an overview of the recorded states. States are ordered in lines
+// of history, which start at state 0 and share the states they branched from.
+// The current state is on the current line, but not necessarily at its end:
+// after reverting to an earlier state, the later states can be returned to.
+// A phrase that changes the state before the end of a line starts a new line,
+// so the later states are kept on the line they were on.
+type History struct {
+	Current int            `json:"current"`
+	Line    int            `json:"line"`
+	Lines   [][]int        `json:"lines"`
+	States  []HistoryEntry `json:"states"`
+}
+
+// Only state 0 is kept as a copy of the knowledge base. Every other state is
+// kept as the difference with its parent, and a copy of the current state is
+// kept to find the difference made by the next phrase.
+type history struct {
+	entries map[int]*HistoryEntry
+	lines   [][]int
+	line    int
+	current int
+	next    int
+
+	root  State
+	state State
+}
+
+// delta is the difference between a recorded state and its parent. The
+// declarations are only kept if they were changed.
+type delta struct {
+	facts        map[string]interface{}
+	placeholders map[string]interface{}
+	instances    instanceDelta
+	nonInstances instanceDelta
+}
+
+// instanceDelta holds the instances that were added or changed, the keys of
+// the instances that were removed and the facts that no longer have any
+// instances at all.
+type instanceDelta struct {
+	set     map[string]*orderedmap.OrderedMap[uint64, Expression]
+	deleted map[string][]uint64
+	removed []string
+}
+
+// EnableHistory starts recording the states of the knowledge base, starting
+// with the current state as state 0. Recording the history keeps the changes
+// made by every phrase, so the history is not recorded by default.
+func (e *Engine) EnableHistory() {
+	e.history = &history{
+		entries: map[int]*HistoryEntry{0: {Number: 0, Parent: -1, Changes: []Phrase{}}},
+		lines:   [][]int{{0}},
+		next:    1,
+		root:    e.Snapshot(),
+		state:   e.Snapshot(),
+	}
+}
+
+// RecordsHistory returns whether the history of the engine is recorded.
+func (e *Engine) RecordsHistory() bool {
+	return e.history != nil
+}
+
+// History returns the lines of history and the states on the current line.
+func (e *Engine) History() (History, error) {
+	if e.history == nil {
+		return History{}, ErrNoHistory
+	}
+
+	h := e.history
+	result := History{
+		Current: h.current,
+		Line:    h.line,
+		Lines:   make([][]int, 0, len(h.lines)),
+		States:  make([]HistoryEntry, 0, len(h.lines[h.line])),
+	}
+
+	for _, line := range h.lines {
+		result.Lines = append(result.Lines, append([]int{}, line...))
+	}
+
+	for _, number := range h.lines[h.line] {
+		result.States = append(result.States, *h.entries[number])
+	}
+
+	return result, nil
+}
+
+// Revert restores the state with the given number. If it is not on the
+// current line, the most recent line that contains it becomes the current
+// line.
+func (e *Engine) Revert(number int) error {
+	if e.history == nil {
+		return ErrNoHistory
+	}
+
+	h := e.history
+	if h.position(h.line, number) < 0 {
+		found := false
+		for i := len(h.lines) - 1; i >= 0 && !found; i-- {
+			if h.position(i, number) >= 0 {
+				h.line = i
+				found = true
+			}
+		}
+
+		if !found {
+			return ErrUnknownState.Errorf("state %d does not exist", number)
+		}
+	}
+
+	h.current = number
+	h.state = h.stateOf(number)
+	e.Restore(h.state)
+
+	return nil
+}
+
+// Undo reverts to the state before the current one.
+func (e *Engine) Undo() error {
+	if e.history == nil {
+		return ErrNoHistory
+	}
+
+	position := e.history.position(e.history.line, e.history.current)
+	if position == 0 {
+		return ErrUnknownState.Errorf("there is no state before state %d", e.history.current)
+	}
+
+	return e.Revert(e.history.lines[e.history.line][position-1])
+}
+
+// Redo returns to the state after the current one, after it was reverted.
+func (e *Engine) Redo() error {
+	if e.history == nil {
+		return ErrNoHistory
+	}
+
+	line := e.history.lines[e.history.line]
+	position := e.history.position(e.history.line, e.history.current)
+	if position == len(line)-1 {
+		return ErrUnknownState.Errorf("there is no state after state %d", e.history.current)
+	}
+
+	return e.Revert(line[position+1])
+}
+
+// Branch starts a new line of history from the state with the given number
+// and restores that state. The current line is kept as it is, and the number
+// of the new line is returned.
+func (e *Engine) Branch(number int) (int, error) {
+	if e.history == nil {
+		return 0, ErrNoHistory
+	}
+
+	h := e.history
+	for i := len(h.lines) - 1; i >= 0; i-- {
+		if position := h.position(i, number); position >= 0 {
+			h.lines = append(h.lines, append([]int{}, h.lines[i][:position+1]...))
+			h.line = len(h.lines) - 1
+			h.current = number
+			h.state = h.stateOf(number)
+			e.Restore(h.state)
+
+			return h.line, nil
+		}
+	}
+
+	return 0, ErrUnknownState.Errorf("state %d does not exist", number)
+}
+
+// position returns the index of the state on the given line, or -1 if the
+// state is not on the line.
+func (h *history) position(line int, number int) int {
+	for i, n := range h.lines[line] {
+		if n == number {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// record adds the current state of the engine after the current state. If
+// the current state is not at the end of the current line, a new line is
+// started from it, like Branch does, so the later states are kept.
+func (e *Engine) record(phrase Phrase, result PhraseResult) {
+	h := e.history
+
+	line := h.lines[h.line]
+	position := h.position(h.line, h.current)
+	if position == len(line)-1 {
+		h.lines[h.line] = append(line, h.next)
+	} else {
+		h.lines = append(h.lines, append(line[:position+1:position+1], h.next))
+		h.line = len(h.lines) - 1
+	}
+
+	changes := result.Changes
+	if changes == nil {
+		changes = []Phrase{}
+	}
+	result.Changes = nil
+
+	// Only the difference with the previous state is kept, which is applied
+	// to the copy of the previous state to keep it up to date
+	d := &delta{
+		instances:    diffState(h.state.Instances, e.instances),
+		nonInstances: diffState(h.state.NonInstances, e.nonInstances),
+	}
+	// The declarations are compared as copies, as copying them fills in
+	// empty lists
+	facts, placeholders := copyFacts(e.state["facts"]), copyFacts(e.state["placeholders"])
+	if !reflect.DeepEqual(h.state.Facts, facts) || !reflect.DeepEqual(h.state.Placeholders, placeholders) {
+		d.facts = facts
+		d.placeholders = placeholders
+	}
+	d.apply(&h.state)
+
+	phrase = copyPhrase(phrase)
+	h.entries[h.next] = &HistoryEntry{
+		Number:  h.next,
+		Parent:  h.current,
+		Phrase:  &phrase,
+		Result:  &result,
+		Changes: changes,
+		delta:   d,
+	}
+	h.current = h.next
+	h.next++
+}
+
+// stateOf rebuilds a recorded state, by applying the differences on the way
+// from state 0 to it.
+func (h *history) stateOf(number int) State {
+	path := make([]*delta, 0)
+	for entry := h.entries[number]; entry.delta != nil; entry = h.entries[entry.Parent] {
+		path = append(path, entry.delta)
+	}
+
+	state := State{
+		Facts:        h.root.Facts,
+		Placeholders: h.root.Placeholders,
+		Instances:    copyInstances(h.root.Instances),
+		NonInstances: copyInstances(h.root.NonInstances),
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i].apply(&state)
+	}
+
+	return state
+}
+
+// apply changes a state into the state after the delta. The declarations are
+// replaced rather than changed, so they can be shared with the delta.
+func (d *delta) apply(state *State) {
+	if d.facts != nil {
+		state.Facts = d.facts
+		state.Placeholders = d.placeholders
+	}
+
+	d.instances.apply(state.Instances)
+	d.nonInstances.apply(state.NonInstances)
+}
+
+func (d instanceDelta) apply(instances map[string]*orderedmap.OrderedMap[uint64, Expression]) {
+	for _, factName := range d.removed {
+		delete(instances, factName)
+	}
+
+	for factName, keys := range d.deleted {
+		for _, key := range keys {
+			instances[factName].Delete(key)
+		}
+	}
+
+	for factName, set := range d.set {
+		if _, ok := instances[factName]; !ok {
+			instances[factName] = orderedmap.New[uint64, Expression]()
+		}
+		for pair := set.Oldest(); pair != nil; pair = pair.Next() {
+			instances[factName].Set(pair.Key, pair.Value)
+		}
+	}
+}
+
+// diffState returns the difference between the instances before and after a
+// phrase. Instances of which only the derived flag changed count as changed.
+func diffState(before, after map[string]*orderedmap.OrderedMap[uint64, Expression]) instanceDelta {
+	d := instanceDelta{
+		set:     make(map[string]*orderedmap.OrderedMap[uint64, Expression]),
+		deleted: make(map[string][]uint64),
+	}
+
+	for factName, instances := range after {
+		previous, known := before[factName]
+		if !known {
+			d.set[factName] = orderedmap.New[uint64, Expression]()
+		}
+
+		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
+			if known {
+				if old, ok := previous.Get(pair.Key); ok && old.IsDerived == pair.Value.IsDerived {
+					continue
+				}
+			}
+
+			if _, ok := d.set[factName]; !ok {
+				d.set[factName] = orderedmap.New[uint64, Expression]()
+			}
+			d.set[factName].Set(pair.Key, copyExpression(pair.Value))
+		}
+	}
+
+	for factName, instances := range before {
+		current, ok := after[factName]
+		if !ok {
+			d.removed = append(d.removed, factName)
+			continue
+		}
+
+		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
+			if _, ok := current.Get(pair.Key); !ok {
+				d.deleted[factName] = append(d.deleted[factName], pair.Key)
+			}
+		}
+	}
+
+	return d
+}
+
+// copyPhrase copies the expressions of a phrase, so that the recorded phrase
+// is not affected by later changes to the phrase that was interpreted.
+func copyPhrase(phrase Phrase) Phrase {
+	if phrase.Expression != nil {
+		expression := copyExpression(*phrase.Expression)
+		phrase.Expression = &expression
+	}
+	if phrase.Operand != nil {
+		operand := copyExpression(*phrase.Operand)
+		phrase.Operand = &operand
+	}
+
+	return phrase
+}
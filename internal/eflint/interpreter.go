@@ -4,58 +4,89 @@ import (
 	"fmt"
 	"github.com/mitchellh/hashstructure/v2"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"io"
 	"log"
 	"reflect"
+	"sort"
 	"strings"
 )
 
 var (
-	verbose           = false
-	customDerivation  = false
 	derivationVersion = 3
 )
 
-func Println(a ...any) {
-	if verbose {
-		fmt.Println(a...)
+// SetTrace makes the engine trace what it does to a writer, such as the
+// transitions it executes and the violations it finds. A nil writer turns
+// tracing off.
+func (e *Engine) SetTrace(w io.Writer) {
+	e.trace = w
+}
+
+// println writes a line to the trace of the engine, if it is traced.
+func (e *Engine) println(a ...any) {
+	if e.trace != nil {
+		fmt.Fprintln(e.trace, a...)
 	}
 }
 
-func getFactName(name string) string {
-	// If the name ends with quotation marks or digits, remove those
-	name = strings.TrimRight(name, "'0123456789")
+func (e *Engine) getFactName(name string) string {
+	// If the name ends with primes or digits, remove those, unless the name
+	// is declared as it is, like [article 6]
+	if _, ok := e.state["facts"][name]; !ok && e.state["placeholders"][name] == nil {
+		name = strings.TrimRight(name, "'0123456789")
+	}
 
-	if globalState["placeholders"][name] != nil {
-		return getFactName(globalState["placeholders"][name].(string))
+	if e.state["placeholders"][name] != nil {
+		return e.getFactName(e.state["placeholders"][name].(string))
 	}
 
 	return name
 }
 
-// InterpretPhrases interprets the given phrases and returns the results
-func InterpretPhrases(phrases []Phrase) {
-	// Clean the global result and error state
-	globalErrors = make([]Error, 0)
-	globalResults = make([]PhraseResult, 0)
-	globalState = make(map[string]map[string]interface{})
-	globalState["facts"] = make(map[string]interface{})
-	globalState["placeholders"] = make(map[string]interface{})
-	globalInstances = make(map[string]*orderedmap.OrderedMap[uint64, Expression])
-	globalNonInstances = make(map[string]*orderedmap.OrderedMap[uint64, Expression])
-
-	initializeFacts()
+// Interpret interprets the given phrases in the state of the engine and
+// returns the results. If updates is set, the changes to the state are
+// reported for every phrase. Otherwise, they are only reported for the phrases
+// that ask for them.
+func (e *Engine) Interpret(phrases []Phrase, updates bool) []PhraseResult {
+	// Clean the result state
+	e.results = make([]PhraseResult, 0)
 
 	for _, phrase := range phrases {
-		if err := InterpretPhrase(phrase); err != nil {
-			// TODO: Stop after first error? Or continue?
-			log.Println(err, "oh no")
+		count := len(e.results)
+
+		if err := e.interpretSafely(phrase, phrase.Updates || updates); err != nil {
+			// The error only fails the result of the phrase that caused it
+			if len(e.results) == count {
+				e.results = append(e.results, PhraseResult{})
+			}
+
+			index := len(e.results) - 1
+			e.results[index].Success = false
+			e.results[index].Errors = append(e.results[index].Errors, AsError(locate(err, phrase.Position)))
 		}
 	}
+
+	return e.results
 }
 
-func initializeFacts() {
+// interpretSafely interprets a single phrase and turns a panic into an
+// internal error, so a bug in the interpreter only fails the phrase that
+// triggered it.
+func (e *Engine) interpretSafely(phrase Phrase, updates bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.customDerivation = false
+			e.violatedDuties = nil
+			err = ErrInternal.Errorf("internal error: %v", r)
+		}
+	}()
+
+	return e.interpretPhrase(phrase, updates)
+}
+
+func (e *Engine) initializeFacts() {
 	for factName, factType := range defaultFacts {
-		handleAtomicFact(Phrase{
+		e.handleAtomicFact(Phrase{
 			Kind: "create",
 			Name: factName,
 			Type: factType,
@@ -63,142 +94,328 @@ func initializeFacts() {
 	}
 }
 
-func addViolation(reason string, violation Expression) {
-	if _, ok := globalViolations[reason]; !ok {
-		globalViolations[reason] = make([]Expression, 0)
+// addViolation records a violation of the current phrase, located at the
+// declaration of the violated fact.
+func (e *Engine) addViolation(violation Violation) {
+	violation.Position = e.declarationPosition(violation.Identifier)
+	e.violations = append(e.violations, violation)
+}
+
+// listViolations adds the violations that were found to the result of the
+// current phrase. Duties are compared with the duties that were violated
+// before the phrase, if those are known: duties that become violated are
+// marked as such, and duties that are no longer violated are added as
+// unviolated.
+func (e *Engine) listViolations(previous map[string]Violation) {
+	index := len(e.results) - 1
+	violations := e.collectViolations()
+
+	current := make(map[string]Violation)
+	for i, violation := range violations {
+		if violation.Kind != "duty" {
+			continue
+		}
+
+		key := violationKey(violation)
+		current[key] = violation
+		if _, ok := previous[key]; previous != nil && !ok {
+			violations[i].Change = "violated"
+		}
+	}
+
+	if previous != nil {
+		keys := make([]string, 0, len(previous))
+		for key := range previous {
+			if _, ok := current[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			violation := previous[key]
+			violation.Change = "unviolated"
+			e.println("  unviolated duty:", key)
+			violations = append(violations, violation)
+		}
+
+		e.violatedDuties = current
 	}
 
-	globalViolations[reason] = append(globalViolations[reason], violation)
+	for _, violation := range violations {
+		if violation.Change != "unviolated" {
+			e.results[index].Violated = true
+		}
+	}
+	e.results[index].Violations = append(e.results[index].Violations, violations...)
 }
 
-func listViolations() {
-	if len(globalViolations) == 0 {
-		return
+// dutiesViolated returns the duties that are violated in the current state of
+// the knowledge base, by their instance.
+func (e *Engine) dutiesViolated() (map[string]Violation, error) {
+	if e.violatedDuties != nil {
+		return e.violatedDuties, nil
+	}
+
+	violations, err := e.Violations()
+	if err != nil {
+		return nil, err
+	}
+
+	duties := make(map[string]Violation)
+	for _, violation := range violations {
+		if violation.Kind == "duty" {
+			duties[violationKey(violation)] = violation
+		}
 	}
 
-	index := len(globalResults) - 1
+	return duties, nil
+}
 
-	globalResults[index].Violated = true
+func violationKey(violation Violation) string {
+	return FormatExpression(Expression{Identifier: violation.Identifier, Operands: violation.Operands})
+}
 
-	Println("violations:")
+// Violations returns the duties and invariants that are violated in the
+// current state of the knowledge base.
+func (e *Engine) Violations() ([]Violation, error) {
+	previous := e.violations
+	defer func() {
+		e.violations = previous
+	}()
 
-	for reason, violations := range globalViolations {
-		for _, violation := range violations {
-			switch reason {
+	e.violations = make([]Violation, 0)
+	if err := e.CheckViolations(); err != nil {
+		return nil, err
+	}
 
-			case "act":
-				Println("  disabled action:", formatExpression(violation))
-			case "duty":
-				Println("  violated duty!:", formatExpression(violation))
-			case "invariant":
-				Println("  violated invariant!:", formatExpression(violation))
-			}
+	return e.collectViolations(), nil
+}
 
-			if violation.Value != nil {
-				globalResults[index].Violations = append(globalResults[index].Violations, Violation{
-					Kind:       reason,
-					Identifier: violation.Value.([]string)[0],
-					Operands:   []Expression{}})
-			} else {
-				globalResults[index].Violations = append(globalResults[index].Violations, Violation{
-					Kind:       reason,
-					Identifier: violation.Identifier,
-					Operands:   violation.Operands})
-			}
+// collectViolations returns the violations that were found.
+func (e *Engine) collectViolations() []Violation {
+	result := make([]Violation, 0, len(e.violations))
+
+	e.println("violations:")
+
+	for _, violation := range e.violations {
+		instance := violationKey(violation)
+
+		switch violation.Kind {
+		case "act":
+			e.println("  disabled action:", instance)
+		case "duty":
+			e.println("  violated duty!:", instance)
+		case "invariant":
+			e.println("  violated invariant!:", violation.Identifier)
 		}
+
+		result = append(result, violation)
+	}
+
+	return result
+}
+
+// declarationPosition returns the position at which a fact was declared, if
+// it is known.
+func (e *Engine) declarationPosition(name string) *Position {
+	switch fact := e.state["facts"][name].(type) {
+	case AtomicFact:
+		return fact.Position
+	case CompositeFact:
+		return fact.Position
 	}
+
+	return nil
+}
+
+// InterpretPhrase interprets a single phrase, and reports its changes if the
+// phrase asks for them.
+func (e *Engine) InterpretPhrase(phrase Phrase) error {
+	return e.interpretPhrase(phrase, phrase.Updates)
 }
 
-func InterpretPhrase(phrase Phrase) error {
-	globalViolations = make(map[string][]Expression)
-	currentInstances := make(map[string]*orderedmap.OrderedMap[uint64, Expression])
-	currentNonInstances := make(map[string]*orderedmap.OrderedMap[uint64, Expression])
+// interpretPhrase interprets a single phrase, and reports its changes if
+// updates is set.
+func (e *Engine) interpretPhrase(phrase Phrase, updates bool) error {
+	// Stateless phrases are interpreted in a temporary copy of the knowledge
+	// base. Their changes are reported, but not committed.
+	if phrase.Stateless {
+		snapshot := e.Snapshot()
+		duties := e.violatedDuties
+		defer func() {
+			e.Restore(snapshot)
+			e.violatedDuties = duties
+		}()
+	}
+
+	e.violations = make([]Violation, 0)
 
-	for factName, instances := range globalInstances {
-		currentInstances[factName] = orderedmap.New[uint64, Expression]()
-		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
-			currentInstances[factName].Set(pair.Key, pair.Value)
+	// Computing the changes requires a copy of all instances from before the
+	// phrase, so this is only done when the changes are requested, recorded in
+	// the history or the only outcome of a stateless phrase.
+	reported := updates || phrase.Stateless
+	recorded := e.history != nil && !phrase.Stateless
+	var currentInstances map[string]*orderedmap.OrderedMap[uint64, Expression]
+	if reported || recorded {
+		currentInstances = make(map[string]*orderedmap.OrderedMap[uint64, Expression])
+
+		for factName, instances := range e.instances {
+			currentInstances[factName] = orderedmap.New[uint64, Expression]()
+			for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
+				currentInstances[factName].Set(pair.Key, pair.Value)
+			}
 		}
 	}
 
-	for factName, instances := range globalNonInstances {
-		currentNonInstances[factName] = orderedmap.New[uint64, Expression]()
-		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
-			currentNonInstances[factName].Set(pair.Key, pair.Value)
+	e.results = append(e.results, PhraseResult{Success: true, Changes: []Phrase{}, Triggers: []Trigger{}, Violations: []Violation{}})
+
+	// Expressions that refer to unknown facts are rejected before anything
+	// is changed
+	for _, expression := range []*Expression{phrase.Operand, phrase.Expression} {
+		if expression == nil {
+			continue
+		}
+
+		check := copyExpression(*expression)
+		if err := e.TypeCheckExpression(&check); err != nil {
+			return err
 		}
 	}
 
-	globalResults = append(globalResults, PhraseResult{Success: true, Changes: []Phrase{}, Triggers: []Trigger{}, Violations: []Violation{}})
+	// The duties that are violated before the phrase, to find the duties
+	// that become violated or unviolated by it
+	var previous map[string]Violation
+	if phrase.Kind != "bquery" && phrase.Kind != "iquery" {
+		duties, err := e.dutiesViolated()
+		if err != nil {
+			return err
+		}
+		previous = duties
+	}
 
 	var err error = nil
 
 	switch phrase.Kind {
 	case "afact":
-		err = handleAtomicFact(phrase)
+		err = e.handleAtomicFact(phrase)
 	case "cfact":
-		err = handleCompositeFact(phrase)
+		err = e.handleCompositeFact(phrase)
 	case "placeholder":
-		err = handlePlaceholder(phrase)
+		err = e.handlePlaceholder(phrase)
 	case "create":
-		err = handleCreate(*phrase.Operand, false)
+		err = e.handleCreate(*phrase.Operand, false)
 	case "terminate":
-		err = handleTerminate(*phrase.Operand)
+		err = e.handleTerminate(*phrase.Operand)
 	case "obfuscate":
-		err = handleObfuscate(*phrase.Operand)
+		err = e.handleObfuscate(*phrase.Operand)
 	case "bquery":
-		globalResults[len(globalResults)-1].IsBquery = true
-		err = handleBQuery(*phrase.Expression)
+		e.results[len(e.results)-1].IsBquery = true
+		err = e.handleBQuery(*phrase.Expression)
 	case "iquery":
-		globalResults[len(globalResults)-1].IsIquery = true
-		err = handleIQuery(*phrase.Expression, phrase.WhenTrue)
+		e.results[len(e.results)-1].IsIquery = true
+		err = e.handleIQuery(*phrase.Expression, phrase.WhenTrue)
 	case "predicate":
-		err = handlePredicate(phrase)
+		err = e.handlePredicate(phrase)
 	case "event":
-		err = handleEvent(phrase)
+		err = e.handleEvent(phrase)
 	case "act":
-		err = handleAct(phrase)
+		err = e.handleAct(phrase)
 	case "duty":
-		err = handleDuty(phrase)
+		err = e.handleDuty(phrase)
 	case "trigger":
-		err = handleTrigger(*phrase.Operand)
+		err = e.handleTrigger(*phrase.Operand, "")
 	case "extend":
-		err = handleExtend(phrase)
+		err = e.handleExtend(phrase)
 	default:
 		//err = fmt.Errorf("unknown phrase kind: %s", phrase.Kind)
 	}
 
 	// Queries can never influence the state
 	if phrase.Kind == "bquery" || phrase.Kind == "iquery" {
-		return nil
+		return err
 	}
 
-	index := len(globalResults) - 1
+	index := len(e.results) - 1
 
+	var derivationErr error
 	if derivationVersion == 1 {
-		DeriveFacts()
+		derivationErr = e.DeriveFacts()
 	} else if derivationVersion == 2 {
-		DeriveFacts2()
+		derivationErr = e.DeriveFacts2()
 	} else if derivationVersion == 3 {
-		DeriveFacts3()
+		derivationErr = e.DeriveFacts3()
 	} else {
-		panic("unknown derivation version")
+		derivationErr = ErrInternal.Errorf("unknown derivation version %d", derivationVersion)
+	}
+
+	if err == nil {
+		err = derivationErr
+	}
+
+	// Without a complete derivation, the violated duties are not known
+	if derivationErr != nil {
+		previous = nil
+		e.violatedDuties = nil
+	}
+
+	e.listViolations(previous)
+
+	if reported || recorded {
+		e.results[index].Changes = append(e.results[index].Changes, e.listChanges(currentInstances)...)
+	}
+
+	if recorded && err == nil {
+		e.record(phrase, e.results[index])
+	}
+
+	if !reported {
+		e.results[index].Changes = []Phrase{}
+	}
+
+	return err
+}
+
+// listChanges returns the phrases that lead from the given instances to the
+// current instances of the engine.
+func (e *Engine) listChanges(currentInstances map[string]*orderedmap.OrderedMap[uint64, Expression]) []Phrase {
+	changes := diffInstances(currentInstances, e.instances, e.nonInstances)
+	for _, change := range changes {
+		prefix := map[string]string{"create": "+", "terminate": "-", "obfuscate": "~"}[change.Kind]
+		e.println(prefix + FormatExpression(*change.Operand))
 	}
 
-	listViolations()
+	return changes
+}
+
+// diffInstances returns the phrases that lead from the instances before to the
+// instances after, ordered by the name of their fact. Instances that are no
+// longer there are terminated if they are non-instances afterwards, and
+// obfuscated otherwise.
+func diffInstances(before, after, nonInstances map[string]*orderedmap.OrderedMap[uint64, Expression]) []Phrase {
+	changes := make([]Phrase, 0)
 
-	for factName, instances := range currentInstances {
-		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
-			if _, ok := globalInstances[factName].Get(pair.Key); !ok {
+	// The fact of an instance is not declared in every state
+	contains := func(instances map[string]*orderedmap.OrderedMap[uint64, Expression], factName string, key uint64) bool {
+		if _, ok := instances[factName]; !ok {
+			return false
+		}
+
+		_, ok := instances[factName].Get(key)
+		return ok
+	}
+
+	for _, factName := range sortedFactNames(before) {
+		for pair := before[factName].Oldest(); pair != nil; pair = pair.Next() {
+			if !contains(after, factName, pair.Key) {
 				expr := copyExpression(pair.Value)
-				if _, ok := globalNonInstances[factName].Get(pair.Key); !ok {
-					Println("~" + formatExpression(pair.Value))
-					globalResults[index].Changes = append(globalResults[index].Changes, Phrase{
+				if !contains(nonInstances, factName, pair.Key) {
+					changes = append(changes, Phrase{
 						Kind:    "obfuscate",
 						Operand: &expr,
 					})
 				} else {
-					Println("-" + formatExpression(pair.Value))
-					globalResults[index].Changes = append(globalResults[index].Changes, Phrase{
+					changes = append(changes, Phrase{
 						Kind:    "terminate",
 						Operand: &expr,
 					})
@@ -207,45 +424,51 @@ func InterpretPhrase(phrase Phrase) error {
 		}
 	}
 
-	for factName, instances := range globalInstances {
-		for pair := instances.Oldest(); pair != nil; pair = pair.Next() {
-			// Check if currentInstances contains the factName
-			if _, ok := currentInstances[factName]; ok {
-				if _, ok := currentInstances[factName].Get(pair.Key); ok {
-					continue
-				}
+	for _, factName := range sortedFactNames(after) {
+		for pair := after[factName].Oldest(); pair != nil; pair = pair.Next() {
+			if contains(before, factName, pair.Key) {
+				continue
 			}
 
-			Println("+" + formatExpression(pair.Value))
 			expr := copyExpression(pair.Value)
-			globalResults[index].Changes = append(globalResults[index].Changes, Phrase{
+			changes = append(changes, Phrase{
 				Kind:    "create",
 				Operand: &expr,
 			})
 		}
 	}
 
-	return err
+	return changes
 }
 
-func handleExtend(phrase Phrase) error {
+func sortedFactNames(instances map[string]*orderedmap.OrderedMap[uint64, Expression]) []string {
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (e *Engine) handleExtend(phrase Phrase) error {
 	name, ok := phrase.Name.(string)
 
 	if !ok {
-		panic("Error in name for extend")
+		return ErrInvalidPhrase.Errorf("the name of an extend must be a string")
 	}
-	if !factExists(name) {
-		return fmt.Errorf("fact does not exist")
+	if !e.factExists(name) {
+		return ErrUnknownFact.Errorf("cannot extend fact %s, as it does not exist", name)
 	}
 
-	fact := globalState["facts"][name]
+	fact := e.state["facts"][name]
 
 	if afact, ok := fact.(AtomicFact); ok {
 		afact.DerivedFrom = append(afact.DerivedFrom, phrase.DerivedFrom...)
 		afact.HoldsWhen = append(afact.HoldsWhen, phrase.HoldsWhen...)
 		afact.ConditionedBy = append(afact.ConditionedBy, phrase.ConditionedBy...)
 
-		globalState["facts"][name] = afact
+		e.state["facts"][name] = afact
 	} else if cfact, ok := fact.(CompositeFact); ok {
 		cfact.DerivedFrom = append(cfact.DerivedFrom, phrase.DerivedFrom...)
 		cfact.HoldsWhen = append(cfact.HoldsWhen, phrase.HoldsWhen...)
@@ -258,35 +481,36 @@ func handleExtend(phrase Phrase) error {
 			cfact.Obfuscates = append(cfact.Obfuscates, phrase.Obfuscates...)
 		}
 
-		globalState["facts"][name] = cfact
+		e.state["facts"][name] = cfact
 	} else {
-		panic("Error in fact type for extend")
+		return ErrInternal.Errorf("fact %s is neither atomic nor composite", name)
 	}
 
 	return nil
 }
 
-func handlePredicate(phrase Phrase) error {
+func (e *Engine) handlePredicate(phrase Phrase) error {
 	// A predicate is a fact without parameters
-	err := handleAtomicFact(Phrase{
+	err := e.handleAtomicFact(Phrase{
 		Kind:        phrase.Kind,
 		Name:        phrase.Name,
 		HoldsWhen:   []Expression{*phrase.Expression},
 		IsInvariant: phrase.IsInvariant,
+		Position:    phrase.Position,
 	})
 
 	if err != nil {
 		return err
 	}
 
-	globalResults[len(globalResults)-1].Changes = []Phrase{phrase}
+	e.results[len(e.results)-1].Changes = []Phrase{phrase}
 
 	return nil
 }
 
-func handleEvent(phrase Phrase) error {
+func (e *Engine) handleEvent(phrase Phrase) error {
 	// An event is a composite fact
-	return handleCompositeFact(Phrase{
+	return e.handleCompositeFact(Phrase{
 		Kind:          phrase.Kind,
 		Name:          phrase.Name,
 		IdentifiedBy:  phrase.RelatedTo,
@@ -298,11 +522,12 @@ func handleEvent(phrase Phrase) error {
 		Terminates:    phrase.Terminates,
 		Obfuscates:    phrase.Obfuscates,
 		FactType:      EventType,
+		Position:      phrase.Position,
 	})
 }
 
-func handleAct(phrase Phrase) error {
-	return handleCompositeFact(Phrase{
+func (e *Engine) handleAct(phrase Phrase) error {
+	return e.handleCompositeFact(Phrase{
 		Kind:          phrase.Kind,
 		Name:          phrase.Name,
 		IdentifiedBy:  append([]string{phrase.Actor}, phrase.RelatedTo...),
@@ -314,11 +539,12 @@ func handleAct(phrase Phrase) error {
 		Terminates:    phrase.Terminates,
 		Obfuscates:    phrase.Obfuscates,
 		FactType:      ActType,
+		Position:      phrase.Position,
 	})
 }
 
-func handleDuty(phrase Phrase) error {
-	return handleCompositeFact(Phrase{
+func (e *Engine) handleDuty(phrase Phrase) error {
+	return e.handleCompositeFact(Phrase{
 		Kind:          phrase.Kind,
 		Name:          phrase.Name,
 		IdentifiedBy:  append([]string{phrase.Holder, phrase.Claimant}, phrase.RelatedTo...),
@@ -327,30 +553,31 @@ func handleDuty(phrase Phrase) error {
 		ConditionedBy: phrase.ConditionedBy,
 		ViolatedWhen:  phrase.ViolatedWhen,
 		FactType:      ActType,
+		Position:      phrase.Position,
 	})
 }
 
-func handlePlaceholder(phrase Phrase) error {
+func (e *Engine) handlePlaceholder(phrase Phrase) error {
 	if names, ok := phrase.Name.([]string); ok {
 		name := names[0]
-		if _, ok := globalState["placeholders"][name]; ok {
-			return fmt.Errorf("placeholder %s already exists", name)
+		if _, ok := e.state["placeholders"][name]; ok {
+			return ErrDuplicatePlaceholder.Errorf("placeholder %s already exists", name)
 		} else {
-			globalState["placeholders"][name] = phrase.For
+			e.state["placeholders"][name] = phrase.For
 			log.Println("New placeholder:", phrase.Name, phrase.For)
-			globalResults[len(globalResults)-1].Changes = []Phrase{phrase}
+			e.results[len(e.results)-1].Changes = []Phrase{phrase}
 			return nil
 		}
 	} else {
-		panic("placeholder name is not a list of strings")
+		return ErrInvalidPhrase.Errorf("the name of a placeholder must be a list of strings")
 	}
 }
 
-func fillParameters(expression Expression, params []string, values []Expression) Expression {
+func (e *Engine) fillParameters(expression Expression, params []string, values []Expression) (Expression, error) {
 	newExpression := copyExpression(expression)
-	err := TypeCheckExpression(&newExpression)
+	err := e.TypeCheckExpression(&newExpression)
 	if err != nil {
-		panic(err)
+		return newExpression, err
 	}
 
 	for i, param := range params {
@@ -360,102 +587,177 @@ func fillParameters(expression Expression, params []string, values []Expression)
 		}
 	}
 
-	return newExpression
+	return newExpression, nil
+}
+
+// gatherEffects fills in the parameters of the given effects and returns all
+// instances they evaluate to.
+func (e *Engine) gatherEffects(effects []Expression, params []string, values []Expression) ([]Expression, error) {
+	result := make([]Expression, 0)
+
+	for _, effect := range effects {
+		filled, err := e.fillParameters(effect, params, values)
+		if err != nil {
+			return nil, err
+		}
+
+		instances, err := e.gatherExpressions(filled)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, instances...)
+	}
+
+	return result, nil
 }
 
-func handleTrigger(operand Expression) error {
+// transition holds the effects of a trigger, including those of the acts and
+// events it syncs with, and the instances that were triggered, so that each
+// instance is triggered once even if the syncs form a cycle.
+type transition struct {
+	obfuscates []Expression
+	terminates []Expression
+	creates    []Expression
+	triggered  map[string]bool
+}
+
+// handleTrigger triggers the instances of the operand as a single transition.
+// The parent is the name of the act or event whose trigger syncs with them,
+// if any. All effects are evaluated in the state before the transition, and
+// terminations are applied before creations, so an instance that is both
+// terminated and created holds afterwards.
+func (e *Engine) handleTrigger(operand Expression, parent string) error {
+	effects := &transition{triggered: make(map[string]bool)}
+	if err := e.gatherTransition(operand, parent, effects); err != nil {
+		return err
+	}
+
+	for _, obfuscate := range effects.obfuscates {
+		if err := e.handleObfuscate(obfuscate); err != nil {
+			return err
+		}
+	}
+
+	for _, terminate := range effects.terminates {
+		if err := e.handleTerminate(terminate); err != nil {
+			return err
+		}
+	}
+
+	for _, create := range effects.creates {
+		if err := e.create(create, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gatherTransition reports the triggers of the instances of the operand and
+// the acts and events they sync with, and adds their effects to the
+// transition.
+func (e *Engine) gatherTransition(operand Expression, parent string, effects *transition) error {
 	// A trigger can trigger an Event
 
 	// Iterate over the given operand
-	for _, expr := range gatherExpressions(operand) {
+	exprs, err := e.gatherExpressions(operand)
+	if err != nil {
+		return err
+	}
+
+	for _, expr := range exprs {
 		if expr.Identifier == "" {
 			log.Println("Skipping non-identifier expression in trigger", expr)
 			continue
 		}
 
-		expr, err := convertInstance(expr)
+		expr, err := e.convertInstance(expr)
 		if err != nil {
-			log.Println("Error in converting trigger instance")
+			return err
+		}
+
+		key := FormatExpression(expr)
+		if effects.triggered[key] {
 			continue
 		}
+		effects.triggered[key] = true
 
-		Println("executed transition:")
+		e.println("executed transition:")
 
 		// Check if the given identifier is a fact which is triggerable
-		if fact, ok := globalState["facts"][expr.Identifier]; ok {
+		if fact, ok := e.state["facts"][expr.Identifier]; ok {
 			if cfact, ok := fact.(CompositeFact); ok {
 				if cfact.FactType == ActType {
-					// Need to check if the fact is triggerable by checking if it holds true
-					eval, err := evaluateInstance(expr)
+					eval, err := e.enabled(expr)
 					if err != nil {
-						log.Println("Error in evaluating Act")
-						continue
+						return err
 					}
 
 					if !eval {
-						// TODO: Non-true act can still be enabled if its conditioned-by fields are okay.
-						Println(formatExpression(expr), "(DISABLED)")
-						addViolation("act", copyExpression(expr))
+						e.println(FormatExpression(expr), "(DISABLED)")
+						instance := copyExpression(expr)
+						e.addViolation(Violation{Kind: "act", Identifier: instance.Identifier, Operands: instance.Operands})
 					} else {
-						Println(formatExpression(expr), "(ENABLED)")
+						e.println(FormatExpression(expr), "(ENABLED)")
 					}
 				} else if cfact.FactType == EventType {
-					Println(formatExpression(expr))
+					e.println(FormatExpression(expr))
 				} else if cfact.FactType == DutyType {
-					Println("Triggering duty", cfact.Name)
+					e.println("Triggering duty", cfact.Name)
 				} else {
-					log.Println("Fact is not triggerable")
-					break
+					return ErrNotTriggerable.Errorf("fact %s is not triggerable", expr.Identifier)
 				}
 
-				syncsWith := make([]Expression, 0)
-				obfuscates := make([]Expression, 0)
-				terminates := make([]Expression, 0)
-				creates := make([]Expression, 0)
-
-				for _, sync := range cfact.SyncsWith {
-					syncsWith = append(syncsWith, gatherExpressions(fillParameters(sync, cfact.IdentifiedBy, expr.Operands))...)
-				}
-
-				for _, obfuscate := range cfact.Obfuscates {
-					obfuscates = append(obfuscates, gatherExpressions(fillParameters(obfuscate, cfact.IdentifiedBy, expr.Operands))...)
+				syncsWith, err := e.gatherEffects(cfact.SyncsWith, cfact.IdentifiedBy, expr.Operands)
+				if err != nil {
+					return err
 				}
 
-				for _, terminate := range cfact.Terminates {
-					terminates = append(terminates, gatherExpressions(fillParameters(terminate, cfact.IdentifiedBy, expr.Operands))...)
+				obfuscates, err := e.gatherEffects(cfact.Obfuscates, cfact.IdentifiedBy, expr.Operands)
+				if err != nil {
+					return err
 				}
 
-				for _, create1 := range cfact.Creates {
-					creates = append(creates, gatherExpressions(fillParameters(create1, cfact.IdentifiedBy, expr.Operands))...)
+				terminates, err := e.gatherEffects(cfact.Terminates, cfact.IdentifiedBy, expr.Operands)
+				if err != nil {
+					return err
 				}
 
-				for _, sync := range syncsWith {
-					handleTrigger(sync)
+				creates, err := e.gatherEffects(cfact.Creates, cfact.IdentifiedBy, expr.Operands)
+				if err != nil {
+					return err
 				}
 
-				for _, obfuscate := range obfuscates {
-					handleObfuscate(obfuscate)
-				}
+				kinds := map[int]string{EventType: "event", ActType: "act", DutyType: "duty"}
+				e.results[len(e.results)-1].Triggers = append(e.results[len(e.results)-1].Triggers, Trigger{
+					Identifier: expr.Identifier,
+					Kind:       kinds[cfact.FactType],
+					Parent:     parent,
+					Position:   cfact.Position,
+				})
 
-				for _, terminate := range terminates {
-					handleTerminate(terminate)
-				}
+				effects.obfuscates = append(effects.obfuscates, obfuscates...)
+				effects.terminates = append(effects.terminates, terminates...)
+				effects.creates = append(effects.creates, creates...)
 
-				for _, create1 := range creates {
-					create(create1, false)
+				for _, sync := range syncsWith {
+					if err := e.gatherTransition(sync, expr.Identifier, effects); err != nil {
+						return err
+					}
 				}
 			} else {
-				log.Println("Fact is not triggerable")
+				return ErrNotTriggerable.Errorf("fact %s is not triggerable", expr.Identifier)
 			}
 		} else {
-			log.Println("Fact not found in trigger")
+			return ErrUnknownFact.Errorf("fact %s does not exist", expr.Identifier)
 		}
 	}
 
 	return nil
 }
 
-func handleAtomicFact(fact Phrase) error {
+func (e *Engine) handleAtomicFact(fact Phrase) error {
 	afact := AtomicFact{
 		Name:          fact.Name.(string),
 		Type:          fact.Type,
@@ -464,24 +766,25 @@ func handleAtomicFact(fact Phrase) error {
 		HoldsWhen:     fact.HoldsWhen,
 		ConditionedBy: fact.ConditionedBy,
 		IsInvariant:   fact.IsInvariant,
+		Position:      fact.Position,
 	}
 
-	globalState["facts"][afact.Name] = afact
+	e.state["facts"][afact.Name] = afact
 
 	// Initialise instances and non-instances for the atomic fact
-	globalInstances[afact.Name] = orderedmap.New[uint64, Expression]()
-	globalNonInstances[afact.Name] = orderedmap.New[uint64, Expression]()
+	e.instances[afact.Name] = orderedmap.New[uint64, Expression]()
+	e.nonInstances[afact.Name] = orderedmap.New[uint64, Expression]()
 
-	index := len(globalResults) - 1
+	index := len(e.results) - 1
 	if index >= 0 {
-		globalResults[index].Changes = []Phrase{fact}
-		Println("New type", afact.Name)
+		e.results[index].Changes = []Phrase{fact}
+		e.println("New type", afact.Name)
 	}
 
 	return nil
 }
 
-func handleCompositeFact(fact Phrase) error {
+func (e *Engine) handleCompositeFact(fact Phrase) error {
 	cfact := CompositeFact{
 		Name:          fact.Name.(string),
 		IdentifiedBy:  fact.IdentifiedBy,
@@ -494,16 +797,17 @@ func handleCompositeFact(fact Phrase) error {
 		Obfuscates:    fact.Obfuscates,
 		ViolatedWhen:  fact.ViolatedWhen,
 		FactType:      fact.FactType,
+		Position:      fact.Position,
 	}
 
-	globalState["facts"][cfact.Name] = cfact
+	e.state["facts"][cfact.Name] = cfact
 
 	// Initialise instances and non-instances for the composite fact
-	globalInstances[cfact.Name] = orderedmap.New[uint64, Expression]()
-	globalNonInstances[cfact.Name] = orderedmap.New[uint64, Expression]()
+	e.instances[cfact.Name] = orderedmap.New[uint64, Expression]()
+	e.nonInstances[cfact.Name] = orderedmap.New[uint64, Expression]()
 
-	globalResults[len(globalResults)-1].Changes = []Phrase{fact}
-	Println("New type", cfact.Name)
+	e.results[len(e.results)-1].Changes = []Phrase{fact}
+	e.println("New type", cfact.Name)
 
 	return nil
 }
@@ -529,8 +833,8 @@ func checkRange(value interface{}, fact interface{}) bool {
 	return false
 }
 
-func factExists(identifier string) bool {
-	for factname := range globalState["facts"] {
+func (e *Engine) factExists(identifier string) bool {
+	for factname := range e.state["facts"] {
 		if factname == identifier {
 			return true
 		}
@@ -539,41 +843,26 @@ func factExists(identifier string) bool {
 	return false
 }
 
-func formatValue(v interface{}) string {
-	switch v.(type) {
-	case string:
-		return fmt.Sprintf("\"%s\"", v)
-	case bool:
-		return fmt.Sprintf("%t", v)
-	case int64:
-		return fmt.Sprintf("%d", v)
-	case []string:
-		return fmt.Sprintf("%s", v.([]string)[0])
-	default:
-		return fmt.Sprintf("%v", v)
-	}
-}
-
-func canCreate(operand Expression) error {
+func (e *Engine) canCreate(operand Expression) error {
 	// First check if the fact exists
-	if !factExists(operand.Identifier) {
-		return fmt.Errorf("fact %s does not exist", operand.Identifier)
+	if !e.factExists(operand.Identifier) {
+		return ErrUnknownFact.Errorf("fact %s does not exist", operand.Identifier)
 	}
 
 	// If it is an atomic fact, check if the value is of the correct type
 	// and in the range of the fact.
-	if _, ok := globalState["facts"][operand.Identifier].(AtomicFact); ok {
-		if !checkRange(operand.Operands[0].Value, globalState["facts"][operand.Identifier]) {
+	if _, ok := e.state["facts"][operand.Identifier].(AtomicFact); ok && len(operand.Operands) > 0 {
+		if !checkRange(operand.Operands[0].Value, e.state["facts"][operand.Identifier]) {
 			value := operand.Operands[0].Value
-			return fmt.Errorf("value %s is not in the range of fact %s", formatValue(value), operand.Identifier)
+			return ErrRangeViolation.Errorf("value %s is not in the range of fact %s", formatValue(value), operand.Identifier)
 		}
 	}
 
 	// If it is a composite fact, check if the values are of the correct type
 	// by checking if we can recursively create them.
-	if _, ok := globalState["facts"][operand.Identifier].(CompositeFact); ok {
+	if _, ok := e.state["facts"][operand.Identifier].(CompositeFact); ok {
 		for _, expr := range operand.Operands {
-			err := canCreate(expr)
+			err := e.canCreate(expr)
 			if err != nil {
 				return err
 			}
@@ -583,103 +872,127 @@ func canCreate(operand Expression) error {
 	return nil
 }
 
-func convertAtomic(operand Expression, target string) Expression {
+func (e *Engine) convertAtomic(operand Expression, target string) (Expression, error) {
 	if operand.Value != nil {
 		// Primitive value, check if we can convert it
 		if reflect.TypeOf(operand.Value) == intType && target == "Int" {
-			return operand
+			return operand, nil
 		} else if reflect.TypeOf(operand.Value) == stringType && target == "String" {
-			return operand
+			return operand, nil
 		} else {
 			// Try to convert the value
-			if !factExists(target) {
-				panic("Conversion target does not exist")
+			if !e.factExists(target) {
+				return operand, ErrTypeMismatch.Errorf("cannot convert %s to %s", formatValue(operand.Value), target)
 			}
-			if afact, ok := globalState["facts"][target].(AtomicFact); ok {
-				newOperand := convertAtomic(operand, afact.Type)
+			if afact, ok := e.state["facts"][target].(AtomicFact); ok {
+				newOperand, err := e.convertAtomic(operand, afact.Type)
+				if err != nil {
+					return operand, err
+				}
 				if newOperand.Value != nil {
 					return Expression{
 						Identifier: target,
 						Operands: []Expression{
 							newOperand,
 						},
-					}
+					}, nil
 				}
 			}
 
-			panic("Cannot convert primitive value to composite fact")
+			return operand, ErrTypeMismatch.Errorf("cannot convert %s to composite fact %s", formatValue(operand.Value), target)
 		}
 	} else if operand.Identifier != "" {
-		if !factExists(operand.Identifier) {
-			panic("Fact does not exist")
+		if !e.factExists(operand.Identifier) {
+			return operand, ErrUnknownFact.Errorf("fact %s does not exist", operand.Identifier)
 		}
 
-		if afact, ok := globalState["facts"][operand.Identifier].(AtomicFact); ok {
+		if afact, ok := e.state["facts"][operand.Identifier].(AtomicFact); ok {
 			if afact.Type == target {
-				return convertAtomic(operand.Operands[0], target)
+				if len(operand.Operands) != 1 {
+					return operand, ErrArityMismatch.Errorf("atomic fact %s expects 1 operand, got %d", operand.Identifier, len(operand.Operands))
+				}
+				return e.convertAtomic(operand.Operands[0], target)
 			} else if afact.Name == target {
-				return operand
+				return operand, nil
 			} else {
-				panic("Don't know how to convert " + afact.Type + " to " + target)
+				return operand, ErrTypeMismatch.Errorf("cannot convert %s to %s", FormatExpression(operand), target)
 			}
 		} else {
-			panic("Cannot convert composite fact to atomic fact")
+			return operand, ErrTypeMismatch.Errorf("cannot convert composite fact %s to atomic fact %s", operand.Identifier, target)
 		}
 	} else {
-		panic("Unknown error in convertAtomic")
+		return operand, ErrInvalidExpression.Errorf("cannot convert %s to %s", FormatExpression(operand), target)
 	}
 }
 
-func convertComposite(operands []Expression, targets []string) []Expression {
+func (e *Engine) convertComposite(operands []Expression, targets []string) ([]Expression, error) {
+	if len(operands) != len(targets) {
+		return operands, ErrArityMismatch.Errorf("expected %d operands, got %d", len(targets), len(operands))
+	}
+
 	for i := range operands {
-		// Find target[i] in the global state
-		target := getFactName(targets[i])
-		if !factExists(target) {
-			panic("Fact does not exist")
+		// Find target[i] in the state
+		target := e.getFactName(targets[i])
+		if !e.factExists(target) {
+			return operands, ErrUnknownFact.Errorf("fact %s does not exist", target)
 		}
-		if _, ok := globalState["facts"][target].(AtomicFact); ok {
-			operands[i] = convertAtomic(operands[i], target)
+
+		var err error
+		if _, ok := e.state["facts"][target].(AtomicFact); ok {
+			operands[i], err = e.convertAtomic(operands[i], target)
 		} else {
-			operands[i].Operands = convertComposite(operands[i].Operands, globalState["facts"][target].(CompositeFact).IdentifiedBy)
+			operands[i].Operands, err = e.convertComposite(operands[i].Operands, e.state["facts"][target].(CompositeFact).IdentifiedBy)
+		}
+
+		if err != nil {
+			return operands, err
 		}
 	}
 
-	return operands
+	return operands, nil
 }
 
-func convertInstance(operand Expression) (Expression, error) {
-	if !factExists(operand.Identifier) {
-		return operand, fmt.Errorf("fact %s does not exist", operand.Identifier)
+func (e *Engine) convertInstance(operand Expression) (Expression, error) {
+	if !e.factExists(operand.Identifier) {
+		return operand, ErrUnknownFact.Errorf("fact %s does not exist", operand.Identifier)
 	}
 
-	fact := globalState["facts"][operand.Identifier]
+	fact := e.state["facts"][operand.Identifier]
 	if afact, ok := fact.(AtomicFact); ok {
 		if len(operand.Operands) == 0 && afact.Type == "" {
 			return operand, nil
 		}
 
 		if len(operand.Operands) != 1 {
-			return operand, fmt.Errorf("atomic fact operands mismatch")
+			return operand, ErrArityMismatch.Errorf("atomic fact %s expects 1 operand, got %d", operand.Identifier, len(operand.Operands))
 		}
 
-		operand.Operands[0] = convertAtomic(operand.Operands[0], afact.Type)
+		converted, err := e.convertAtomic(operand.Operands[0], afact.Type)
+		if err != nil {
+			return operand, err
+		}
+		operand.Operands[0] = converted
 
 	} else if cfact, ok := fact.(CompositeFact); ok {
 		if len(operand.Operands) != len(cfact.IdentifiedBy) {
-			return operand, fmt.Errorf("composite fact operands mismatch")
+			return operand, ErrArityMismatch.Errorf("composite fact %s expects %d operands, got %d", operand.Identifier, len(cfact.IdentifiedBy), len(operand.Operands))
+		}
+		converted, err := e.convertComposite(operand.Operands, cfact.IdentifiedBy)
+		if err != nil {
+			return operand, err
 		}
-		operand.Operands = convertComposite(operand.Operands, cfact.IdentifiedBy)
+		operand.Operands = converted
 	}
 
-	return operand, canCreate(operand)
+	return operand, e.canCreate(operand)
 }
 
-func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
+func (e *Engine) equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 	if instance1.Value != nil && instance2.Value != nil {
 		return instance1.Value == instance2.Value
 	} else if instance1.Value != nil {
 		if instance2.Identifier != "" {
-			if _, ok := globalState["facts"][instance2.Identifier].(AtomicFact); ok {
+			if _, ok := e.state["facts"][instance2.Identifier].(AtomicFact); ok {
 				return instance2.Operands[0].Value == instance1.Value
 			} else {
 				return false
@@ -687,7 +1000,7 @@ func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 		}
 	} else if instance2.Value != nil {
 		if instance1.Identifier != "" {
-			if _, ok := globalState["facts"][instance1.Identifier].(AtomicFact); ok {
+			if _, ok := e.state["facts"][instance1.Identifier].(AtomicFact); ok {
 				return instance2.Value == instance1.Operands[0].Value
 			} else {
 				return false
@@ -699,13 +1012,13 @@ func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 		return false
 	}
 
-	if !factExists(instance1.Identifier) || !factExists(instance2.Identifier) {
+	if !e.factExists(instance1.Identifier) || !e.factExists(instance2.Identifier) {
 		log.Println("One of the facts does not exist")
 		return false
 	}
 
-	fact1 := globalState["facts"][instance1.Identifier]
-	fact2 := globalState["facts"][instance2.Identifier]
+	fact1 := e.state["facts"][instance1.Identifier]
+	fact2 := e.state["facts"][instance2.Identifier]
 
 	afact1, aok1 := fact1.(AtomicFact)
 	afact2, aok2 := fact2.(AtomicFact)
@@ -715,7 +1028,7 @@ func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 			return false
 		}
 
-		return equalInstanceContents(instance1.Operands[0], instance2.Operands[0])
+		return e.equalInstanceContents(instance1.Operands[0], instance2.Operands[0])
 	}
 
 	cfact1, cok1 := fact1.(CompositeFact)
@@ -727,7 +1040,7 @@ func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 				return false
 			}
 
-			if !equalInstanceContents(instance1.Operands[i], instance2.Operands[i]) {
+			if !e.equalInstanceContents(instance1.Operands[i], instance2.Operands[i]) {
 				return false
 			}
 		}
@@ -736,8 +1049,8 @@ func equalInstanceContents(instance1 Expression, instance2 Expression) bool {
 	return true
 }
 
-func create(op Expression, derived bool) error {
-	op, err := convertInstance(op)
+func (e *Engine) create(op Expression, derived bool) error {
+	op, err := e.convertInstance(op)
 	if err != nil {
 		return err
 	}
@@ -747,24 +1060,24 @@ func create(op Expression, derived bool) error {
 	hash, err := hashstructure.Hash(op, hashstructure.FormatV2, nil)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if _, present := globalNonInstances[op.Identifier].Get(hash); present {
+	if _, present := e.nonInstances[op.Identifier].Get(hash); present {
 		if derived {
 			return fmt.Errorf("cannot derive a non-instance")
 		}
 
-		globalNonInstances[op.Identifier].Delete(hash)
+		e.nonInstances[op.Identifier].Delete(hash)
 	}
 
 	// Check if the instance already exists
-	if instance, present := globalInstances[op.Identifier].Get(hash); present {
+	if instance, present := e.instances[op.Identifier].Get(hash); present {
 		if !derived {
 			// Set the derived field to this instance to false, as it is now postulated.
 			newExpr := instance
 			newExpr.IsDerived = false
-			globalInstances[op.Identifier].Set(hash, newExpr)
+			e.instances[op.Identifier].Set(hash, newExpr)
 
 			return nil
 		} else {
@@ -772,18 +1085,22 @@ func create(op Expression, derived bool) error {
 		}
 	}
 
-	globalInstances[op.Identifier].Set(hash, op)
+	e.instances[op.Identifier].Set(hash, op)
 
 	return nil
 }
 
 // handleCreate explicitly sets a given expression to true,
 // by moving it from the non-instances to the instances list.
-func handleCreate(operand Expression, derived bool) error {
-	for _, op := range gatherExpressions(operand) {
-		err := create(op, derived)
-		if err != nil {
-			// TODO: Handle error
+func (e *Engine) handleCreate(operand Expression, derived bool) error {
+	ops, err := e.gatherExpressions(operand)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if err := e.create(op, derived); err != nil {
+			return err
 		}
 	}
 
@@ -793,9 +1110,14 @@ func handleCreate(operand Expression, derived bool) error {
 // handleTerminate explicitly sets a given expression to false,
 // by moving it from the instances to the non-instances
 // list.
-func handleTerminate(operand Expression) error {
-	for _, op := range gatherExpressions(operand) {
-		op, err := convertInstance(op)
+func (e *Engine) handleTerminate(operand Expression) error {
+	ops, err := e.gatherExpressions(operand)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		op, err := e.convertInstance(op)
 		if err != nil {
 			return err
 		}
@@ -803,19 +1125,16 @@ func handleTerminate(operand Expression) error {
 		hash, err := hashstructure.Hash(op, hashstructure.FormatV2, nil)
 
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		// If there is an instance for this expression, remove it
-		if _, present := globalInstances[op.Identifier].Get(hash); present {
-			globalInstances[op.Identifier].Delete(hash)
-		}
-
-		if _, present := globalNonInstances[op.Identifier].Get(hash); present {
-			return fmt.Errorf("non-instance %s already exists", formatExpression(op))
+		if _, present := e.instances[op.Identifier].Get(hash); present {
+			e.instances[op.Identifier].Delete(hash)
 		}
 
-		globalNonInstances[op.Identifier].Set(hash, op)
+		// Terminating a non-instance again does not change anything
+		e.nonInstances[op.Identifier].Set(hash, op)
 	}
 
 	return nil
@@ -823,14 +1142,19 @@ func handleTerminate(operand Expression) error {
 
 // handleObfuscate implicitly sets a given expression to false,
 // by removing it from both the instances and non-instances list.
-func handleObfuscate(operand Expression) error {
-	for _, op := range gatherExpressions(operand) {
+func (e *Engine) handleObfuscate(operand Expression) error {
+	ops, err := e.gatherExpressions(operand)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
 		if op.Identifier == "" {
-			log.Println("Skipping non-identifier expression", formatExpression(op))
+			log.Println("Skipping non-identifier expression", FormatExpression(op))
 			continue
 		}
 
-		op, err := convertInstance(op)
+		op, err := e.convertInstance(op)
 		if err != nil {
 			return err
 		}
@@ -838,98 +1162,120 @@ func handleObfuscate(operand Expression) error {
 		hash, err := hashstructure.Hash(op, hashstructure.FormatV2, nil)
 
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		// If there is an instance for this expression, remove it
-		if _, present := globalInstances[op.Identifier].Get(hash); present {
-			globalInstances[op.Identifier].Delete(hash)
+		if _, present := e.instances[op.Identifier].Get(hash); present {
+			e.instances[op.Identifier].Delete(hash)
 		}
 
 		// If there is a non-instance for this expression, remove it
-		if _, present := globalNonInstances[op.Identifier].Get(hash); present {
-			globalNonInstances[op.Identifier].Delete(hash)
+		if _, present := e.nonInstances[op.Identifier].Get(hash); present {
+			e.nonInstances[op.Identifier].Delete(hash)
 		}
 	}
 
 	return nil
 }
 
-func handleBQuery(expression Expression) error {
-	instances := gatherExpressions(expression)
-
-	//if len(instances) != 1 {
-	//	panic("multiple instances in handleBQuery")
-	//}
-
-	instance := instances[0]
-	result, err := evaluateInstance(instance)
-
+func (e *Engine) handleBQuery(expression Expression) error {
+	instances, err := e.gatherExpressions(expression)
 	if err != nil {
-		// TODO: Based on the kind of error, handle it differently
-		panic(err)
+		return err
+	}
+
+	// An expression without any instances does not hold
+	result := false
+	if len(instances) > 0 {
+		result, err = e.evaluateInstance(instances[0])
+		if err != nil {
+			return err
+		}
 	}
 
-	globalResults[len(globalResults)-1].Result = result
+	e.results[len(e.results)-1].Result = result
 
 	if result {
-		Println("query successful")
+		e.println("query successful")
 	} else {
-		Println("query failed")
+		e.println("query failed")
 	}
 
 	return nil
 }
 
-func isFiniteFact(factName string) bool {
-	factName = getFactName(factName)
+func (e *Engine) isFiniteFact(factName string) (bool, error) {
+	factName = e.getFactName(factName)
 
-	if fact, ok := globalState["facts"][factName]; ok {
+	if fact, ok := e.state["facts"][factName]; ok {
 		if afact, ok := fact.(AtomicFact); ok {
-			return len(afact.Range) > 0 || afact.Type == ""
+			return len(afact.Range) > 0 || afact.Type == "", nil
 		} else if cfact, ok := fact.(CompositeFact); ok {
 			for _, param := range cfact.IdentifiedBy {
-				if !isFiniteFact(param) {
-					return false
+				finite, err := e.isFiniteFact(param)
+				if err != nil || !finite {
+					return false, err
 				}
 			}
-			return true
+			return true, nil
 		}
 	}
 
-	panic("fact does not exist or something went wrong")
-	return false
+	return false, ErrUnknownFact.Errorf("fact %s does not exist", factName)
 }
 
-func iterateFact(factName string) <-chan ConstructorApplication {
+// iterateFact sends the instances of a fact on the returned channel, until
+// they run out or done is closed. A nil done channel never stops the
+// iteration, so the channel must then be read until it is closed.
+func (e *Engine) iterateFact(factName string, done <-chan struct{}) (<-chan ConstructorApplication, error) {
 	c := make(chan ConstructorApplication)
+	send := func(instance ConstructorApplication) bool {
+		select {
+		case c <- instance:
+			return true
+		case <-done:
+			return false
+		}
+	}
 
-	factName = getFactName(factName)
+	factName = e.getFactName(factName)
 
 	result := ConstructorApplication{
 		Identifier: factName,
 		Operands:   nil,
 	}
 
-	if isFiniteFact(factName) {
+	finite, err := e.isFiniteFact(factName)
+	if err != nil {
+		return nil, err
+	}
+
+	if finite {
 		// Iterate over all possible instances for finite facts
 		go func() {
-			if fact, ok := globalState["facts"][factName].(AtomicFact); ok {
+			defer close(c)
+
+			if fact, ok := e.state["facts"][factName].(AtomicFact); ok {
 				if len(fact.Range) == 0 {
-					c <- result
+					send(result)
 				}
 
 				for _, instance := range fact.Range {
 					result.Operands = []Expression{
 						instance,
 					}
-					c <- result
+					if !send(result) {
+						return
+					}
 				}
-			} else if fact, ok := globalState["facts"][factName].(CompositeFact); ok {
+			} else if fact, ok := e.state["facts"][factName].(CompositeFact); ok {
 				var instances [][]interface{}
 				for _, param := range fact.IdentifiedBy {
 					pInstances := make([]interface{}, 0)
-					for instance := range iterateFact(param) {
+					// The parameters are known to exist, as the fact is finite
+					params, _ := e.iterateFact(param, nil)
+					for instance := range params {
 						pInstances = append(pInstances, instance)
 					}
 					instances = append(instances, pInstances)
@@ -944,26 +1290,30 @@ func iterateFact(factName string) <-chan ConstructorApplication {
 							Operands:   param.(ConstructorApplication).Operands,
 						})
 					}
-					c <- result
+					if !send(result) {
+						return
+					}
 				}
 			}
-			close(c)
 		}()
 	} else {
 		// Iterate over all known instances for infinite facts
 		//log.Println("Infinite fact")
 		go func() {
-			for pair := globalInstances[factName].Oldest(); pair != nil; pair = pair.Next() {
-				c <- ConstructorApplication{
+			defer close(c)
+
+			for pair := e.instances[factName].Oldest(); pair != nil; pair = pair.Next() {
+				if !send(ConstructorApplication{
 					Identifier: pair.Value.Identifier,
 					Operands:   pair.Value.Operands,
+				}) {
+					return
 				}
 			}
-			close(c)
 		}()
 	}
 
-	return c
+	return c, nil
 }
 
 func cartesianProduct(params ...[]interface{}) (result [][]interface{}) {
@@ -1001,97 +1351,38 @@ func cartesianProduct(params ...[]interface{}) (result [][]interface{}) {
 	return p
 }
 
-func formatExpression(expression Expression) string {
-	if expression.Value != nil {
-		return formatValue(expression.Value)
-	} else if expression.Identifier != "" {
-		result := expression.Identifier + "("
-		for i, operand := range expression.Operands {
-			if i > 0 {
-				result += ","
-			}
-			result += formatExpression(operand)
-		}
-		result += ")"
-		return result
-	} else if expression.Operator != "" {
-		expr1 := formatExpression(expression.Operands[0])
-		if expression.Operator == "NOT" {
-			return "!" + expr1
-		}
-		expr2 := formatExpression(expression.Operands[1])
-
-		switch expression.Operator {
-		case "AND":
-			return expr1 + " && " + expr2
-		case "OR":
-			return expr1 + " || " + expr2
-		case "ADD":
-			return expr1 + " + " + expr2
-		case "SUB":
-			return expr1 + " - " + expr2
-		case "MUL":
-			return expr1 + " * " + expr2
-		case "DIV":
-			return expr1 + " / " + expr2
-		case "MOD":
-			return expr1 + " % " + expr2
-		case "LT":
-			return expr1 + " < " + expr2
-		case "GT":
-			return expr1 + " > " + expr2
-		case "GTE":
-			return expr1 + " >= " + expr2
-		case "LTE":
-			return expr1 + " <= " + expr2
-		case "EQ":
-			return expr1 + " == " + expr2
-		case "NEQ":
-			return expr1 + " != " + expr2
-		case "WHEN":
-			return expr1 + " When " + expr2
-		}
-	} else if expression.Iterator != "" {
-		keyword := expression.Iterator[:1] + strings.ToLower(expression.Iterator[1:])
-		if expression.Iterator == "EXISTS" || expression.Iterator == "FOREACH" {
-			return keyword + expression.Binds[0] + " : " + formatExpression(expression.Operands[0])
-		}
-
-		return keyword + "(" + formatExpression(expression.Operands[0]) + ")"
-	} else if expression.Parameter != "" {
-		return formatExpression(*expression.Operand) + "." + expression.Parameter
-	}
-
-	return ""
-}
-
-func handleIQuery(expression Expression, filter bool) error {
+func (e *Engine) handleIQuery(expression Expression, filter bool) error {
 	if filter {
-		Println("?--" + formatExpression(expression))
+		e.println("?--" + FormatExpression(expression))
 	} else {
-		Println("?-" + formatExpression(expression))
+		e.println("?-" + FormatExpression(expression))
 	}
 
-	signal := make(chan struct{})
+	signal := make(chan struct{}, 1)
+	values := e.handleExpression(expression, signal)
+	defer stop(signal, values)
 
 	results := make([]Expression, 0)
-	errors := make([]Error, 0)
 
-	for instance := range handleExpression(expression, signal) {
+	for instance := range values {
+		if instance.err != nil {
+			return instance.err
+		}
+
 		if instance.Identifier == "" {
-			panic("invalid instance in iquery result")
+			return ErrInvalidExpression.Errorf("%s does not evaluate to instances", FormatExpression(expression))
 		}
 
 		if filter {
-			eval, err := evaluateInstance(instance)
+			eval, err := e.evaluateInstance(instance)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			if eval {
-				Println(formatExpression(instance))
+				e.println(FormatExpression(instance))
 			}
 		} else {
-			Println(formatExpression(instance))
+			e.println(FormatExpression(instance))
 		}
 
 		results = append(results, instance)
@@ -1099,12 +1390,7 @@ func handleIQuery(expression Expression, filter bool) error {
 		signal <- struct{}{}
 	}
 
-	if len(errors) > 0 {
-		globalResults[len(globalResults)-1].Success = false
-		globalResults[len(globalResults)-1].Errors = errors
-	} else {
-		globalResults[len(globalResults)-1].Results = results
-	}
+	e.results[len(e.results)-1].Results = results
 
 	return nil
 }
@@ -1157,6 +1443,8 @@ func copyExpression(expression Expression) Expression {
 		Iterator:   expression.Iterator,
 		IsDerived:  expression.IsDerived,
 		Parameter:  expression.Parameter,
+		Position:   expression.Position,
+		err:        expression.err,
 	}
 
 	if expression.Expression != nil {
@@ -1180,14 +1468,145 @@ func copyExpression(expression Expression) Expression {
 	return result
 }
 
-func evaluateInstance(instance Expression) (bool, error) {
+// enabled returns whether an instance is enabled: it holds, and the
+// conditions of its fact hold for it. This is what Enabled(t) evaluates to,
+// and what decides whether a triggered act is disabled.
+func (e *Engine) enabled(instance Expression) (bool, error) {
+	holds, err := e.evaluateInstance(instance)
+	if err != nil || !holds {
+		return false, err
+	}
+
+	var conditions []Expression
+	switch fact := e.state["facts"][instance.Identifier].(type) {
+	case AtomicFact:
+		conditions = fact.ConditionedBy
+	case CompositeFact:
+		conditions = fact.ConditionedBy
+	default:
+		return false, ErrInvalidExpression.Errorf("Enabled(t) requires t to be an instance, not %s", FormatExpression(instance))
+	}
+
+	for _, condition := range conditions {
+		holds, err := e.clauseHolds(instance, condition)
+		if err != nil || !holds {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// violated returns whether an instance of a duty holds and one of its
+// violation conditions holds for it.
+func (e *Engine) violated(instance Expression) (bool, error) {
+	cfact, ok := e.state["facts"][instance.Identifier].(CompositeFact)
+	if !ok || len(cfact.ViolatedWhen) == 0 {
+		return false, nil
+	}
+
+	if holds, err := e.evaluateInstance(instance); err != nil || !holds {
+		return false, err
+	}
+
+	for _, clause := range cfact.ViolatedWhen {
+		if violated, err := e.clauseHolds(instance, clause); err != nil || violated {
+			return violated, err
+		}
+	}
+
+	return false, nil
+}
+
+// known returns whether an instance is present in the knowledge base, having
+// been created or derived, and whether it is absent from it, having been
+// terminated. An instance that is neither only holds if a Holds when clause
+// holds for it.
+func (e *Engine) known(instance Expression) (present bool, absent bool, err error) {
+	instance, err = e.convertInstance(instance)
+	if err != nil {
+		return false, false, err
+	}
+
+	hash, err := hashstructure.Hash(instance, hashstructure.FormatV2, nil)
+	if err != nil {
+		return false, false, err
+	}
+
+	if instances, ok := e.instances[instance.Identifier]; ok {
+		_, present = instances.Get(hash)
+	}
+	if nonInstances, ok := e.nonInstances[instance.Identifier]; ok {
+		_, absent = nonInstances.Get(hash)
+	}
+
+	return present, absent, nil
+}
+
+// negate evaluates the negation of an expression. During a custom derivation,
+// an instance that is not known to not exist is assumed not to exist, and this
+// assumption is recorded so that it can be withdrawn if the instance is
+// derived later on.
+func (e *Engine) negate(expression Expression) (bool, error) {
+	expr, _ := e.first(expression)
+
+	eval, err := e.evaluateInstance(expr)
+	if err != nil {
+		return false, err
+	}
+
+	// Only negated instances can be assumed not to exist
+	if e.customDerivation && expr.Identifier != "" {
+		hash, err := hashstructure.Hash(expr, hashstructure.FormatV2, nil)
+		if err != nil {
+			return false, err
+		}
+
+		if _, present := e.nonInstances[expr.Identifier].Get(hash); !present {
+			e.tempAssumptions = append(e.tempAssumptions, &Assumptions{
+				Expression:  hash,
+				Knowledge:   e.copyKnowledge(),
+				Assumptions: e.copyAssumptions(),
+				Queue:       e.copyQueue(),
+			})
+		}
+	}
+
+	return !eval, nil
+}
+
+// clauseHolds fills in a clause of the fact of an instance with the instance,
+// and evaluates it. A clause without any value refers to instances that do
+// not hold.
+func (e *Engine) clauseHolds(instance Expression, clause Expression) (bool, error) {
+	params, values := []string{instance.Identifier}, []Expression{instance}
+	if cfact, ok := e.state["facts"][instance.Identifier].(CompositeFact); ok {
+		params, values = cfact.IdentifiedBy, instance.Operands
+	}
+
+	filled, err := e.fillParameters(clause, params, values)
+	if err != nil {
+		return false, err
+	}
+
+	expr, ok := e.first(filled)
+	if !ok {
+		return false, nil
+	}
+
+	return e.evaluateInstance(expr)
+}
+
+func (e *Engine) evaluateInstance(instance Expression) (bool, error) {
+	if instance.err != nil {
+		return false, instance.err
+	}
+
 	if instance.Value != nil {
 		switch instance.Value.(type) {
 		case []string:
-			signal := make(chan struct{})
-			defer close(signal)
-
-			return handleExpression(instance, signal) != nil, nil
+			// A reference to a fact always holds
+			return true, nil
 		case bool:
 			return instance.Value.(bool), nil
 		case string:
@@ -1195,38 +1614,36 @@ func evaluateInstance(instance Expression) (bool, error) {
 		case int64:
 			return instance.Value.(int64) > 0, nil
 		default:
-			panic("invalid type")
-			//return false, fmt.Errorf("invalid type %T", instance.Value)
+			return false, ErrInvalidExpression.Errorf("cannot evaluate a value of type %T", instance.Value)
 		}
 	} else if instance.Identifier != "" {
-		//log.Println("Evaluating", formatExpression(instance))
+		//log.Println("Evaluating", FormatExpression(instance))
 		if findVariable(instance) != "" {
-			panic("instance contains variables")
+			return false, ErrInvalidExpression.Errorf("cannot evaluate %s, as it contains variables", FormatExpression(instance))
 		}
 
-		instance, err := convertInstance(instance)
+		instance, err := e.convertInstance(instance)
 		if err != nil {
 			// TODO: TEMPORARY
 			return false, nil
-			panic(err)
 		}
 
 		// Search for the fact
-		if !factExists(instance.Identifier) {
+		if !e.factExists(instance.Identifier) {
 			return false, ErrUnknownType
 		}
 
 		// Check if the instance is already known
 		hash, err := hashstructure.Hash(instance, hashstructure.FormatV2, nil)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
-		if _, present := globalInstances[instance.Identifier].Get(hash); present {
+		if _, present := e.instances[instance.Identifier].Get(hash); present {
 			return true, nil
 		}
 
 		// Check if the instance is known to not exist
-		if _, present := globalNonInstances[instance.Identifier].Get(hash); present {
+		if _, present := e.nonInstances[instance.Identifier].Get(hash); present {
 			return false, nil
 		}
 	} else {
@@ -1236,26 +1653,74 @@ func evaluateInstance(instance Expression) (bool, error) {
 	return false, nil
 }
 
-func gatherExpressions(expression Expression) []Expression {
+func (e *Engine) gatherExpressions(expression Expression) ([]Expression, error) {
 	result := make([]Expression, 0)
 	signal := make(chan struct{}, 1)
-	defer close(signal)
+	values := e.handleExpression(expression, signal)
+	defer stop(signal, values)
+
+	for instance := range values {
+		if instance.err != nil {
+			return nil, instance.err
+		}
 
-	for instance := range handleExpression(expression, signal) {
 		result = append(result, instance)
 
 		signal <- struct{}{}
 	}
 
-	return result
+	return result, nil
+}
+
+// next waits until the consumer of a producer asks for its next value, and
+// returns false if the consumer closed the signal because it does not need any
+// more values.
+func next(signal <-chan struct{}) bool {
+	_, ok := <-signal
+	return ok
+}
+
+// stop closes the signal of a producer whose remaining values are not needed
+// and waits until it has finished, so that no evaluation keeps reading the
+// knowledge base after its consumer has moved on.
+func stop(signal chan struct{}, values <-chan Expression) {
+	close(signal)
+	for range values {
+	}
+}
+
+// first evaluates an expression to its first value and stops the evaluation of
+// the others. The second result is false if the expression has no values.
+func (e *Engine) first(expression Expression) (Expression, bool) {
+	signal := make(chan struct{}, 1)
+	values := e.handleExpression(expression, signal)
+	value, ok := <-values
+	stop(signal, values)
+
+	return value, ok
+}
+
+// failed returns an expression that carries the given error through the
+// evaluator instead of a value.
+func failed(err error) Expression {
+	return Expression{err: err}
+}
+
+// failedChannel returns a channel that only yields the given error. Producers
+// stop after sending an error, so consumers must not signal for more results.
+func failedChannel(err error) <-chan Expression {
+	c := make(chan Expression, 1)
+	c <- failed(err)
+	close(c)
+	return c
 }
 
 // TODO: This can return any expression
-func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expression {
+func (e *Engine) handleExpression(expression Expression, signal <-chan struct{}) <-chan Expression {
 	c := make(chan Expression)
 
-	if err := TypeCheckExpression(&expression); err != nil {
-		panic(err)
+	if err := e.TypeCheckExpression(&expression); err != nil {
+		return failedChannel(err)
 	}
 
 	// Check if there are any variables in the expression
@@ -1264,11 +1729,18 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 		// Find all occurrences of the variable
 		occurrences := findOccurrences(&expression, ref)
 
+		done := make(chan struct{})
+		instances, err := e.iterateFact(ref, done)
+		if err != nil {
+			return failedChannel(err)
+		}
+
 		go func() {
-			// Iterate over all instances of the variable
-			signal2 := make(chan struct{}, 1)
+			defer close(done)
 
-			for instance := range iterateFact(ref) {
+			// Iterate over all instances of the variable
+		instances:
+			for instance := range instances {
 				// Replace all occurrences of the variable with the instance
 				for _, occurrence := range occurrences {
 					*occurrence = Expression{
@@ -1277,12 +1749,19 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 					}
 				}
 
-				for result := range handleExpression(copyExpression(expression), signal2) {
+				signal2 := make(chan struct{}, 1)
+				results := e.handleExpression(copyExpression(expression), signal2)
+				for result := range results {
 					c <- copyExpression(result)
 
-					<-signal
+					if result.err != nil || !next(signal) {
+						stop(signal2, results)
+						break instances
+					}
+
 					signal2 <- struct{}{}
 				}
+				close(signal2)
 			}
 
 			// Put the original expression back
@@ -1292,13 +1771,7 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 				}
 			}
 
-			close(signal2)
 			close(c)
-			select {
-			case _, _ = <-signal:
-			default:
-				break
-			}
 		}()
 
 		return c
@@ -1310,14 +1783,24 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 			return c
 		}
 
+		done := make(chan struct{})
+		instances, err := e.iterateFact(ref[0], done)
+		if err != nil {
+			return failedChannel(err)
+		}
+
 		go func() {
-			for instance := range iterateFact(ref[0]) {
+			defer close(done)
+
+			for instance := range instances {
 				c <- Expression{
 					Identifier: instance.Identifier,
 					Operands:   instance.Operands,
 				}
 
-				<-signal
+				if !next(signal) {
+					break
+				}
 			}
 			close(c)
 		}()
@@ -1345,15 +1828,19 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 	} else if expression.Operator != "" {
 		go func() {
 			signal2 := make(chan struct{}, 1)
+			values := e.handleOperator(expression, signal2)
 
-			for operand := range handleOperator(expression, signal2) {
+			for operand := range values {
 				c <- operand
 
-				<-signal
+				if operand.err != nil || !next(signal) {
+					break
+				}
+
 				signal2 <- struct{}{}
 			}
 
-			close(signal2)
+			stop(signal2, values)
 			close(c)
 		}()
 	} else if expression.Identifier != "" {
@@ -1363,99 +1850,130 @@ func handleExpression(expression Expression, signal <-chan struct{}) <-chan Expr
 		//	panic("No operands for expression")
 		//}
 
-		signal2 := make(chan struct{}, 1)
-
 		for i := range expression.Operands {
 			// TODO: CHeck if this is correct (It is not!)
-			expression.Operands[i], ok = <-handleExpression(expression.Operands[i], signal2)
+			expression.Operands[i], ok = e.first(expression.Operands[i])
 			if !ok {
-				close(signal2)
 				close(c)
 				return c
 			}
+
+			if expression.Operands[i].err != nil {
+				return failedChannel(expression.Operands[i].err)
+			}
 		}
 
 		go func() {
 			// TODO: This is needed as we cannot always evaluate instances to true/false (citizen(Bob))
 			c <- expression
 
-			//log.Println("Sent expression")
-
-			close(signal2)
 			close(c)
-
-			//log.Println("Closed channel")
-			_, _ = <-signal
-			//log.Println("Received optional signal")
 		}()
 	} else if expression.Iterator != "" {
 		go func() {
 			signal2 := make(chan struct{}, 1)
+			values := e.handleIterator(expression, signal2)
 
-			for expr := range handleIterator(expression, signal2) {
+			for expr := range values {
 				c <- expr
 
-				<-signal
+				if expr.err != nil || !next(signal) {
+					break
+				}
+
 				signal2 <- struct{}{}
 			}
 
-			close(signal2)
+			stop(signal2, values)
 			close(c)
 		}()
 	} else if expression.Parameter != "" {
 		go func() {
 			signal2 := make(chan struct{}, 1)
+			values := e.handleProjection(expression, signal2)
 
-			for expr := range handleProjection(expression, signal2) {
+			for expr := range values {
 				c <- expr
 
-				<-signal
+				if expr.err != nil || !next(signal) {
+					break
+				}
+
 				signal2 <- struct{}{}
 			}
 
-			close(signal2)
+			stop(signal2, values)
 			close(c)
 		}()
 	} else {
-		log.Println("Unknown expression type", expression, ":(")
-		panic("Unknown expression type")
-		close(c)
+		return failedChannel(ErrInvalidExpression.Errorf("unknown expression type"))
 	}
 
 	return c
 }
 
-func handleArithmeticOperator(operator string, operand1 int64, operand2 int64) interface{} {
+func handleArithmeticOperator(operator string, operand1 int64, operand2 int64) (interface{}, error) {
 	switch operator {
 	case "ADD":
-		return operand1 + operand2
+		return operand1 + operand2, nil
 	case "SUB":
-		return operand1 - operand2
+		return operand1 - operand2, nil
 	case "MUL":
-		return operand1 * operand2
+		return operand1 * operand2, nil
 	case "DIV":
-		return operand1 / operand2
+		if operand2 == 0 {
+			return nil, ErrDivisionByZero.Errorf("cannot divide %d by zero", operand1)
+		}
+		return operand1 / operand2, nil
 	case "MOD":
-		return operand1 % operand2
+		if operand2 == 0 {
+			return nil, ErrDivisionByZero.Errorf("cannot take %d modulo zero", operand1)
+		}
+		return operand1 % operand2, nil
+	case "GT":
+		return operand1 > operand2, nil
+	case "LT":
+		return operand1 < operand2, nil
+	case "GTE":
+		return operand1 >= operand2, nil
+	case "LTE":
+		return operand1 <= operand2, nil
+	default:
+		return nil, ErrUnknownOperator.Errorf("unknown operator %s", operator)
+	}
+}
+
+func handleStringOperator(operator string, operand1 string, operand2 string) interface{} {
+	switch operator {
+	case "ADD":
+		return operand1 + operand2
 	case "GT":
 		return operand1 > operand2
 	case "LT":
 		return operand1 < operand2
 	case "GTE":
 		return operand1 >= operand2
-	case "LTE":
-		return operand1 <= operand2
 	default:
-		panic("Unknown operator")
+		return operand1 <= operand2
+	}
+}
+
+// instanceToString returns the string of an instance of a String fact, or
+// the expression itself otherwise.
+func (e *Engine) instanceToString(expression Expression) Expression {
+	if afact, ok := e.state["facts"][expression.Identifier].(AtomicFact); ok && afact.Type == "String" && len(expression.Operands) == 1 {
+		return expression.Operands[0]
 	}
+
+	return expression
 }
 
-func instanceToInt(expression Expression) Expression {
-	if !factExists(expression.Identifier) || len(expression.Operands) == 0 {
+func (e *Engine) instanceToInt(expression Expression) Expression {
+	if !e.factExists(expression.Identifier) || len(expression.Operands) == 0 {
 		return expression
 	}
 
-	fact := globalState["facts"][expression.Identifier]
+	fact := e.state["facts"][expression.Identifier]
 
 	if afact, ok := fact.(AtomicFact); ok {
 		if afact.Type == "Int" {
@@ -1466,50 +1984,75 @@ func instanceToInt(expression Expression) Expression {
 	return expression
 }
 
-func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expression {
+func (e *Engine) handleOperator(expression Expression, signal <-chan struct{}) <-chan Expression {
 	c := make(chan Expression)
 
 	if expression.Operator == "ADD" || expression.Operator == "SUB" || expression.Operator == "MUL" || expression.Operator == "DIV" || expression.Operator == "MOD" ||
 		expression.Operator == "LT" || expression.Operator == "GT" || expression.Operator == "LTE" || expression.Operator == "GTE" {
-		go func() {
-			// TODO: Check if exactly two operands
+		if len(expression.Operands) != 2 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator %s expects 2 operands, got %d", expression.Operator, len(expression.Operands)))
+		}
 
-			signal1 := make(chan struct{}, 1)
-			defer close(signal1)
+		go func() {
+			defer close(c)
 
-			expression1 := <-handleExpression(expression.Operands[0], signal1)
-			expression2 := <-handleExpression(expression.Operands[1], signal1)
+			expression1, _ := e.first(expression.Operands[0])
+			if expression1.err != nil {
+				c <- expression1
+				return
+			}
 
-			expression1 = instanceToInt(expression1)
-			expression2 = instanceToInt(expression2)
+			expression2, _ := e.first(expression.Operands[1])
+			if expression2.err != nil {
+				c <- expression2
+				return
+			}
 
-			if expression1.Value == nil || expression2.Value == nil {
-				panic("nil value")
+			// Strings are concatenated and compared as well
+			string1, ok1 := e.instanceToString(expression1).Value.(string)
+			string2, ok2 := e.instanceToString(expression2).Value.(string)
+			if ok1 && ok2 && expression.Operator != "SUB" && expression.Operator != "MUL" && expression.Operator != "DIV" && expression.Operator != "MOD" {
+				c <- Expression{
+					Value: handleStringOperator(expression.Operator, string1, string2),
+				}
+				return
 			}
 
-			if reflect.TypeOf(expression1.Value) != intType {
-				panic("Cannot convert to expression1 to int")
+			expression1 = e.instanceToInt(expression1)
+			expression2 = e.instanceToInt(expression2)
+
+			if reflect.TypeOf(expression1.Value) != intType || reflect.TypeOf(expression2.Value) != intType {
+				c <- failed(ErrNonIntegerArithmetic.Errorf("operator %s expects integers, got %s and %s", expression.Operator, FormatExpression(expression1), FormatExpression(expression2)))
+				return
 			}
 
-			if reflect.TypeOf(expression2.Value) != intType {
-				panic("Cannot convert to expression2 to int")
+			value, err := handleArithmeticOperator(expression.Operator, expression1.Value.(int64), expression2.Value.(int64))
+			if err != nil {
+				c <- failed(err)
+				return
 			}
 
 			c <- Expression{
-				Value: handleArithmeticOperator(expression.Operator, expression1.Value.(int64), expression2.Value.(int64)),
+				Value: value,
 			}
-
-			close(c)
 		}()
 	} else if expression.Operator == "EQ" || expression.Operator == "NEQ" {
-		signal1 := make(chan struct{})
-		defer close(signal1)
+		if len(expression.Operands) != 2 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator %s expects 2 operands, got %d", expression.Operator, len(expression.Operands)))
+		}
 
-		expr1 := <-handleExpression(expression.Operands[0], signal1)
-		expr2 := <-handleExpression(expression.Operands[1], signal1)
+		expr1, _ := e.first(expression.Operands[0])
+		if expr1.err != nil {
+			return failedChannel(expr1.err)
+		}
+
+		expr2, _ := e.first(expression.Operands[1])
+		if expr2.err != nil {
+			return failedChannel(expr2.err)
+		}
 
 		go func() {
-			value := equalInstanceContents(expr1, expr2)
+			value := e.equalInstanceContents(expr1, expr2)
 			if expression.Operator == "NEQ" {
 				value = !value
 			}
@@ -1522,18 +2065,19 @@ func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expres
 		}()
 	} else if expression.Operator == "AND" {
 		go func() {
-			signal1 := make(chan struct{})
-			defer close(signal1)
+			defer close(c)
 
 			result := true
 			for _, operand := range expression.Operands {
-				expr := <-handleExpression(operand, signal1)
-				if eval, err := evaluateInstance(expr); err == nil {
-					result = result && eval
-				} else {
-					panic(err)
+				expr, _ := e.first(operand)
+				eval, err := e.evaluateInstance(expr)
+				if err != nil {
+					c <- failed(err)
+					return
 				}
 
+				result = result && eval
+
 				if !result {
 					break
 				}
@@ -1545,18 +2089,19 @@ func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expres
 		}()
 	} else if expression.Operator == "OR" {
 		go func() {
-			signal1 := make(chan struct{})
-			defer close(signal1)
+			defer close(c)
 
 			result := false
 			for _, operand := range expression.Operands {
-				expr := <-handleExpression(operand, signal1)
-				if eval, err := evaluateInstance(expr); err == nil {
-					result = result || eval
-				} else {
-					panic(err)
+				expr, _ := e.first(operand)
+				eval, err := e.evaluateInstance(expr)
+				if err != nil {
+					c <- failed(err)
+					return
 				}
 
+				result = result || eval
+
 				if result {
 					break
 				}
@@ -1567,56 +2112,43 @@ func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expres
 			}
 		}()
 	} else if expression.Operator == "NOT" {
-		signal1 := make(chan struct{})
-		defer close(signal1)
+		if len(expression.Operands) != 1 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator NOT expects 1 operand, got %d", len(expression.Operands)))
+		}
 
-		expr := <-handleExpression(expression.Operands[0], signal1)
+		// The negation is evaluated before it is sent, as the assumptions it
+		// makes are read by the derivation as soon as it has the value
+		value, err := e.negate(expression.Operands[0])
+		if err != nil {
+			return failedChannel(err)
+		}
 
 		go func() {
-			if eval, err := evaluateInstance(expr); err == nil {
-				if customDerivation {
-					hash1, err := hashstructure.Hash(expr, hashstructure.FormatV2, nil)
-					if err != nil {
-						panic(err)
-					}
-
-					hash2, err := hashstructure.Hash(expr, hashstructure.FormatV2, nil)
-					if err != nil {
-						panic(err)
-					}
-
-					if hash1 == hash2 {
-						//log.Println("Negating literal", formatExpression(expr))
-						if _, present := globalNonInstances[expr.Identifier].Get(hash2); !present {
-							//log.Println("Assuming negated literal", formatExpression(expr), "is false")
-							// We assume that the instance does not exist
-							//log.Println("Assuming that", formatExpression(expr), "does not exist")
-							tempAssumptions = append(tempAssumptions, &Assumptions{
-								Expression:  hash2,
-								Knowledge:   copyKnowledge(),
-								Assumptions: copyAssumptions(),
-								Queue:       copyQueue(),
-							})
-						}
-					}
-				}
-
-				c <- Expression{
-					Value: !eval,
-				}
-			} else {
-				panic(err)
+			c <- Expression{
+				Value: value,
 			}
-
 			close(c)
 		}()
 	} else if expression.Operator == "COUNT" {
-		signal1 := make(chan struct{}, 1)
+		if len(expression.Operands) != 1 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator COUNT expects 1 operand, got %d", len(expression.Operands)))
+		}
 
 		go func() {
+			defer close(c)
+
+			signal1 := make(chan struct{}, 1)
+			values := e.handleExpression(expression.Operands[0], signal1)
+
 			length := int64(0)
 
-			for range handleExpression(expression.Operands[0], signal1) {
+			for expr := range values {
+				if expr.err != nil {
+					stop(signal1, values)
+					c <- expr
+					return
+				}
+
 				length++
 
 				signal1 <- struct{}{}
@@ -1625,45 +2157,70 @@ func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expres
 			c <- Expression{
 				Value: length,
 			}
-
-			close(c)
-			close(signal1)
 		}()
 	} else if expression.Operator == "WHEN" {
-		signal1 := make(chan struct{})
+		if len(expression.Operands) != 2 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator WHEN expects 2 operands, got %d", len(expression.Operands)))
+		}
 
-		expr := <-handleExpression(expression.Operands[1], signal1)
+		expr, _ := e.first(expression.Operands[1])
 
-		//log.Println("WHEN", formatExpression(expression.Operands[0]), expr)
+		//log.Println("WHEN", FormatExpression(expression.Operands[0]), expr)
+
+		eval, err := e.evaluateInstance(expr)
+		if err != nil {
+			return failedChannel(err)
+		}
 
-		if eval, err := evaluateInstance(expr); err == nil && eval {
+		if eval {
 			go func() {
-				for expr := range handleExpression(expression.Operands[0], signal1) {
+				signal1 := make(chan struct{}, 1)
+				values := e.handleExpression(expression.Operands[0], signal1)
+
+				for expr := range values {
 					c <- expr
 
-					<-signal
+					if expr.err != nil || !next(signal) {
+						break
+					}
+
 					signal1 <- struct{}{}
 				}
 
-				close(signal1)
+				stop(signal1, values)
 				close(c)
 			}()
 		} else {
 			//log.Println("When is false")
 			close(c)
-			close(signal1)
 		}
 	} else if expression.Operator == "MAX" || expression.Operator == "MIN" || expression.Operator == "SUM" {
-		signal1 := make(chan struct{})
+		if len(expression.Operands) != 1 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator %s expects 1 operand, got %d", expression.Operator, len(expression.Operands)))
+		}
+
 		go func() {
+			defer close(c)
+
+			signal1 := make(chan struct{}, 1)
+			values := e.handleExpression(expression.Operands[0], signal1)
+
 			value := int64(0)
 			first := true
 
-			for expr := range handleExpression(expression.Operands[0], signal1) {
-				numb := instanceToInt(expr)
+			for expr := range values {
+				if expr.err != nil {
+					stop(signal1, values)
+					c <- expr
+					return
+				}
 
-				if numb.Value == nil || reflect.TypeOf(numb.Value) != intType {
-					panic("Cannot convert to int")
+				numb := e.instanceToInt(expr)
+
+				if reflect.TypeOf(numb.Value) != intType {
+					stop(signal1, values)
+					c <- failed(ErrNonIntegerArithmetic.Errorf("operator %s expects integers, got %s", expression.Operator, FormatExpression(expr)))
+					return
 				}
 
 				if expression.Operator == "MAX" && numb.Value.(int64) > value {
@@ -1681,175 +2238,210 @@ func handleOperator(expression Expression, signal <-chan struct{}) <-chan Expres
 			c <- Expression{
 				Value: value,
 			}
-
-			close(c)
-			close(signal1)
 		}()
-	} else if expression.Operator == "HOLDS" {
-		signal1 := make(chan struct{})
-		defer close(signal1)
-		expr1 := <-handleExpression(expression.Operands[0], signal1)
+	} else if expression.Operator == "HOLDS" || expression.Operator == "ENABLED" || expression.Operator == "VIOLATED" ||
+		expression.Operator == "PRESENT" || expression.Operator == "ABSENT" {
+		if len(expression.Operands) != 1 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator %s expects 1 operand, got %d", expression.Operator, len(expression.Operands)))
+		}
+
+		expr1, _ := e.first(expression.Operands[0])
 
 		go func() {
+			defer close(c)
+
+			if expr1.err != nil {
+				c <- expr1
+				return
+			}
+
 			if expr1.Identifier == "" {
-				panic("Holds(t) requires t to evaluate to a an instance, not a literal")
+				c <- failed(ErrInvalidExpression.Errorf("%s(t) requires t to evaluate to an instance, not %s", functionOperators[expression.Operator], FormatExpression(expr1)))
+				return
+			}
+
+			var eval bool
+			var err error
+			switch expression.Operator {
+			case "HOLDS":
+				eval, err = e.evaluateInstance(expr1)
+			case "ENABLED":
+				eval, err = e.enabled(expr1)
+			case "VIOLATED":
+				eval, err = e.violated(expr1)
+			case "PRESENT":
+				eval, _, err = e.known(expr1)
+			case "ABSENT":
+				_, eval, err = e.known(expr1)
 			}
-			eval, err := evaluateInstance(expr1)
 			if err != nil {
-				panic(err)
+				c <- failed(err)
+				return
 			}
 
 			c <- Expression{
 				Value: eval,
 			}
-
-			close(c)
 		}()
-	} else if expression.Operator == "ENABLED" {
-		expr := expression.Operands[0]
-		conditions := make([]Expression, 0)
-		fact := globalState["facts"][expression.Operands[0].Identifier]
-		if afact, ok := fact.(AtomicFact); ok {
-			for _, condition := range afact.ConditionedBy {
-				conditions = append(conditions, fillParameters(condition, []string{afact.Name}, []Expression{expr}))
+	} else if expression.Operator == "NEG" || expression.Operator == "ABS" {
+		if len(expression.Operands) != 1 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator %s expects 1 operand, got %d", expression.Operator, len(expression.Operands)))
+		}
+
+		go func() {
+			defer close(c)
+
+			expr, _ := e.first(expression.Operands[0])
+			if expr.err != nil {
+				c <- expr
+				return
 			}
-		} else if cfact, ok := fact.(CompositeFact); ok {
-			for _, condition := range cfact.ConditionedBy {
-				conditions = append(conditions, fillParameters(condition, cfact.IdentifiedBy, expr.Operands))
+
+			value, ok := e.instanceToInt(expr).Value.(int64)
+			if !ok {
+				c <- failed(ErrNonIntegerArithmetic.Errorf("operator %s expects an integer, got %s", expression.Operator, FormatExpression(expr)))
+				return
+			}
+
+			if expression.Operator == "NEG" || value < 0 {
+				value = -value
 			}
-		} else {
-			panic("Unknown fact type")
-		}
 
-		signal1 := make(chan struct{})
-		defer close(signal1)
-		expr = <-handleExpression(Expression{
-			Operator: "AND",
-			Operands: append([]Expression{
-				{
-					Operator: "HOLDS",
-					Operands: []Expression{expression.Operands[0]},
-				},
-			}, conditions...),
-		}, signal1)
+			c <- Expression{
+				Value: value,
+			}
+		}()
+	} else if expression.Operator == "IF" {
+		if len(expression.Operands) != 3 {
+			return failedChannel(ErrInvalidExpression.Errorf("operator IF expects 3 operands, got %d", len(expression.Operands)))
+		}
 
 		go func() {
-			eval, err := evaluateInstance(expr)
+			condition, _ := e.first(expression.Operands[0])
+			eval, err := e.evaluateInstance(condition)
 			if err != nil {
-				panic(err)
+				c <- failed(err)
+				close(c)
+				return
 			}
 
-			c <- Expression{
-				Value: eval,
+			branch := expression.Operands[2]
+			if eval {
+				branch = expression.Operands[1]
+			}
+
+			// The values of the branch are passed on, like those of a Foreach
+			signal2 := make(chan struct{}, 1)
+			values := e.handleExpression(branch, signal2)
+
+			for expr := range values {
+				c <- copyExpression(expr)
+
+				if expr.err != nil || !next(signal) {
+					break
+				}
+
+				signal2 <- struct{}{}
 			}
 
+			stop(signal2, values)
 			close(c)
 		}()
 	} else {
-		log.Println("Unknown operator", expression)
-		panic("Unknown operator")
+		return failedChannel(ErrUnknownOperator.Errorf("unknown operator %s", expression.Operator))
 	}
 
 	return c
 }
 
-func handleIterator(expression Expression, signal <-chan struct{}) <-chan Expression {
+func (e *Engine) handleIterator(expression Expression, signal <-chan struct{}) <-chan Expression {
 	c := make(chan Expression)
 
 	if expression.Iterator == "FOREACH" {
 		go func() {
-			signal1 := make(chan struct{})
-			defer close(signal1)
+			signal1 := make(chan struct{}, 1)
+			values := e.handleExpression(*expression.Expression, signal1)
 
-			for expr := range handleExpression(*expression.Expression, signal1) {
+			for expr := range values {
 				c <- copyExpression(expr)
 
-				<-signal
+				if expr.err != nil || !next(signal) {
+					break
+				}
+
 				signal1 <- struct{}{}
 			}
 
+			stop(signal1, values)
 			close(c)
 		}()
-	} else if expression.Iterator == "EXISTS" {
+	} else if expression.Iterator == "EXISTS" || expression.Iterator == "FORALL" {
+		// Exists stops at the first value that holds, Forall at the first
+		// value that does not
+		quantifier := expression.Iterator == "EXISTS"
+
 		go func() {
-			signal1 := make(chan struct{})
-			defer close(signal1)
-
-			for expr := range handleExpression(*expression.Expression, signal1) {
-				if eval, err := evaluateInstance(expr); err == nil {
-					if eval {
-						c <- Expression{
-							Value: true,
-						}
-						close(c)
-						return
-					}
-				} else {
-					panic(err)
-				}
+			defer close(c)
 
-				signal1 <- struct{}{}
-			}
+			signal1 := make(chan struct{}, 1)
+			values := e.handleExpression(*expression.Expression, signal1)
 
-			c <- Expression{
-				Value: false,
+			result := Expression{
+				Value: !quantifier,
 			}
+			for expr := range values {
+				eval, err := e.evaluateInstance(expr)
+				if err != nil {
+					result = failed(err)
+					break
+				}
 
-			close(c)
-		}()
-	} else if expression.Iterator == "FORALL" {
-		go func() {
-			signal1 := make(chan struct{})
-			defer close(signal1)
-
-			for expr := range handleExpression(*expression.Expression, signal1) {
-				if eval, err := evaluateInstance(expr); err == nil {
-					if !eval {
-						c <- Expression{
-							Value: false,
-						}
-						close(c)
-						return
-					}
-				} else {
-					panic(err)
+				if eval == quantifier {
+					result.Value = quantifier
+					break
 				}
 
 				signal1 <- struct{}{}
 			}
 
-			c <- Expression{
-				Value: true,
-			}
-
-			close(c)
+			stop(signal1, values)
+			c <- result
 		}()
 	} else {
-		log.Println("Unknown iterator", expression)
-		panic("Unknown iterator")
+		return failedChannel(ErrUnknownOperator.Errorf("unknown iterator %s", expression.Iterator))
 	}
 
 	return c
 }
 
-func handleProjection(expression Expression, signal <-chan struct{}) <-chan Expression {
+func (e *Engine) handleProjection(expression Expression, signal <-chan struct{}) <-chan Expression {
 	//log.Println("Projection", expression.Parameter, expression.Operand)
 	c := make(chan Expression)
 
 	go func() {
-		signal1 := make(chan struct{})
-		defer close(signal1)
+		defer close(c)
+
+		signal1 := make(chan struct{}, 1)
+		values := e.handleExpression(*expression.Operand, signal1)
+		defer stop(signal1, values)
+
+		for expr := range values {
+			if expr.err != nil {
+				c <- expr
+				return
+			}
 
-		for expr := range handleExpression(*expression.Operand, signal1) {
 			if expr.Identifier == "" {
-				panic("Cannot project non-identifier")
+				c <- failed(ErrInvalidExpression.Errorf("cannot project %s, as it is not an instance", FormatExpression(expr)))
+				return
 			}
 
-			if !factExists(expr.Identifier) {
-				panic("Cannot project non-existing fact")
+			if !e.factExists(expr.Identifier) {
+				c <- failed(ErrUnknownFact.Errorf("fact %s does not exist", expr.Identifier))
+				return
 			}
 
-			fact := globalState["facts"][expr.Identifier]
+			fact := e.state["facts"][expr.Identifier]
 
 			if cfact, ok := fact.(CompositeFact); ok {
 				found := false
@@ -1858,7 +2450,9 @@ func handleProjection(expression Expression, signal <-chan struct{}) <-chan Expr
 					if param == expression.Parameter {
 						c <- expr.Operands[i]
 
-						<-signal
+						if !next(signal) {
+							return
+						}
 						signal1 <- struct{}{}
 
 						found = true
@@ -1867,11 +2461,12 @@ func handleProjection(expression Expression, signal <-chan struct{}) <-chan Expr
 				}
 
 				if !found {
-					close(c)
-					panic("Expression has no parameter " + expression.Parameter)
+					c <- failed(ErrInvalidExpression.Errorf("%s has no parameter %s", expr.Identifier, expression.Parameter))
+					return
 				}
 			} else {
-				panic("Cannot project atomic fact")
+				c <- failed(ErrInvalidExpression.Errorf("cannot project atomic fact %s", expr.Identifier))
+				return
 			}
 		}
 	}()
@@ -26,16 +26,16 @@ func (i *Input) UnmarshalJSON(data []byte) error {
 	case "ping":
 		phrasesExpected = false
 	default:
-		return fmt.Errorf("unknown kind: %s", aux.Kind)
+		return ErrUnknownKind.Errorf("unknown kind: %s", aux.Kind)
 	}
 
 	if phrasesExpected {
 		if _, ok := tempMap["phrases"]; !ok {
-			return fmt.Errorf("missing field: phrases")
+			return ErrParse.Errorf("missing field: phrases")
 		}
 	} else {
 		if _, ok := tempMap["phrases"]; ok {
-			return fmt.Errorf("unexpected field: phrases")
+			return ErrUnsupportedFields.Errorf("unexpected field: phrases")
 		}
 	}
 
@@ -43,6 +43,7 @@ func (i *Input) UnmarshalJSON(data []byte) error {
 	i.Kind = aux.Kind
 	i.Updates = aux.Updates
 	i.Phrases = aux.Phrases
+	i.Session = aux.Session
 
 	return nil
 }
@@ -175,6 +176,7 @@ func (p *Phrase) UnmarshalJSON(data []byte) error {
 	p.Kind = aux.Kind
 	p.Stateless = aux.Stateless
 	p.Updates = aux.Updates
+	p.Position = aux.Position
 
 	return nil
 }
@@ -203,6 +205,7 @@ func (e *Expression) UnmarshalJSON(data []byte) error {
 		//log.Println("ConstructorApplication", ConstructorApplication)
 		e.Identifier = ConstructorApplication.Identifier
 		e.Operands = ConstructorApplication.Operands
+		e.Position = ConstructorApplication.Position
 		return nil
 	}
 
@@ -213,6 +216,7 @@ func (e *Expression) UnmarshalJSON(data []byte) error {
 		//log.Println("Operator", Operator)
 		e.Operator = Operator.Operator
 		e.Operands = Operator.Operands
+		e.Position = Operator.Position
 		return nil
 	}
 
@@ -224,6 +228,7 @@ func (e *Expression) UnmarshalJSON(data []byte) error {
 		e.Iterator = Iterator.Iterator
 		e.Binds = Iterator.Binds
 		e.Expression = &Iterator.Expression
+		e.Position = Iterator.Position
 		return nil
 	}
 
@@ -234,6 +239,7 @@ func (e *Expression) UnmarshalJSON(data []byte) error {
 		//log.Println("Projection", Projection.Operand)
 		e.Parameter = Projection.Parameter
 		e.Operand = Projection.Operand
+		e.Position = Projection.Position
 		return nil
 	}
 
@@ -272,9 +278,9 @@ func GenerateHandshake() ([]byte, error) {
 		SupportedVersions: SupportedVersions,
 		Reasoner:          Reasoner,
 		ReasonerVersion:   ReasonerVersion,
-		SharesUpdates:     true,
-		SharesTriggers:    true,
-		SharesViolations:  false,
+		SharesUpdates:     SharesUpdates,
+		SharesTriggers:    SharesTriggers,
+		SharesViolations:  SharesViolations,
 	})
 }
 
@@ -291,6 +297,118 @@ func (e Expression) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// MarshalLocated encodes the input like json.MarshalIndent, but also encodes
+// the positions of the expressions in its phrases. The positions of
+// expressions are left out of the other JSON output of the server, as they
+// would show up in the instances of facts.
+func MarshalLocated(input Input, indent string) ([]byte, error) {
+	phrases := make([]locatedPhrase, len(input.Phrases))
+	for i, phrase := range input.Phrases {
+		phrases[i] = locatePhrase(phrase)
+	}
+
+	type Alias Input
+	return json.MarshalIndent(&struct {
+		*Alias
+		Phrases []locatedPhrase `json:"phrases"`
+	}{
+		Alias:   (*Alias)(&input),
+		Phrases: phrases,
+	}, "", indent)
+}
+
+// locatedPhrase replaces the expressions of a phrase by located expressions.
+type locatedPhrase struct {
+	*phraseAlias
+	Expression    *locatedExpression  `json:"expression,omitempty"`
+	Operand       *locatedExpression  `json:"operand,omitempty"`
+	Range         []locatedExpression `json:"range,omitempty"`
+	DerivedFrom   []locatedExpression `json:"derived-from,omitempty"`
+	HoldsWhen     []locatedExpression `json:"holds-when,omitempty"`
+	ConditionedBy []locatedExpression `json:"conditioned-by,omitempty"`
+	SyncsWith     []locatedExpression `json:"syncs-with,omitempty"`
+	Creates       []locatedExpression `json:"creates,omitempty"`
+	Terminates    []locatedExpression `json:"terminates,omitempty"`
+	Obfuscates    []locatedExpression `json:"obfuscates,omitempty"`
+	ViolatedWhen  []locatedExpression `json:"violated-when,omitempty"`
+}
+
+type phraseAlias Phrase
+
+func locatePhrase(phrase Phrase) locatedPhrase {
+	return locatedPhrase{
+		phraseAlias:   (*phraseAlias)(&phrase),
+		Expression:    locateExpression(phrase.Expression),
+		Operand:       locateExpression(phrase.Operand),
+		Range:         locateExpressions(phrase.Range),
+		DerivedFrom:   locateExpressions(phrase.DerivedFrom),
+		HoldsWhen:     locateExpressions(phrase.HoldsWhen),
+		ConditionedBy: locateExpressions(phrase.ConditionedBy),
+		SyncsWith:     locateExpressions(phrase.SyncsWith),
+		Creates:       locateExpressions(phrase.Creates),
+		Terminates:    locateExpressions(phrase.Terminates),
+		Obfuscates:    locateExpressions(phrase.Obfuscates),
+		ViolatedWhen:  locateExpressions(phrase.ViolatedWhen),
+	}
+}
+
+// locatedExpression is an expression that is encoded with its position.
+// Primitives and variable references are encoded as plain values, so they
+// have no room for a position.
+type locatedExpression struct {
+	Value      interface{}         `json:"value,omitempty"`
+	Operator   string              `json:"operator,omitempty"`
+	Identifier string              `json:"identifier,omitempty"`
+	Operands   []locatedExpression `json:"operands,omitempty"`
+	Iterator   string              `json:"iterator,omitempty"`
+	Binds      []string            `json:"binds,omitempty"`
+	Expression *locatedExpression  `json:"expression,omitempty"`
+	Operand    *locatedExpression  `json:"operand,omitempty"`
+	Parameter  string              `json:"parameter,omitempty"`
+	Position   *Position           `json:"position,omitempty"`
+}
+
+func locateExpression(expression *Expression) *locatedExpression {
+	if expression == nil {
+		return nil
+	}
+
+	return &locatedExpression{
+		Value:      expression.Value,
+		Operator:   expression.Operator,
+		Identifier: expression.Identifier,
+		Operands:   locateExpressions(expression.Operands),
+		Iterator:   expression.Iterator,
+		Binds:      expression.Binds,
+		Expression: locateExpression(expression.Expression),
+		Operand:    locateExpression(expression.Operand),
+		Parameter:  expression.Parameter,
+		Position:   expression.Position,
+	}
+}
+
+func locateExpressions(expressions []Expression) []locatedExpression {
+	if expressions == nil {
+		return nil
+	}
+
+	result := make([]locatedExpression, len(expressions))
+	for i := range expressions {
+		result[i] = *locateExpression(&expressions[i])
+	}
+
+	return result
+}
+
+func (e locatedExpression) MarshalJSON() ([]byte, error) {
+	if e.Value != nil {
+		return json.Marshal(e.Value)
+	}
+
+	type Alias locatedExpression
+	return json.Marshal((*Alias)(&e))
+}
+
 func (p PhraseResult) MarshalJSON() ([]byte, error) {
 
 	if p.IsBquery {
@@ -309,6 +427,7 @@ func (p PhraseResult) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(&StateChanges{
 		Success:    p.Success,
+		Errors:     p.Errors,
 		Changes:    p.Changes,
 		Triggers:   p.Triggers,
 		Violated:   p.Violated,
@@ -319,11 +438,9 @@ func (p PhraseResult) MarshalJSON() ([]byte, error) {
 // GenerateJSON generates JSON from the given struct
 // If it fails, it returns an error
 func GenerateJSON(output Output) ([]byte, error) {
-	if len(globalErrors) > 0 {
+	if len(output.Errors) > 0 {
 		output.Success = false
-		output.Errors = globalErrors
-	} else {
-		output.Results = globalResults
+		output.Results = nil
 	}
 
 	result, err := json.Marshal(output)
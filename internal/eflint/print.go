@@ -0,0 +1,316 @@
+package eflint
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// infixOperators are the operators that are written between their operands,
+// with the precedences with which they are parsed: an operator takes the
+// expression before it as its left operand if its left precedence is at least
+// the minimum precedence at that point, and its right operand is parsed with
+// its right precedence as the minimum.
+var infixOperators = map[string]struct {
+	symbol      string
+	left, right int
+}{
+	"OR":  {"||", 1, 1},
+	"AND": {"&&", 1, 1},
+	"EQ":  {"==", 2, 2},
+	"NEQ": {"!=", 2, 2},
+	"ADD": {"+", 3, 3},
+	"SUB": {"-", 3, 3},
+	"MUL": {"*", 5, 4},
+	"DIV": {"/", 7, 6},
+	"MOD": {"%", 9, 8},
+	"LT":  {"<", 10, 10},
+	"GT":  {">", 10, 10},
+	"LTE": {"<=", 10, 10},
+	"GTE": {">=", 10, 10},
+}
+
+// functionOperators are the operators that are written like an application.
+var functionOperators = map[string]string{
+	"COUNT":    "Count",
+	"SUM":      "Sum",
+	"MAX":      "Max",
+	"MIN":      "Min",
+	"HOLDS":    "Holds",
+	"ENABLED":  "Enabled",
+	"VIOLATED": "Violated",
+	"PRESENT":  "Present",
+	"ABSENT":   "Absent",
+	"ABS":      "Abs",
+}
+
+// The precedences of the context of an expression. An expression that is
+// complete on its own, such as an operand of a constructor, has no minimum
+// precedence and is not followed by an operator.
+const (
+	complete = -1
+	atom     = 100
+	// projected is the precedence of the dot of a projection, or of When.
+	projected = 0
+)
+
+// identifier matches the names that can be written without escaping them.
+var identifier = regexp.MustCompile(`^[a-z][a-zA-Z0-9_-]*'*$`)
+
+// formatName formats the name of a fact, escaping it as [name] if it cannot
+// be written as an identifier.
+func formatName(name string) string {
+	if identifier.MatchString(name) {
+		return name
+	}
+
+	return "[" + name + "]"
+}
+
+func formatNames(names []string, separator string) string {
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, formatName(name))
+	}
+
+	return strings.Join(formatted, separator)
+}
+
+func formatValue(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return strconv.Quote(v.(string))
+	case bool:
+		if v.(bool) {
+			return "True"
+		}
+		return "False"
+	case int64:
+		return fmt.Sprintf("%d", v)
+	case []string:
+		return formatName(v.([]string)[0])
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// FormatExpression formats an expression in the eFLINT syntax, such as
+// greeted(person("Bob")) for an instance. Parentheses are only added where
+// the expression would be parsed differently without them.
+func FormatExpression(expression Expression) string {
+	return formatExpression(expression, complete, complete)
+}
+
+// formatExpression formats an expression that is parsed with the minimum
+// precedence min, and that is followed by an operator with the left
+// precedence next.
+func formatExpression(expression Expression, min int, next int) string {
+	parenthesize := func(needed bool, formatted func() string) string {
+		if needed {
+			return "(" + formatExpression(expression, complete, complete) + ")"
+		}
+		return formatted()
+	}
+
+	switch {
+	case expression.Value != nil:
+		return formatValue(expression.Value)
+	case expression.Identifier != "":
+		operands := make([]string, 0, len(expression.Operands))
+		for _, operand := range expression.Operands {
+			operands = append(operands, FormatExpression(operand))
+		}
+		return formatName(expression.Identifier) + "(" + strings.Join(operands, ",") + ")"
+	case expression.Operator == "NOT" && len(expression.Operands) == 1:
+		return "!" + formatExpression(expression.Operands[0], atom, next)
+	case expression.Operator == "NEG" && len(expression.Operands) == 1:
+		return "-" + formatExpression(expression.Operands[0], atom, next)
+	case functionOperators[expression.Operator] != "" && len(expression.Operands) == 1:
+		return functionOperators[expression.Operator] + "(" + FormatExpression(expression.Operands[0]) + ")"
+	case expression.Operator == "WHEN" && len(expression.Operands) == 2:
+		// When is only parsed after a complete expression
+		return parenthesize(min != complete || next != complete, func() string {
+			return formatExpression(expression.Operands[0], 0, projected) + " When " + FormatExpression(expression.Operands[1])
+		})
+	case infixOperators[expression.Operator].symbol != "" && len(expression.Operands) == 2:
+		operator := infixOperators[expression.Operator]
+		if min < 0 {
+			min = 0
+		}
+
+		// The operator must take the left operand, and the next operator
+		// must not take the right operand
+		return parenthesize(operator.left < min || next >= operator.right, func() string {
+			return formatExpression(expression.Operands[0], min, operator.left) + " " + operator.symbol + " " +
+				formatExpression(expression.Operands[1], operator.right, next)
+		})
+	case expression.Iterator != "" && expression.Expression != nil:
+		// The body of an iterator extends as far as possible
+		return parenthesize(next != complete, func() string {
+			keyword := expression.Iterator[:1] + strings.ToLower(expression.Iterator[1:])
+			return keyword + " " + formatNames(expression.Binds, ", ") + " : " + FormatExpression(*expression.Expression)
+		})
+	case expression.Operator == "IF" && len(expression.Operands) == 3:
+		// Like the body of an iterator, the else branch extends as far as possible
+		return parenthesize(next != complete, func() string {
+			return "If " + FormatExpression(expression.Operands[0]) + " Then " + FormatExpression(expression.Operands[1]) +
+				" Else " + FormatExpression(expression.Operands[2])
+		})
+	case expression.Parameter != "" && expression.Operand != nil:
+		return parenthesize(min != complete || next != complete, func() string {
+			return formatExpression(*expression.Operand, atom, projected) + "." + formatName(expression.Parameter)
+		})
+	}
+
+	return ""
+}
+
+// FormatPhrase formats a phrase in the eFLINT syntax, ending with a dot. The
+// clauses of declarations are put on lines of their own.
+func FormatPhrase(phrase Phrase) (string, error) {
+	name := formatName(fmt.Sprint(phrase.Name))
+	related := ""
+	if len(phrase.RelatedTo) > 0 {
+		related = " Related to " + formatNames(phrase.RelatedTo, ", ")
+	}
+
+	var result string
+	switch phrase.Kind {
+	case "afact":
+		result = "Fact " + name + " Identified by " + formatRange(phrase)
+		result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by")
+	case "cfact":
+		result = "Fact " + name + " Identified by " + formatNames(phrase.IdentifiedBy, " * ")
+		result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by")
+	case "placeholder":
+		names, ok := phrase.Name.([]string)
+		if !ok || len(names) == 0 {
+			return "", ErrInvalidPhrase.Errorf("the name of a placeholder must be a list of strings")
+		}
+		result = "Placeholder " + formatName(names[0]) + " For " + formatName(phrase.For)
+	case "predicate":
+		if phrase.Expression == nil {
+			return "", ErrInvalidPhrase.Errorf("predicate %s has no expression", name)
+		}
+		keyword := "Predicate"
+		if phrase.IsInvariant {
+			keyword = "Invariant"
+		}
+		result = keyword + " " + name + " When " + FormatExpression(*phrase.Expression)
+	case "event":
+		result = "Event " + name + related
+		result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by", "syncs-with", "creates", "terminates", "obfuscates")
+	case "act":
+		result = "Act " + name + " Actor " + formatName(phrase.Actor) + related
+		result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by", "syncs-with", "creates", "terminates", "obfuscates")
+	case "duty":
+		result = "Duty " + name + " Holder " + formatName(phrase.Holder) + " Claimant " + formatName(phrase.Claimant) + related
+		result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by", "violated-when")
+	case "extend":
+		parentKind := strings.ToLower(phrase.ParentKind)
+		keyword := map[string]string{"fact": "Fact", "duty": "Duty", "event": "Event", "act": "Act"}[parentKind]
+		switch parentKind {
+		case "fact", "duty":
+			result = "Extend " + keyword + " " + name
+			result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by")
+		case "event", "act":
+			result = "Extend " + keyword + " " + name
+			result += formatClauses(phrase, "derived-from", "holds-when", "conditioned-by", "syncs-with", "creates", "terminates", "obfuscates")
+		default:
+			return "", ErrUnknownKind.Errorf("unknown kind of fact to extend: %s", phrase.ParentKind)
+		}
+	case "bquery", "iquery":
+		if phrase.Expression == nil {
+			return "", ErrInvalidPhrase.Errorf("query has no expression")
+		}
+		prefix := map[string]string{"bquery": "?", "iquery": "?-"}[phrase.Kind]
+		if phrase.Kind == "iquery" && phrase.WhenTrue {
+			prefix = "?--"
+		}
+		expression := FormatExpression(*phrase.Expression)
+		if strings.HasPrefix(expression, "-") {
+			// The minus would be read as part of the prefix
+			expression = "(" + expression + ")"
+		}
+		result = prefix + expression
+	case "create", "terminate", "obfuscate", "trigger":
+		if phrase.Operand == nil {
+			return "", ErrInvalidPhrase.Errorf("%s has no operand", phrase.Kind)
+		}
+		prefix := map[string]string{"create": "+", "terminate": "-", "obfuscate": "~"}[phrase.Kind]
+		result = prefix + FormatExpression(*phrase.Operand)
+	default:
+		return "", ErrUnknownKind.Errorf("unknown kind: %s", phrase.Kind)
+	}
+
+	return result + ".", nil
+}
+
+// formatRange formats the type of an atomic fact, or its range of values.
+// Consecutive integers are formatted as a range like 1..5.
+func formatRange(phrase Phrase) string {
+	if len(phrase.Range) == 0 {
+		if phrase.Type == "" {
+			return "String"
+		}
+		return phrase.Type
+	}
+
+	consecutive := len(phrase.Range) > 1
+	for i, value := range phrase.Range {
+		if number, ok := value.Value.(int64); !ok || number != phrase.Range[0].Value.(int64)+int64(i) {
+			consecutive = false
+			break
+		}
+	}
+	if consecutive {
+		return FormatExpression(phrase.Range[0]) + ".." + FormatExpression(phrase.Range[len(phrase.Range)-1])
+	}
+
+	values := make([]string, 0, len(phrase.Range))
+	for _, value := range phrase.Range {
+		values = append(values, FormatExpression(value))
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// formatClauses formats the clauses of a declaration, in the given order.
+func formatClauses(phrase Phrase, clauses ...string) string {
+	keywords := map[string]string{
+		"derived-from":   "Derived from",
+		"holds-when":     "Holds when",
+		"conditioned-by": "Conditioned by",
+		"syncs-with":     "Syncs with",
+		"creates":        "Creates",
+		"terminates":     "Terminates",
+		"obfuscates":     "Obfuscates",
+		"violated-when":  "Violated when",
+	}
+	expressions := map[string][]Expression{
+		"derived-from":   phrase.DerivedFrom,
+		"holds-when":     phrase.HoldsWhen,
+		"conditioned-by": phrase.ConditionedBy,
+		"syncs-with":     phrase.SyncsWith,
+		"creates":        phrase.Creates,
+		"terminates":     phrase.Terminates,
+		"obfuscates":     phrase.Obfuscates,
+		"violated-when":  phrase.ViolatedWhen,
+	}
+
+	result := ""
+	for _, clause := range clauses {
+		if len(expressions[clause]) == 0 {
+			continue
+		}
+
+		formatted := make([]string, 0, len(expressions[clause]))
+		for _, expression := range expressions[clause] {
+			formatted = append(formatted, FormatExpression(expression))
+		}
+		result += "\n  " + keywords[clause] + " " + strings.Join(formatted, ", ")
+	}
+
+	return result
+}
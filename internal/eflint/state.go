@@ -0,0 +1,193 @@
+package eflint
+
+import (
+	"encoding/json"
+	"github.com/mitchellh/hashstructure/v2"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"sort"
+)
+
+// storedFact holds all the fields of an atomic or composite fact. Some of them
+// are not part of the JSON of the facts themselves, as they are not shown to
+// clients.
+type storedFact struct {
+	Kind          string       `json:"kind"`
+	Name          string       `json:"name"`
+	Type          string       `json:"type,omitempty"`
+	Range         []Expression `json:"range,omitempty"`
+	IdentifiedBy  []string     `json:"identified-by,omitempty"`
+	DerivedFrom   []Expression `json:"derived-from,omitempty"`
+	HoldsWhen     []Expression `json:"holds-when,omitempty"`
+	ConditionedBy []Expression `json:"conditioned-by,omitempty"`
+	IsInvariant   bool         `json:"is-invariant,omitempty"`
+	SyncsWith     []Expression `json:"syncs-with,omitempty"`
+	Creates       []Expression `json:"creates,omitempty"`
+	Terminates    []Expression `json:"terminates,omitempty"`
+	Obfuscates    []Expression `json:"obfuscates,omitempty"`
+	ViolatedWhen  []Expression `json:"violated-when,omitempty"`
+	FactType      int          `json:"fact-type,omitempty"`
+	Position      *Position    `json:"position,omitempty"`
+}
+
+type storedInstance struct {
+	Instance Expression `json:"instance"`
+	Derived  bool       `json:"derived,omitempty"`
+}
+
+type storedState struct {
+	Facts        []storedFact                `json:"facts"`
+	Placeholders map[string]string           `json:"placeholders"`
+	Instances    map[string][]storedInstance `json:"instances"`
+	NonInstances map[string][]storedInstance `json:"non-instances"`
+}
+
+// MarshalJSON encodes the complete state, so that it can be stored and
+// restored later on with UnmarshalJSON.
+func (s State) MarshalJSON() ([]byte, error) {
+	stored := storedState{
+		Facts:        make([]storedFact, 0, len(s.Facts)),
+		Placeholders: make(map[string]string, len(s.Placeholders)),
+		Instances:    storeInstances(s.Instances),
+		NonInstances: storeInstances(s.NonInstances),
+	}
+
+	for _, fact := range s.Facts {
+		switch f := fact.(type) {
+		case AtomicFact:
+			stored.Facts = append(stored.Facts, storedFact{
+				Kind:          "afact",
+				Name:          f.Name,
+				Type:          f.Type,
+				Range:         f.Range,
+				DerivedFrom:   f.DerivedFrom,
+				HoldsWhen:     f.HoldsWhen,
+				ConditionedBy: f.ConditionedBy,
+				IsInvariant:   f.IsInvariant,
+				Position:      f.Position,
+			})
+		case CompositeFact:
+			stored.Facts = append(stored.Facts, storedFact{
+				Kind:          "cfact",
+				Name:          f.Name,
+				IdentifiedBy:  f.IdentifiedBy,
+				DerivedFrom:   f.DerivedFrom,
+				HoldsWhen:     f.HoldsWhen,
+				ConditionedBy: f.ConditionedBy,
+				SyncsWith:     f.SyncsWith,
+				Creates:       f.Creates,
+				Terminates:    f.Terminates,
+				Obfuscates:    f.Obfuscates,
+				ViolatedWhen:  f.ViolatedWhen,
+				FactType:      f.FactType,
+				Position:      f.Position,
+			})
+		default:
+			return nil, ErrInternal.Errorf("cannot store fact of type %T", fact)
+		}
+	}
+
+	// Facts are sorted, so the same state is always stored in the same way
+	sort.Slice(stored.Facts, func(i, j int) bool {
+		return stored.Facts[i].Name < stored.Facts[j].Name
+	})
+
+	for name, placeholder := range s.Placeholders {
+		stored.Placeholders[name] = placeholder.(string)
+	}
+
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON decodes a state that was encoded with MarshalJSON.
+func (s *State) UnmarshalJSON(data []byte) error {
+	var stored storedState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	s.Facts = make(map[string]interface{}, len(stored.Facts))
+	for _, f := range stored.Facts {
+		switch f.Kind {
+		case "afact":
+			s.Facts[f.Name] = AtomicFact{
+				Name:          f.Name,
+				Type:          f.Type,
+				Range:         f.Range,
+				DerivedFrom:   f.DerivedFrom,
+				HoldsWhen:     f.HoldsWhen,
+				ConditionedBy: f.ConditionedBy,
+				IsInvariant:   f.IsInvariant,
+				Position:      f.Position,
+			}
+		case "cfact":
+			s.Facts[f.Name] = CompositeFact{
+				Name:          f.Name,
+				IdentifiedBy:  f.IdentifiedBy,
+				DerivedFrom:   f.DerivedFrom,
+				HoldsWhen:     f.HoldsWhen,
+				ConditionedBy: f.ConditionedBy,
+				SyncsWith:     f.SyncsWith,
+				Creates:       f.Creates,
+				Terminates:    f.Terminates,
+				Obfuscates:    f.Obfuscates,
+				ViolatedWhen:  f.ViolatedWhen,
+				FactType:      f.FactType,
+				Position:      f.Position,
+			}
+		default:
+			return ErrUnknownKind.Errorf("unknown kind of stored fact: %s", f.Kind)
+		}
+	}
+
+	s.Placeholders = make(map[string]interface{}, len(stored.Placeholders))
+	for name, placeholder := range stored.Placeholders {
+		s.Placeholders[name] = placeholder
+	}
+
+	var err error
+	if s.Instances, err = restoreInstances(stored.Instances); err != nil {
+		return err
+	}
+	if s.NonInstances, err = restoreInstances(stored.NonInstances); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func storeInstances(instances map[string]*orderedmap.OrderedMap[uint64, Expression]) map[string][]storedInstance {
+	result := make(map[string][]storedInstance, len(instances))
+
+	for factName, factInstances := range instances {
+		result[factName] = make([]storedInstance, 0, factInstances.Len())
+		for pair := factInstances.Oldest(); pair != nil; pair = pair.Next() {
+			result[factName] = append(result[factName], storedInstance{
+				Instance: pair.Value,
+				Derived:  pair.Value.IsDerived,
+			})
+		}
+	}
+
+	return result
+}
+
+func restoreInstances(stored map[string][]storedInstance) (map[string]*orderedmap.OrderedMap[uint64, Expression], error) {
+	result := make(map[string]*orderedmap.OrderedMap[uint64, Expression], len(stored))
+
+	for factName, factInstances := range stored {
+		result[factName] = orderedmap.New[uint64, Expression]()
+		for _, instance := range factInstances {
+			instance.Instance.IsDerived = instance.Derived
+
+			// The keys are not stored, as they follow from the instances
+			hash, err := hashstructure.Hash(instance.Instance, hashstructure.FormatV2, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			result[factName].Set(hash, instance.Instance)
+		}
+	}
+
+	return result, nil
+}
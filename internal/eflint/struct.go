@@ -5,6 +5,7 @@ type Input struct {
 	Kind    string   `json:"kind"`
 	Phrases []Phrase `json:"phrases"`
 	Updates bool     `json:"updates"`
+	Session string   `json:"session,omitempty"`
 }
 
 // A phrase is one of 3 types:
@@ -47,7 +48,8 @@ type Phrase struct {
 	ParentKind    string       `json:"parent-kind,omitempty"`
 
 	// Extra information
-	FactType int `json:"-"`
+	FactType int       `json:"-"`
+	Position *Position `json:"position,omitempty"`
 }
 
 type Query struct {
@@ -67,6 +69,7 @@ type AtomicFact struct {
 	HoldsWhen     []Expression `json:"holds-when,omitempty"`
 	ConditionedBy []Expression `json:"conditioned-by,omitempty"`
 	IsInvariant   bool         `json:"-"`
+	Position      *Position    `json:"-"`
 }
 
 type CompositeFact struct {
@@ -83,7 +86,8 @@ type CompositeFact struct {
 	Obfuscates   []Expression `json:"-"`
 	ViolatedWhen []Expression `json:"-"`
 
-	FactType int `json:"-"`
+	FactType int       `json:"-"`
+	Position *Position `json:"-"`
 }
 
 type Placeholder struct {
@@ -160,6 +164,11 @@ type Expression struct {
 	Operand    *Expression  `json:"operand,omitempty"`
 	Parameter  string       `json:"parameter,omitempty"`
 	IsDerived  bool         `json:"-" hash:"-"`
+	Position   *Position    `json:"-" hash:"-"`
+
+	// err is set instead of a value when the evaluation of an expression
+	// failed, so errors can be passed through the channels of the evaluator.
+	err error
 }
 
 type Primitive struct {
@@ -177,6 +186,7 @@ type VariableReference struct {
 type ConstructorApplication struct {
 	Identifier string       `json:"identifier"`
 	Operands   []Expression `json:"operands"`
+	Position   *Position    `json:"position,omitempty"`
 }
 
 // - Operators
@@ -184,6 +194,7 @@ type ConstructorApplication struct {
 type Operator struct {
 	Operator string       `json:"operator"`
 	Operands []Expression `json:"operands"`
+	Position *Position    `json:"position,omitempty"`
 }
 
 // - Iterators
@@ -192,25 +203,40 @@ type Iterator struct {
 	Iterator   string     `json:"iterator"`
 	Binds      []string   `json:"binds"`
 	Expression Expression `json:"expression"`
+	Position   *Position  `json:"position,omitempty"`
 }
 
 // Triggers and Violations
 
 type Trigger struct {
-	Identifier string `json:"identifier"`
-	Kind       string `json:"kind"`
-	Parent     string `json:"parent"`
+	Identifier string    `json:"identifier"`
+	Kind       string    `json:"kind"`
+	Parent     string    `json:"parent"`
+	Position   *Position `json:"position,omitempty"`
 }
 
 type Projection struct {
 	Parameter string      `json:"parameter"`
 	Operand   *Expression `json:"operand"`
+	Position  *Position   `json:"position,omitempty"`
 }
 
+// Violation is a disabled act that was triggered, a violated duty or an
+// invariant that does not hold.
 type Violation struct {
 	Kind       string       `json:"kind"`
 	Identifier string       `json:"identifier"`
 	Operands   []Expression `json:"operands"`
+
+	// For duties, whether the phrase made the duty violated or unviolated.
+	// Duties that stay violated have no change.
+	Change string `json:"change,omitempty"`
+
+	// For invariants, the instances of the bound variables for which the
+	// invariant fails
+	Witnesses [][]Expression `json:"witnesses,omitempty"`
+
+	Position *Position `json:"position,omitempty"`
 }
 
 type Output struct {
@@ -221,15 +247,24 @@ type Output struct {
 }
 
 type Error struct {
-	Id      string `json:"id"`
-	Message string `json:"message"`
+	Id       string    `json:"id"`
+	Message  string    `json:"message"`
+	Position *Position `json:"position,omitempty"`
+}
+
+// Position is a location in a source file in eFLINT syntax. Lines and columns
+// start at 1.
+type Position struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
 }
 
 type PhraseResult struct {
 	Success    bool         `json:"success"`
 	Errors     []Error      `json:"errors,omitempty"`
 	Results    []Expression `json:"result"`
-	Changes    []Phrase     `json:"changes,omitempty"`
+	Changes    []Phrase     `json:"changes"`
 	Triggers   []Trigger    `json:"triggers,omitempty"`
 	Violated   bool         `json:"violated"`
 	Violations []Violation  `json:"violations,omitempty"`
@@ -252,6 +287,7 @@ type IQueryResult struct {
 
 type StateChanges struct {
 	Success    bool        `json:"success"`
+	Errors     []Error     `json:"errors,omitempty"`
 	Changes    []Phrase    `json:"changes"`
 	Triggers   []Trigger   `json:"triggers"`
 	Violated   bool        `json:"violated"`
@@ -1,5 +1,9 @@
 package eflint
 
+import (
+	"fmt"
+)
+
 func isSupportedVersion(version string) bool {
 	for _, supportedVersion := range SupportedVersions {
 		if version == supportedVersion {
@@ -9,7 +13,9 @@ func isSupportedVersion(version string) bool {
 	return false
 }
 
-// Typecheck checks that the input is valid.
+// Typecheck checks that the input is valid. The phrases themselves can only be
+// checked against the facts that are declared, which is done by
+// Engine.TypecheckPhrases.
 func Typecheck(input Input) error {
 	// Check if the input version is supported
 	if !isSupportedVersion(input.Version) {
@@ -18,7 +24,7 @@ func Typecheck(input Input) error {
 
 	switch input.Kind {
 	case "phrases":
-		return TypecheckPhrases(input.Phrases)
+		return nil
 	case "ping":
 		fallthrough
 	case "handshake":
@@ -33,164 +39,624 @@ func Typecheck(input Input) error {
 	}
 }
 
-// TypecheckPhrases goes over all the phrases in the input and checks that
-// the types of the expressions are correct.
-func TypecheckPhrases(phrases []Phrase) error {
-	for _, phrase := range phrases {
-		err := TypecheckPhrase(phrase)
-		if err != nil {
-			return err
+// typechecker checks phrases against the declared facts. It works on a copy of
+// the declarations of an engine, so the engine itself is left as it is.
+type typechecker struct {
+	*Engine
+
+	// Declarations may refer to facts that are only declared later on, so
+	// they are checked after all phrases have been declared.
+	pending []pendingCheck
+	phrase  int
+
+	// Queries and statements may refer to values outside the range of a
+	// fact, so ranges are only checked within declarations.
+	ranges bool
+}
+
+type pendingCheck struct {
+	phrase int
+	check  func() error
+}
+
+// later checks the declaration of the current phrase once all phrases have
+// been declared.
+func (t *typechecker) later(check func() error) {
+	t.pending = append(t.pending, pendingCheck{phrase: t.phrase, check: check})
+}
+
+// TypecheckPhrases goes over all the phrases and checks them against the facts
+// that are declared in the engine or by the phrases. The phrases are not
+// interpreted. An error is returned for every phrase that is not correct.
+func (e *Engine) TypecheckPhrases(phrases []Phrase) []Error {
+	t := &typechecker{
+		Engine: &Engine{
+			state: map[string]map[string]interface{}{
+				"facts":        copyFacts(e.state["facts"]),
+				"placeholders": copyFacts(e.state["placeholders"]),
+			},
+		},
+	}
+
+	errors := make([]Error, 0)
+	fail := func(index int, err error) {
+		failure := AsError(locate(err, phrases[index].Position))
+		failure.Message = fmt.Sprintf("phrase %d: %s", index+1, failure.Message)
+		errors = append(errors, failure)
+	}
+
+	for i, phrase := range phrases {
+		t.phrase = i
+		if err := t.TypecheckPhrase(phrase); err != nil {
+			fail(i, err)
 		}
 	}
-	return nil
+
+	t.ranges = true
+	for _, pending := range t.pending {
+		if err := pending.check(); err != nil {
+			fail(pending.phrase, err)
+		}
+	}
+
+	return errors
 }
 
 // TypecheckPhrase checks that the types of the expressions in the phrase are
-// correct.
-func TypecheckPhrase(phrase Phrase) error {
+// correct. Declarations are added to the declared facts right away, but their
+// clauses are only checked once all phrases have been declared.
+func (t *typechecker) TypecheckPhrase(phrase Phrase) error {
 	switch phrase.Kind {
 	case "bquery":
-		return TypecheckBquery(phrase)
+		return t.TypecheckBquery(phrase)
 	case "iquery":
-		return TypecheckIquery(phrase)
+		return t.TypecheckIquery(phrase)
 	case "create":
-		return TypecheckCreate(phrase)
+		return t.TypecheckCreate(phrase)
 	case "terminate":
-		return TypecheckTerminate(phrase)
+		return t.TypecheckTerminate(phrase)
 	case "obfuscate":
-		return TypecheckObfuscate(phrase)
+		return t.TypecheckObfuscate(phrase)
 	case "trigger":
-		return TypecheckTrigger(phrase)
+		return t.TypecheckTrigger(phrase)
 	case "afact":
-		return TypecheckAfact(phrase)
+		return t.TypecheckAfact(phrase)
 	case "cfact":
-		return TypecheckCfact(phrase)
+		return t.TypecheckCfact(phrase)
 	case "placeholder":
-		return TypecheckPlaceholder(phrase)
+		return t.TypecheckPlaceholder(phrase)
 	case "predicate":
-		return TypecheckPredicate(phrase)
+		return t.TypecheckPredicate(phrase)
 	case "event":
-		return TypecheckEvent(phrase)
+		return t.TypecheckEvent(phrase)
 	case "act":
-		return TypecheckAct(phrase)
+		return t.TypecheckAct(phrase)
 	case "duty":
-		return TypecheckDuty(phrase)
+		return t.TypecheckDuty(phrase)
 	case "extend":
-		return TypecheckExtend(phrase)
+		return t.TypecheckExtend(phrase)
 	default:
-		return ErrUnknownKind
+		return ErrUnknownKind.Errorf("unknown kind: %s", phrase.Kind)
 	}
 }
 
 // TypecheckBquery checks that the types of the expressions in the bquery are
 // correct.
-func TypecheckBquery(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckBquery(phrase Phrase) error {
+	if phrase.Expression == nil {
+		return ErrInvalidPhrase.Errorf("a query needs an expression")
+	}
+
+	_, err := t.typeOf(*phrase.Expression)
+	return err
 }
 
 // TypecheckIquery checks that the types of the expressions in the iquery are
 // correct.
-func TypecheckIquery(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckIquery(phrase Phrase) error {
+	return t.TypecheckBquery(phrase)
 }
 
 // TypecheckCreate checks that the types of the expressions in the create are
 // correct.
-func TypecheckCreate(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckCreate(phrase Phrase) error {
+	if phrase.Operand == nil {
+		return ErrInvalidPhrase.Errorf("a %s needs an operand", phrase.Kind)
+	}
+
+	return t.checkInstance(*phrase.Operand)
 }
 
 // TypecheckTerminate checks that the types of the expressions in the terminate
 // are correct.
-func TypecheckTerminate(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckTerminate(phrase Phrase) error {
+	return t.TypecheckCreate(phrase)
 }
 
 // TypecheckObfuscate checks that the types of the expressions in the obfuscate
 // are correct.
-func TypecheckObfuscate(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckObfuscate(phrase Phrase) error {
+	return t.TypecheckCreate(phrase)
 }
 
 // TypecheckTrigger checks that the types of the expressions in the trigger are
-// correct.
-func TypecheckTrigger(phrase Phrase) error {
-	return nil
+// correct, and that they refer to events, acts or duties.
+func (t *typechecker) TypecheckTrigger(phrase Phrase) error {
+	if phrase.Operand == nil {
+		return ErrInvalidPhrase.Errorf("a trigger needs an operand")
+	}
+
+	factType, err := t.typeOf(*phrase.Operand)
+	if err != nil {
+		return err
+	}
+
+	if cfact, ok := t.state["facts"][factType].(CompositeFact); ok {
+		if cfact.FactType == EventType || cfact.FactType == ActType || cfact.FactType == DutyType {
+			return nil
+		}
+	}
+
+	return ErrNotTriggerable.Errorf("%s is not an event, act or duty", FormatExpression(*phrase.Operand))
 }
 
 // TypecheckAfact checks that the types of the expressions in the afact are
 // correct.
-func TypecheckAfact(phrase Phrase) error {
-	// Default the name to "String"
-	if phrase.Name.(string) == "" {
-		phrase.Name = "String"
-	}
-
-	// Check if range is given. If so, check its type.
-	//if phrase.Range != nil {
-	//	for _, expr := range phrase.Range {
-	//		if phrase.Name.(string) == "String" {
-	//			if _, ok := expr.Value.(string); !ok {
-	//				return fmt.Errorf("range of atomic fact %s must be string", phrase.Name.(string))
-	//			}
-	//		} else if phrase.Name.(string) == "Int" {
-	//			if _, ok := expr.Value.(int); !ok {
-	//				return fmt.Errorf("range of atomic fact %s must be int", phrase.Name.(string))
-	//			}
-	//		} else {
-	//			// TODO: This should be handled somewhere else
-	//			return fmt.Errorf("unknown type %s", phrase.Name.(string))
-	//		}
-	//	}
-	//}
+func (t *typechecker) TypecheckAfact(phrase Phrase) error {
+	name, err := phraseName(phrase)
+	if err != nil {
+		return err
+	}
+
+	if phrase.Type != "" && phrase.Type != "String" && phrase.Type != "Int" {
+		return ErrUnknownType.Errorf("unknown type %s of fact %s", phrase.Type, name)
+	}
+
+	// Check that the range only contains values of the type of the fact
+	for _, value := range phrase.Range {
+		if valueType := primitiveType(value.Value); valueType != phrase.Type {
+			return ErrTypeMismatch.Errorf("range of fact %s contains %s, which is not of type %s", name, FormatExpression(value), phrase.Type)
+		}
+	}
+
+	t.state["facts"][name] = AtomicFact{Name: name, Type: phrase.Type, Range: phrase.Range}
+	t.later(func() error {
+		return t.checkClauses(phrase)
+	})
 
 	return nil
 }
 
 // TypecheckCfact checks that the types of the expressions in the cfact are
 // correct.
-func TypecheckCfact(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckCfact(phrase Phrase) error {
+	return t.checkCompositeFact(phrase, phrase.IdentifiedBy, FactType)
 }
 
 // TypecheckPlaceholder checks that the types of the expressions in the
 // placeholder are correct.
-func TypecheckPlaceholder(phrase Phrase) error {
+func (t *typechecker) TypecheckPlaceholder(phrase Phrase) error {
+	names, ok := phrase.Name.([]string)
+	if !ok || len(names) == 0 {
+		return ErrInvalidPhrase.Errorf("the name of a placeholder must be a list of strings")
+	}
+
+	if !t.factExists(t.getFactName(phrase.For)) {
+		return ErrUnknownFact.Errorf("placeholder %s is for %s, which is not a declared fact", names[0], phrase.For)
+	}
+
+	for _, name := range names {
+		if _, ok := t.state["placeholders"][name]; ok {
+			return ErrDuplicatePlaceholder.Errorf("placeholder %s already exists", name)
+		}
+
+		t.state["placeholders"][name] = phrase.For
+	}
+
 	return nil
 }
 
 // TypecheckPredicate checks that the types of the expressions in the predicate
 // are correct.
-func TypecheckPredicate(phrase Phrase) error {
+func (t *typechecker) TypecheckPredicate(phrase Phrase) error {
+	name, err := phraseName(phrase)
+	if err != nil {
+		return err
+	}
+
+	if phrase.Expression == nil {
+		return ErrInvalidPhrase.Errorf("predicate %s needs an expression", name)
+	}
+
+	t.state["facts"][name] = AtomicFact{Name: name}
+	t.later(func() error {
+		_, err := t.typeOf(*phrase.Expression)
+		return err
+	})
+
 	return nil
 }
 
 // TypecheckEvent checks that the types of the expressions in the event are
 // correct.
-func TypecheckEvent(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckEvent(phrase Phrase) error {
+	return t.checkCompositeFact(phrase, phrase.RelatedTo, EventType)
 }
 
 // TypecheckAct checks that the types of the expressions in the act are correct.
-func TypecheckAct(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckAct(phrase Phrase) error {
+	if phrase.Actor == "" {
+		return ErrInvalidPhrase.Errorf("act %v has no actor", phrase.Name)
+	}
+
+	return t.checkCompositeFact(phrase, append([]string{phrase.Actor}, phrase.RelatedTo...), ActType)
 }
 
 // TypecheckDuty checks that the types of the expressions in the duty are
 // correct.
-func TypecheckDuty(phrase Phrase) error {
-	return nil
+func (t *typechecker) TypecheckDuty(phrase Phrase) error {
+	if phrase.Holder == "" || phrase.Claimant == "" {
+		return ErrInvalidPhrase.Errorf("duty %v needs both a holder and a claimant", phrase.Name)
+	}
+
+	return t.checkCompositeFact(phrase, append([]string{phrase.Holder, phrase.Claimant}, phrase.RelatedTo...), DutyType)
 }
 
 // TypecheckExtend checks that the types of the expressions in the extend are
 // correct.
-func TypecheckExtend(phrase Phrase) error {
+func (t *typechecker) TypecheckExtend(phrase Phrase) error {
+	name, err := phraseName(phrase)
+	if err != nil {
+		return err
+	}
+
+	if !t.factExists(name) {
+		return ErrUnknownFact.Errorf("cannot extend fact %s, as it does not exist", name)
+	}
+
+	t.later(func() error {
+		return t.checkClauses(phrase)
+	})
+
+	return nil
+}
+
+func phraseName(phrase Phrase) (string, error) {
+	name, ok := phrase.Name.(string)
+	if !ok || name == "" {
+		return "", ErrInvalidPhrase.Errorf("the name of a %s must be a string", phrase.Kind)
+	}
+
+	return name, nil
+}
+
+// checkCompositeFact declares a composite fact with the given parameters.
+func (t *typechecker) checkCompositeFact(phrase Phrase, params []string, factType int) error {
+	name, err := phraseName(phrase)
+	if err != nil {
+		return err
+	}
+
+	t.state["facts"][name] = CompositeFact{Name: name, IdentifiedBy: params, FactType: factType}
+	t.later(func() error {
+		for _, param := range params {
+			if !t.factExists(t.getFactName(param)) {
+				return ErrUnknownFact.Errorf("%s of fact %s is not a declared fact", param, name)
+			}
+		}
+
+		return t.checkClauses(phrase)
+	})
+
+	return nil
+}
+
+// checkClauses checks the expressions in the clauses of a declaration.
+func (t *typechecker) checkClauses(phrase Phrase) error {
+	clauses := [][]Expression{phrase.DerivedFrom, phrase.HoldsWhen, phrase.ConditionedBy, phrase.SyncsWith, phrase.ViolatedWhen}
+	for _, expressions := range clauses {
+		for _, expression := range expressions {
+			if _, err := t.typeOf(expression); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The effects of events and acts must be instances
+	effects := [][]Expression{phrase.Creates, phrase.Terminates, phrase.Obfuscates}
+	for _, expressions := range effects {
+		for _, expression := range expressions {
+			if err := t.checkInstance(expression); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkInstance checks that the expression evaluates to instances of a fact.
+func (t *typechecker) checkInstance(expression Expression) error {
+	valueType, err := t.typeOf(expression)
+	if err != nil {
+		return err
+	}
+
+	if !t.factExists(valueType) {
+		return ErrInvalidExpression.Errorf("%s is of type %s, not an instance of a fact", FormatExpression(expression), valueType)
+	}
+
 	return nil
 }
 
-func TypeCheckExpressions(expressions *[]Expression) error {
+// primitiveType returns the type of a literal value, or an empty string if the
+// value is not a literal.
+func primitiveType(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return "Int"
+	case string:
+		return "String"
+	case bool:
+		return "Bool"
+	default:
+		return ""
+	}
+}
+
+// isInteger reports whether values of the given type can be used as integers.
+func (t *typechecker) isInteger(valueType string) bool {
+	if afact, ok := t.state["facts"][valueType].(AtomicFact); ok {
+		return afact.Type == "Int"
+	}
+
+	return valueType == "Int"
+}
+
+func (t *typechecker) isString(valueType string) bool {
+	if afact, ok := t.state["facts"][valueType].(AtomicFact); ok {
+		return afact.Type == "String"
+	}
+
+	return valueType == "String"
+}
+
+// typeOf infers the type of an expression. This is either Int, String or Bool
+// for literals, or the name of the fact for instances.
+func (t *typechecker) typeOf(expression Expression) (valueType string, err error) {
+	defer func() {
+		err = locate(err, expression.Position)
+	}()
+
+	if expression.Value != nil {
+		if reference, ok := expression.Value.([]string); ok {
+			if len(reference) != 1 {
+				return "", ErrInvalidExpression.Errorf("invalid reference %v", reference)
+			}
+
+			name := t.getFactName(reference[0])
+			if !t.factExists(name) {
+				return "", ErrUnknownFact.Errorf("%s does not refer to a declared fact", reference[0])
+			}
+
+			return name, nil
+		}
+
+		if valueType := primitiveType(expression.Value); valueType != "" {
+			return valueType, nil
+		}
+
+		return "", ErrInvalidExpression.Errorf("values of type %T are not supported", expression.Value)
+	} else if expression.Identifier != "" {
+		return t.typeOfApplication(expression)
+	} else if expression.Operator != "" {
+		return t.typeOfOperator(expression)
+	} else if expression.Iterator != "" {
+		return t.typeOfIterator(expression)
+	} else if expression.Parameter != "" {
+		return t.typeOfProjection(expression)
+	}
+
+	return "", ErrInvalidExpression.Errorf("unknown expression type")
+}
+
+func (t *typechecker) typeOfApplication(expression Expression) (string, error) {
+	name := expression.Identifier
+	fact, ok := t.state["facts"][name]
+	if !ok {
+		return "", ErrUnknownFact.Errorf("fact %s does not exist", name)
+	}
+
+	// Without operands, the parameters are filled in as variables
+	if len(expression.Operands) == 0 {
+		return name, nil
+	}
+
+	if afact, ok := fact.(AtomicFact); ok {
+		if len(expression.Operands) != 1 || afact.Type == "" {
+			return "", ErrArityMismatch.Errorf("atomic fact %s is applied to %d operands", name, len(expression.Operands))
+		}
+
+		operandType, err := t.typeOf(expression.Operands[0])
+		if err != nil {
+			return "", err
+		}
+
+		// Instances of atomic facts of the same type can be converted
+		if other, ok := t.state["facts"][operandType].(AtomicFact); ok {
+			operandType = other.Type
+		}
+
+		return name, t.checkOperand(expression.Operands[0], operandType, afact)
+	}
+
+	cfact := fact.(CompositeFact)
+	if len(expression.Operands) != len(cfact.IdentifiedBy) {
+		return "", ErrArityMismatch.Errorf("composite fact %s expects %d operands, got %d", name, len(cfact.IdentifiedBy), len(expression.Operands))
+	}
+
+	for i, operand := range expression.Operands {
+		param := t.getFactName(cfact.IdentifiedBy[i])
+		operandType, err := t.typeOf(operand)
+		if err != nil {
+			return "", err
+		}
+
+		// Instances of the parameter itself are always fine
+		if operandType == param {
+			continue
+		}
+
+		// Otherwise, only literals can be converted to an instance of the parameter
+		paramFact, ok := t.state["facts"][param].(AtomicFact)
+		if !ok || t.factExists(operandType) {
+			return "", ErrTypeMismatch.Errorf("operand %s of %s must be an instance of %s", FormatExpression(operand), name, param)
+		}
+
+		if err := t.checkOperand(operand, operandType, paramFact); err != nil {
+			return "", err
+		}
+	}
+
+	return name, nil
+}
+
+// checkOperand checks that an operand of the given type can be converted to an
+// instance of the atomic fact.
+func (t *typechecker) checkOperand(operand Expression, operandType string, afact AtomicFact) error {
+	if operandType != afact.Type {
+		return ErrTypeMismatch.Errorf("%s is not of type %s of fact %s", FormatExpression(operand), afact.Type, afact.Name)
+	}
+
+	if t.ranges && operand.Value != nil && !checkRange(operand.Value, afact) {
+		return ErrRangeViolation.Errorf("value %s is not in the range of fact %s", formatValue(operand.Value), afact.Name)
+	}
+
+	return nil
+}
+
+func (t *typechecker) typeOfOperator(expression Expression) (string, error) {
+	types := make([]string, 0, len(expression.Operands))
+	for _, operand := range expression.Operands {
+		operandType, err := t.typeOf(operand)
+		if err != nil {
+			return "", err
+		}
+
+		types = append(types, operandType)
+	}
+
+	operands := 1
+	result := "Bool"
+
+	switch expression.Operator {
+	case "ADD", "LT", "GT", "LTE", "GTE":
+		// Strings are concatenated and compared as well
+		if len(types) == 2 && t.isString(types[0]) && t.isString(types[1]) {
+			operands = 2
+			if expression.Operator == "ADD" {
+				result = "String"
+			}
+			break
+		}
+		fallthrough
+	case "SUB", "MUL", "DIV", "MOD", "SUM", "MAX", "MIN", "NEG", "ABS":
+		for i, operandType := range types {
+			if !t.isInteger(operandType) {
+				return "", ErrNonIntegerArithmetic.Errorf("operator %s expects integers, got %s", expression.Operator, FormatExpression(expression.Operands[i]))
+			}
+		}
+
+		switch expression.Operator {
+		case "ADD", "SUB", "MUL", "DIV", "MOD":
+			operands, result = 2, "Int"
+		case "LT", "GT", "LTE", "GTE":
+			operands = 2
+		default:
+			result = "Int"
+		}
+	case "EQ", "NEQ":
+		operands = 2
+	case "AND", "OR":
+		operands = len(types)
+	case "NOT":
+	case "COUNT":
+		result = "Int"
+	case "WHEN":
+		operands = 2
+		if len(types) == 2 {
+			result = types[0]
+		}
+	case "HOLDS", "ENABLED", "VIOLATED", "PRESENT", "ABSENT":
+		if len(types) == 1 && !t.factExists(types[0]) {
+			return "", ErrInvalidExpression.Errorf("%s(t) requires t to be an instance, not %s", functionOperators[expression.Operator], FormatExpression(expression.Operands[0]))
+		}
+	case "IF":
+		operands = 3
+		if len(types) == 3 {
+			result = types[1]
+		}
+	default:
+		return "", ErrUnknownOperator.Errorf("unknown operator %s", expression.Operator)
+	}
+
+	if len(types) != operands {
+		return "", ErrInvalidExpression.Errorf("operator %s expects %d operands, got %d", expression.Operator, operands, len(types))
+	}
+
+	return result, nil
+}
+
+func (t *typechecker) typeOfIterator(expression Expression) (string, error) {
+	for _, bind := range expression.Binds {
+		if !t.factExists(t.getFactName(bind)) {
+			return "", ErrUnknownFact.Errorf("%s does not refer to a declared fact", bind)
+		}
+	}
+
+	if expression.Expression == nil {
+		return "", ErrInvalidExpression.Errorf("iterator %s needs an expression", expression.Iterator)
+	}
+
+	valueType, err := t.typeOf(*expression.Expression)
+	if err != nil {
+		return "", err
+	}
+
+	switch expression.Iterator {
+	case "FOREACH":
+		return valueType, nil
+	case "EXISTS", "FORALL":
+		return "Bool", nil
+	default:
+		return "", ErrUnknownOperator.Errorf("unknown iterator %s", expression.Iterator)
+	}
+}
+
+func (t *typechecker) typeOfProjection(expression Expression) (string, error) {
+	if expression.Operand == nil {
+		return "", ErrInvalidExpression.Errorf("projection of %s needs an operand", expression.Parameter)
+	}
+
+	operandType, err := t.typeOf(*expression.Operand)
+	if err != nil {
+		return "", err
+	}
+
+	if cfact, ok := t.state["facts"][operandType].(CompositeFact); ok {
+		for _, param := range cfact.IdentifiedBy {
+			if param == expression.Parameter {
+				return t.getFactName(param), nil
+			}
+		}
+	}
+
+	return "", ErrInvalidExpression.Errorf("%s has no parameter %s", operandType, expression.Parameter)
+}
+
+func (e *Engine) TypeCheckExpressions(expressions *[]Expression) error {
 	for i := range *expressions {
-		err := TypeCheckExpression(&(*expressions)[i])
+		err := e.TypeCheckExpression(&(*expressions)[i])
 		if err != nil {
 			return err
 		}
@@ -199,21 +665,24 @@ func TypeCheckExpressions(expressions *[]Expression) error {
 	return nil
 }
 
-func TypeCheckExpression(expression *Expression) error {
+func (e *Engine) TypeCheckExpression(expression *Expression) (err error) {
+	defer func() {
+		err = locate(err, expression.Position)
+	}()
+
 	if len(expression.Operands) > 0 {
-		err := TypeCheckExpressions(&expression.Operands)
+		err := e.TypeCheckExpressions(&expression.Operands)
 		if err != nil {
 			return err
 		}
 	}
 
 	if expression.Identifier != "" && len(expression.Operands) == 0 {
-		if !factExists(expression.Identifier) {
-			//log.Println(expression)
-			panic("Fact does not exist in typecheck")
+		if !e.factExists(expression.Identifier) {
+			return ErrUnknownFact.Errorf("fact %s does not exist", expression.Identifier)
 		}
 
-		fact := globalState["facts"][expression.Identifier]
+		fact := e.state["facts"][expression.Identifier]
 
 		if cfact, ok := fact.(CompositeFact); ok {
 			for _, param := range cfact.IdentifiedBy {
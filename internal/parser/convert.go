@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Convert converts a parsed input to the input of the interpreter, in the same
+// way as its JSON would be decoded.
+func Convert(ini *Input) eflint.Input {
+	phrases := make([]eflint.Phrase, 0, len(ini.Phrases))
+	for _, phrase := range ini.Phrases {
+		phrases = append(phrases, ConvertPhrase(phrase))
+	}
+
+	return eflint.Input{
+		Version: ini.Version,
+		Kind:    ini.Kind,
+		Phrases: phrases,
+		Updates: ini.Updates,
+	}
+}
+
+// ConvertPhrase converts a phrase to a phrase of the interpreter. The phrase
+// must have been completed by Parse.
+func ConvertPhrase(phrase Phrase) eflint.Phrase {
+	switch p := phrase.(type) {
+	case Fact:
+		converted := eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			Stateless:     p.Stateless,
+			Updates:       p.Updates,
+			Name:          p.Name,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+		}
+
+		if p.Kind == "cfact" {
+			converted.IdentifiedBy = p.IdentifiedBy
+		} else {
+			converted.Type = p.Type
+			for _, value := range p.Range {
+				converted.Range = append(converted.Range, ConvertExpression(value.(Expression)))
+			}
+		}
+
+		return converted
+	case Query:
+		expression := ConvertExpression(p.Operand)
+		return eflint.Phrase{
+			Position:   position(p.Pos),
+			Kind:       p.Kind,
+			Stateless:  p.Stateless,
+			Updates:    p.Updates,
+			Expression: &expression,
+			WhenTrue:   p.WhenTrue,
+		}
+	case Statement:
+		operand := ConvertExpression(p.Operand)
+		return eflint.Phrase{Position: position(p.Pos), Kind: p.Kind, Operand: &operand}
+	case Placeholder:
+		return eflint.Phrase{Position: position(p.Pos), Kind: p.Kind, Name: p.Name, For: p.For}
+	case Predicate:
+		expression := ConvertExpression(p.Expression)
+		return eflint.Phrase{
+			Position:    position(p.Pos),
+			Kind:        p.Kind,
+			Name:        p.Name,
+			IsInvariant: bool(p.IsInvariant),
+			Expression:  &expression,
+		}
+	case Event:
+		return eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			Name:          p.Name,
+			RelatedTo:     p.RelatedTo,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+			SyncsWith:     convertExpressions(p.SyncsWith),
+			Creates:       convertExpressions(p.Creates),
+			Terminates:    convertExpressions(p.Terminates),
+			Obfuscates:    convertExpressions(p.Obfuscates),
+		}
+	case Act:
+		return eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			Name:          p.Name,
+			Actor:         p.Actor,
+			RelatedTo:     p.RelatedTo,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+			SyncsWith:     convertExpressions(p.SyncsWith),
+			Creates:       convertExpressions(p.Creates),
+			Terminates:    convertExpressions(p.Terminates),
+			Obfuscates:    convertExpressions(p.Obfuscates),
+		}
+	case Duty:
+		return eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			Name:          p.Name,
+			Holder:        p.Holder,
+			Claimant:      p.Claimant,
+			RelatedTo:     p.RelatedTo,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+			ViolatedWhen:  convertExpressions(p.ViolatedWhen),
+		}
+	case ExtendFactDuty:
+		return eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			ParentKind:    p.ParentKind,
+			Name:          p.Name,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+		}
+	case ExtendEventAct:
+		return eflint.Phrase{
+			Position:      position(p.Pos),
+			Kind:          p.Kind,
+			ParentKind:    p.ParentKind,
+			Name:          p.Name,
+			DerivedFrom:   convertExpressions(p.DerivedFrom),
+			HoldsWhen:     convertExpressions(p.HoldsWhen),
+			ConditionedBy: convertExpressions(p.ConditionedBy),
+			SyncsWith:     convertExpressions(p.SyncsWith),
+			Creates:       convertExpressions(p.Creates),
+			Terminates:    convertExpressions(p.Terminates),
+			Obfuscates:    convertExpressions(p.Obfuscates),
+		}
+	}
+
+	return eflint.Phrase{}
+}
+
+// ConvertExpression converts an expression to an expression of the
+// interpreter.
+func ConvertExpression(expression Expression) eflint.Expression {
+	converted := convertExpression(expression)
+	converted.Position = position(ExpressionPosition(expression))
+
+	return converted
+}
+
+func convertExpression(expression Expression) eflint.Expression {
+	switch e := expression.(type) {
+	case String:
+		return eflint.Expression{Value: e.Value}
+	case Int:
+		return eflint.Expression{Value: e.Value}
+	case Bool:
+		return eflint.Expression{Value: e.Value}
+	case Reference:
+		return eflint.Expression{Value: []string{e.Value}}
+	case ConstructorApplication:
+		// Constructors always have their operands, even if there are none
+		operands := make([]eflint.Expression, 0, len(e.Operands))
+		for _, operand := range e.Operands {
+			operands = append(operands, ConvertExpression(operand))
+		}
+		return eflint.Expression{Identifier: e.Identifier, Operands: operands}
+	case Operator:
+		operands := make([]eflint.Expression, 0, 2)
+		if e.Left != nil {
+			operands = append(operands, ConvertExpression(e.Left))
+		}
+		if e.Right != nil {
+			operands = append(operands, ConvertExpression(e.Right))
+		}
+		return eflint.Expression{Operator: operatorNames[e.Operator], Operands: operands}
+	case Conditional:
+		return eflint.Expression{Operator: "IF", Operands: []eflint.Expression{
+			ConvertExpression(e.Condition),
+			ConvertExpression(e.Then),
+			ConvertExpression(e.Else),
+		}}
+	case Iterator:
+		body := ConvertExpression(e.Expression)
+		return eflint.Expression{Iterator: e.Iterator, Binds: e.Binds, Expression: &body}
+	case Projection:
+		operand := ConvertExpression(e.Operand)
+		return eflint.Expression{Parameter: e.Parameter, Operand: &operand}
+	}
+
+	return eflint.Expression{}
+}
+
+func convertExpressions(expressions []Expression) []eflint.Expression {
+	if len(expressions) == 0 {
+		return nil
+	}
+
+	converted := make([]eflint.Expression, 0, len(expressions))
+	for _, expression := range expressions {
+		converted = append(converted, ConvertExpression(expression))
+	}
+
+	return converted
+}
+
+// position converts a position of the lexer, if it is known.
+func position(pos lexer.Position) *eflint.Position {
+	if pos.Line == 0 {
+		return nil
+	}
+
+	return &eflint.Position{File: pos.Filename, Line: pos.Line, Column: pos.Column}
+}
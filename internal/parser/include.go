@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loader opens a file that is included by an #include or #require directive.
+// The name of the file is relative to the directory of the file that
+// includes it.
+type Loader func(name string) (io.ReadCloser, error)
+
+// OpenFile opens included files from disk.
+func OpenFile(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// Library returns a loader that opens included files from a file system, such
+// as a directory of specifications. Files outside of it cannot be included.
+func Library(fsys fs.FS) Loader {
+	return func(name string) (io.ReadCloser, error) {
+		name = filepath.ToSlash(name)
+		if !fs.ValidPath(name) {
+			return nil, errors.New("the file is outside of the library")
+		}
+
+		return fsys.Open(name)
+	}
+}
+
+// includer resolves the directives of the files that are parsed together.
+type includer struct {
+	load Loader
+	// required holds the files that have been parsed, which are not parsed
+	// again by #require
+	required map[string]bool
+}
+
+// parse parses a file and replaces its directives by the phrases of the files
+// they refer to. The stack holds the files that include the file. The result
+// is only valid if none of the files contains a syntax error.
+func (i *includer) parse(filename string, file io.Reader, stack []string) ([]Phrase, []Diagnostic, bool) {
+	ini, diagnostics := parseSource(filename, file)
+	if ini == nil {
+		return nil, diagnostics, false
+	}
+
+	stack = append(stack, filepath.Clean(filename))
+	phrases := make([]Phrase, 0, len(ini.Phrases))
+	ok := true
+
+	for _, phrase := range ini.Phrases {
+		directive, isDirective := phrase.(Include)
+		if !isDirective {
+			phrases = append(phrases, phrase)
+			continue
+		}
+
+		included, failures, valid := i.include(directive, stack)
+		phrases = append(phrases, included...)
+		diagnostics = append(diagnostics, failures...)
+		ok = ok && valid
+	}
+
+	return phrases, diagnostics, ok
+}
+
+// include returns the phrases of the file that a directive in the last file
+// on the stack refers to.
+func (i *includer) include(directive Include, stack []string) ([]Phrase, []Diagnostic, bool) {
+	name := directive.File
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(stack[len(stack)-1]), name)
+	}
+
+	fail := func(format string, a ...any) ([]Phrase, []Diagnostic, bool) {
+		return nil, []Diagnostic{{Pos: directive.Pos, Message: fmt.Sprintf(format, a...)}}, true
+	}
+
+	if i.load == nil {
+		return fail("cannot %s %s, files cannot be included here", directive.Kind, name)
+	}
+
+	for index, including := range stack {
+		if including == name && directive.Kind == "include" {
+			return fail("cannot include %s, it is included by itself: %s", name, strings.Join(append(stack[index:], name), " -> "))
+		}
+	}
+
+	if directive.Kind == "require" && i.required[name] {
+		return nil, nil, true
+	}
+	i.required[name] = true
+
+	file, err := i.load(name)
+	if err != nil {
+		var pathError *fs.PathError
+		if errors.As(err, &pathError) {
+			err = pathError.Err
+		}
+		return fail("cannot %s %s: %v", directive.Kind, name, err)
+	}
+	defer file.Close()
+
+	return i.parse(name, file, stack)
+}
@@ -2,106 +2,116 @@ package parser
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
-	"os"
+	"io"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 var (
 	eflintLexer = lexer.MustSimple([]lexer.SimpleRule{
-		{"whitespace", `\s+`},
-		{"Comment", `//.*`},
-		// TODO: Add support for quotation marks.
-		{`DecoratedFactID`, `[a-z][a-z_-]*[0-9]+`},
-		{`FactID`, `[a-z][a-z_-]*`},
-		{`Fact`, `Fact`},
-		{`StringType`, `String`},
-		{`IntType`, `Int`},
-		{`True`, `True`},
-		{`False`, `False`},
-
-		{`IdentifiedBy`, `Identified by`},
-		{`DerivedFrom`, `Derived from`},
-		{`HoldsWhen`, `Holds when`},
-		{`ConditionedBy`, `Conditioned by`},
-		{`ViolatedWhen`, `Violated when`},
-		{`Placeholder`, `Placeholder`},
-		{`Predicate`, `Predicate`},
-		{`Invariant`, `Invariant`},
-		{`Event`, `Event`},
-		{`Duty`, `Duty`},
-		{`RelatedTo`, `Related to`},
-		{`SyncsWith`, `Syncs with`},
-		{`Creates`, `Creates`},
-		{`Holds`, `Holds`},
-		{`Enabled`, `Enabled`},
-		{`Terminates`, `Terminates`},
-		{`Obfuscates`, `Obfuscates`},
-		{`Actor`, `Actor`},
-		{`Act`, `Act`},
-		{`Recipient`, `Recipient`},
-		{`Extend`, `Extend`},
-		{`Holder`, `Holder`},
-		{`Claimant`, `Claimant`},
-
-		{`Foreach`, `Foreach`},
-		{`Forall`, `Forall`},
-		{`For`, `For`},
-		{`When`, `When`},
+		{Name: "whitespace", Pattern: `\s+`},
+		{Name: "Comment", Pattern: `//.*`},
+		// Identifiers that end with digits or primes are decorated, which is
+		// decided by decorate once the whole identifier is matched
+		{Name: `FactID`, Pattern: `[a-z][a-zA-Z0-9_-]*'*`},
+		{Name: `DecoratedFactID`, Pattern: `[a-z][a-zA-Z0-9_-]*'*`},
+		{Name: `EscapedFactID`, Pattern: `\[[^\[\]\n]+\]`},
+		{Name: `Fact`, Pattern: `Fact\b`},
+		{Name: `StringType`, Pattern: `String\b`},
+		{Name: `IntType`, Pattern: `Int\b`},
+		{Name: `True`, Pattern: `True\b`},
+		{Name: `False`, Pattern: `False\b`},
+
+		{Name: `IdentifiedBy`, Pattern: `Identified by\b`},
+		{Name: `DerivedFrom`, Pattern: `Derived from\b`},
+		{Name: `HoldsWhen`, Pattern: `Holds when\b`},
+		{Name: `ConditionedBy`, Pattern: `Conditioned by\b`},
+		{Name: `ViolatedWhen`, Pattern: `Violated when\b`},
+		{Name: `Placeholder`, Pattern: `Placeholder\b`},
+		{Name: `Predicate`, Pattern: `Predicate\b`},
+		{Name: `Invariant`, Pattern: `Invariant\b`},
+		{Name: `Event`, Pattern: `Event\b`},
+		{Name: `Duty`, Pattern: `Duty\b`},
+		{Name: `RelatedTo`, Pattern: `Related to\b`},
+		{Name: `SyncsWith`, Pattern: `Syncs with\b`},
+		{Name: `Creates`, Pattern: `Creates\b`},
+		{Name: `Holds`, Pattern: `Holds\b`},
+		{Name: `Enabled`, Pattern: `Enabled\b`},
+		{Name: `Terminates`, Pattern: `Terminates\b`},
+		{Name: `Obfuscates`, Pattern: `Obfuscates\b`},
+		{Name: `Actor`, Pattern: `Actor\b`},
+		{Name: `Act`, Pattern: `Act\b`},
+		{Name: `Recipient`, Pattern: `Recipient\b`},
+		{Name: `Extend`, Pattern: `Extend\b`},
+		{Name: `Holder`, Pattern: `Holder\b`},
+		{Name: `Claimant`, Pattern: `Claimant\b`},
+
+		{Name: `Foreach`, Pattern: `Foreach\b`},
+		{Name: `Forall`, Pattern: `Forall\b`},
+		{Name: `For`, Pattern: `For\b`},
+		{Name: `When`, Pattern: `When\b`},
 
 		// Iterators
-		{`Count`, `Count`},
-		{`Sum`, `Sum`},
-		{`Max`, `Max`},
-		{`Min`, `Min`},
-
-		{`Not`, `Not`},
-
-		{`True`, `True`},
-		{`False`, `False`},
-		{`OR`, `\|\|`},
-		{`AND`, `&&`},
-		{`EQ`, `==`},
-		{`NEQ`, `!=`},
-		{`GTE`, `>=`},
-		{`LTE`, `<=`},
-		{`GT`, `>`},
-		{`LT`, `<`},
-		{`NOT`, `NOT`},
-		{`Neg`, `!`},
-
-		{`Int`, `[0-9]+`},
-		{`String`, `([A-Z][a-z0-9]*)|"([A-Z][a-z0-9]*)"`},
+		{Name: `Count`, Pattern: `Count\b`},
+		{Name: `Sum`, Pattern: `Sum\b`},
+		{Name: `Max`, Pattern: `Max\b`},
+		{Name: `Min`, Pattern: `Min\b`},
+
+		{Name: `Not`, Pattern: `Not\b`},
+
+		{Name: `True`, Pattern: `True\b`},
+		{Name: `False`, Pattern: `False\b`},
+		{Name: `OR`, Pattern: `\|\|`},
+		{Name: `AND`, Pattern: `&&`},
+		{Name: `EQ`, Pattern: `==`},
+		{Name: `NEQ`, Pattern: `!=`},
+		{Name: `GTE`, Pattern: `>=`},
+		{Name: `LTE`, Pattern: `<=`},
+		{Name: `GT`, Pattern: `>`},
+		{Name: `LT`, Pattern: `<`},
+		{Name: `NOT`, Pattern: `NOT\b`},
+		{Name: `Neg`, Pattern: `!`},
+
+		{Name: `Int`, Pattern: `[0-9]+`},
+		{Name: `String`, Pattern: `[A-Z][a-zA-Z0-9_]*`},
+		{Name: `QuotedString`, Pattern: `"(\\.|[^"\\\n])*"`},
 
 		// Statements
-		{`IqueryHolds`, `\?--`},
-		{`Iquery`, `\?-`},
-		{`Bquery`, `\?`},
-		{`Create`, `\+`},
-		{`Obfuscate`, `~`},
-		{`Terminate`, `-`},
-
-		{`Comma`, `,`},
-		{`Star`, `\*`},
-		{`Dot`, `\.`},
-		{`Quote`, `\'`},
-		{`Div`, `/`},
-		{`Mod`, `%`},
-		{`LParen`, `\(`},
-		{`RParen`, `\)`},
-		{`Colon`, `:`},
-		{"comment", `[#;][^\n]*`},
-		{"Newline", `\n`},
+		{Name: `IqueryHolds`, Pattern: `\?--`},
+		{Name: `Iquery`, Pattern: `\?-`},
+		{Name: `Bquery`, Pattern: `\?`},
+		{Name: `Create`, Pattern: `\+`},
+		{Name: `Obfuscate`, Pattern: `~`},
+		{Name: `Terminate`, Pattern: `-`},
+
+		{Name: `Comma`, Pattern: `,`},
+		{Name: `Star`, Pattern: `\*`},
+		{Name: `Dot`, Pattern: `\.`},
+		{Name: `Quote`, Pattern: `\'`},
+		{Name: `Div`, Pattern: `/`},
+		{Name: `Mod`, Pattern: `%`},
+		{Name: `LParen`, Pattern: `\(`},
+		{Name: `RParen`, Pattern: `\)`},
+		{Name: `Colon`, Pattern: `:`},
+		{Name: `Directive`, Pattern: `#(include|require)\b`},
+		{Name: "comment", Pattern: `[#;][^\n]*`},
+		{Name: "Newline", Pattern: `\n`},
 	})
 	parser = participle.MustBuild[Input](
 		participle.Lexer(eflintLexer),
-		participle.Union[Phrase](Fact{}, Query{}, Statement{}, Placeholder{}, Predicate{}, Event{}, Act{}, Duty{}, ExtendFactDuty{}, ExtendEventAct{}),
+		participle.Union[Phrase](Fact{}, Query{}, Statement{}, Placeholder{}, Predicate{}, Event{}, Act{}, Duty{}, ExtendFactDuty{}, ExtendEventAct{}, Include{}),
 		participle.Union[Range](String{}, Int{}),
 		participle.ParseTypeWith[Expression](parseExpression),
 		participle.Elide("Comment"),
+		participle.Map(decorate, "FactID"),
+		participle.Map(unescape, "EscapedFactID"),
+		participle.Map(unquote, "QuotedString"),
 	)
 	version = "0.1.0"
 	kind    = "phrases"
@@ -149,14 +159,123 @@ var (
 		"MIN":   "MIN",
 		"COUNT": "COUNT",
 
-		"HOLDS":   "HOLDS",
-		"ENABLED": "ENABLED",
-		"NOT":     "NOT",
+		"HOLDS":    "HOLDS",
+		"ENABLED":  "ENABLED",
+		"VIOLATED": "VIOLATED",
+		"PRESENT":  "PRESENT",
+		"ABSENT":   "ABSENT",
+		"NOT":      "NOT",
+		"ABS":      "ABS",
+		"NEG":      "NEG",
+		"IF":       "IF",
+	}
+
+	// functions are the operators that are applied like a constructor, and
+	// whether their operand must be a Foreach
+	functions = map[string]bool{
+		"Count":    true,
+		"Sum":      true,
+		"Min":      true,
+		"Max":      true,
+		"Holds":    false,
+		"Enabled":  false,
+		"Violated": false,
+		"Present":  false,
+		"Absent":   false,
+		"Not":      false,
+		"Abs":      false,
 	}
 )
 
 type precedence struct{ Left, Right int }
 
+// isFunction returns whether the next token is the name of a function. Names
+// that are not keywords, such as Present, are only functions when they are
+// applied, and strings otherwise. A quoted string is never a function.
+func isFunction(lex *lexer.PeekingLexer) bool {
+	token := lex.Peek()
+	if _, ok := functions[token.Value]; !ok || token.Type == eflintLexer.Symbols()["QuotedString"] {
+		return false
+	}
+
+	return token.Type != eflintLexer.Symbols()["String"] || peekAfter(lex).Value == "("
+}
+
+// isKeyword returns whether the next token is a keyword that the lexer reads
+// as a string, such as If and Exists, because it is followed by a token that
+// cannot follow a string.
+func isKeyword(lex *lexer.PeekingLexer, keyword string) bool {
+	token := lex.Peek()
+	if token.Type != eflintLexer.Symbols()["String"] || token.Value != keyword {
+		return false
+	}
+
+	after := peekAfter(lex)
+	if keyword == "Exists" {
+		return after.Type == eflintLexer.Symbols()["FactID"] || after.Type == eflintLexer.Symbols()["DecoratedFactID"]
+	}
+
+	return startsExpression(after)
+}
+
+// startsExpression returns whether an expression can start with a token.
+func startsExpression(token *lexer.Token) bool {
+	symbols := eflintLexer.Symbols()
+	switch token.Type {
+	case symbols["FactID"], symbols["DecoratedFactID"], symbols["String"], symbols["QuotedString"], symbols["Int"],
+		symbols["True"], symbols["False"], symbols["LParen"], symbols["Neg"], symbols["Terminate"],
+		symbols["Foreach"], symbols["Forall"]:
+		return true
+	}
+
+	_, ok := functions[token.Value]
+	return ok
+}
+
+// peekAfter returns the token after the next one, without consuming either.
+func peekAfter(lex *lexer.PeekingLexer) *lexer.Token {
+	checkpoint := lex.MakeCheckpoint()
+	lex.Next()
+	token := lex.Peek()
+	lex.LoadCheckpoint(checkpoint)
+
+	return token
+}
+
+// decorate marks identifiers that end with digits or primes, such as person1
+// and person', as decorated. Decorated identifiers refer to the fact without
+// the decoration, and cannot be declared or applied themselves.
+func decorate(token lexer.Token) (lexer.Token, error) {
+	if strings.TrimRight(token.Value, "'0123456789") != token.Value {
+		token.Type = eflintLexer.Symbols()["DecoratedFactID"]
+	}
+
+	return token, nil
+}
+
+// unescape turns an escaped identifier such as [natural person] into an
+// identifier, which is never decorated.
+func unescape(token lexer.Token) (lexer.Token, error) {
+	token.Type = eflintLexer.Symbols()["FactID"]
+	token.Value = strings.TrimSpace(strings.Trim(token.Value, "[]"))
+
+	return token, nil
+}
+
+// unquote turns a string literal into a string, in which the escapes of Go
+// string literals, such as \" and \n, are replaced. The token stays a
+// QuotedString, so that a quoted keyword such as "Count" remains a string.
+func unquote(token lexer.Token) (lexer.Token, error) {
+	value, err := strconv.Unquote(token.Value)
+	if err != nil {
+		return token, participle.Errorf(token.Pos, "invalid string %s", token.Value)
+	}
+
+	token.Value = value
+
+	return token, nil
+}
+
 type Input struct {
 	Version string   `json:"version" parser:""`
 	Kind    string   `json:"kind"    parser:""`
@@ -184,6 +303,8 @@ type Fact struct {
 	HoldsWhen     []Expression  `json:"holds-when,omitempty"     parser:"| (HoldsWhen @@ (Comma @@)*)"`
 	ConditionedBy []Expression  `json:"conditioned-by,omitempty" parser:"| (ConditionedBy @@ (Comma @@)*) )*"`
 	Tokens        []lexer.Token `json:"-" parser:""`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (f Fact) phrase() {}
@@ -194,6 +315,8 @@ type Query struct {
 	Updates   bool       `json:"updates,omitempty"        parser:""`
 	WhenTrue  bool       `json:"when-true,omitempty"     parser:""`
 	Operand   Expression `json:"expression"               parser:"@@"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (q Query) phrase() {}
@@ -201,6 +324,8 @@ func (q Query) phrase() {}
 type Statement struct {
 	Kind    string     `json:"kind"    parser:"(@(Create | Obfuscate | Terminate))?"`
 	Operand Expression `json:"operand" parser:"@@"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (s Statement) phrase() {}
@@ -209,6 +334,8 @@ type Placeholder struct {
 	Kind string   `json:"kind" parser:"Placeholder"`
 	Name []string `json:"name" parser:"@FactID"`
 	For  string   `json:"for"  parser:"For @FactID"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (p Placeholder) phrase() {}
@@ -225,6 +352,8 @@ type Predicate struct {
 	IsInvariant IsInvariant `json:"is-invariant,omitempty" parser:"@(Invariant | Predicate)"`
 	Name        string      `json:"name"                   parser:"@FactID"`
 	Expression  Expression  `json:"expression"             parser:"When @@"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (p Predicate) phrase() {}
@@ -240,6 +369,8 @@ type Event struct {
 	Creates       []Expression `json:"creates,omitempty"        parser:"| (Creates       @@ (Comma @@)*)"`
 	Terminates    []Expression `json:"terminates,omitempty"     parser:"| (Terminates    @@ (Comma @@)*)"`
 	Obfuscates    []Expression `json:"obfuscates,omitempty"     parser:"| (Obfuscates    @@ (Comma @@)*) )*"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (e Event) phrase() {}
@@ -257,6 +388,8 @@ type Act struct {
 	Creates       []Expression `json:"creates,omitempty"        parser:"| (Creates       @@ (Comma @@)*)"`
 	Terminates    []Expression `json:"terminates,omitempty"     parser:"| (Terminates    @@ (Comma @@)*)"`
 	Obfuscates    []Expression `json:"obfuscates,omitempty"     parser:"| (Obfuscates    @@ (Comma @@)*) )*"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (a Act) phrase() {}
@@ -281,6 +414,8 @@ type Duty struct {
 	HoldsWhen     []Expression `json:"holds-when,omitempty"     parser:"| (HoldsWhen     @@ (Comma @@)*)"`
 	ConditionedBy []Expression `json:"conditioned-by,omitempty" parser:"| (ConditionedBy @@ (Comma @@)*) )*"`
 	ViolatedWhen  []Expression `json:"violated-when,omitempty"  parser:"(ViolatedWhen @@ (Comma @@)*)*"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (d Duty) phrase() {}
@@ -292,6 +427,8 @@ type ExtendFactDuty struct {
 	DerivedFrom   []Expression `json:"derived-from,omitempty"   parser:"( (DerivedFrom @@ (Comma @@)*)"`
 	HoldsWhen     []Expression `json:"holds-when,omitempty"     parser:"| (HoldsWhen @@ (Comma @@)*)"`
 	ConditionedBy []Expression `json:"conditioned-by,omitempty" parser:"| (ConditionedBy @@ (Comma @@)*) )*"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (e ExtendFactDuty) phrase() {}
@@ -307,17 +444,31 @@ type ExtendEventAct struct {
 	Creates       []Expression `json:"creates,omitempty"        parser:"| (Creates       @@ (Comma @@)*)"`
 	Terminates    []Expression `json:"terminates,omitempty"     parser:"| (Terminates    @@ (Comma @@)*)"`
 	Obfuscates    []Expression `json:"obfuscates,omitempty"     parser:"| (Obfuscates    @@ (Comma @@)*) )*"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (e ExtendEventAct) phrase() {}
 
+// Include is an #include or #require directive. Directives are replaced by
+// the phrases of the file they refer to while parsing, so they never end up in
+// the input.
+type Include struct {
+	Kind string `json:"kind" parser:"@Directive"`
+	File string `json:"file" parser:"@(String | QuotedString)"`
+
+	Pos lexer.Position `json:"-" parser:""`
+}
+
+func (i Include) phrase() {}
+
 type Expression interface {
 	expression()
 }
 
 func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 	switch peek := lex.Peek(); {
-	case peek.Value == "Foreach" || peek.Value == "Exists" || peek.Value == "Forall":
+	case peek.Type == eflintLexer.Symbols()["Foreach"] || peek.Type == eflintLexer.Symbols()["Forall"] || isKeyword(lex, "Exists"):
 		lex.Next()
 
 		binds := make([]string, 0)
@@ -349,8 +500,34 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 			Iterator:   strings.ToUpper(peek.Value),
 			Binds:      binds,
 			Expression: expr,
+			Pos:        peek.Pos,
+		}, nil
+	case isKeyword(lex, "If"):
+		lex.Next()
+
+		operands := make([]Expression, 0, 3)
+		for _, keyword := range []string{"Then", "Else", ""} {
+			expr, err := parseExpression(lex)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, expr)
+
+			if keyword != "" {
+				if next := lex.Peek(); next.Type != eflintLexer.Symbols()["String"] || next.Value != keyword {
+					return nil, participle.Errorf(lex.Peek().Pos, "expected %s", keyword)
+				}
+				lex.Next()
+			}
+		}
+
+		return Conditional{
+			Condition: operands[0],
+			Then:      operands[1],
+			Else:      operands[2],
+			Pos:       peek.Pos,
 		}, nil
-	case peek.Value == "Count" || peek.Value == "Sum" || peek.Value == "Min" || peek.Value == "Max" || peek.Value == "Holds" || peek.Value == "Enabled" || peek.Value == "Not":
+	case isFunction(lex):
 		lex.Next()
 
 		if lex.Peek().Value != "(" {
@@ -359,7 +536,7 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 
 		lex.Next()
 
-		if peek.Value != "Holds" && peek.Value != "Not" && peek.Value != "Enabled" && lex.Peek().Value != "Foreach" {
+		if functions[peek.Value] && lex.Peek().Type != eflintLexer.Symbols()["Foreach"] {
 			return nil, participle.Errorf(lex.Peek().Pos, "expected Foreach")
 		}
 
@@ -378,6 +555,7 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 			Left:     expr,
 			Operator: strings.ToUpper(peek.Value),
 			Right:    nil,
+			Pos:      peek.Pos,
 		}, nil
 
 	case peek.Type == eflintLexer.Symbols()["FactID"] || peek.Type == eflintLexer.Symbols()["DecoratedFactID"]:
@@ -396,6 +574,7 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 					return ConstructorApplication{
 						Identifier: id.Value,
 						Operands:   []Expression{},
+						Pos:        id.Pos,
 					}, nil
 				}
 				return nil, err
@@ -418,24 +597,25 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 			return ConstructorApplication{
 				Identifier: id.Value,
 				Operands:   operands,
+				Pos:        id.Pos,
 			}, nil
 		}
 
-		return Reference{id.Value}, nil
-	case peek.Type == eflintLexer.Symbols()["String"]:
-		return String{strings.Trim(lex.Next().Value, "\"")}, nil
+		return Reference{Value: id.Value, Pos: id.Pos}, nil
+	case peek.Type == eflintLexer.Symbols()["String"] || peek.Type == eflintLexer.Symbols()["QuotedString"]:
+		return String{Value: lex.Next().Value, Pos: peek.Pos}, nil
 	case peek.Type == eflintLexer.Symbols()["Int"]:
 		val, err := strconv.ParseInt(lex.Next().Value, 10, 64)
 		if err != nil {
 			return nil, err
 		}
-		return Int{val}, nil
+		return Int{Value: val, Pos: peek.Pos}, nil
 	case peek.Type == eflintLexer.Symbols()["True"] || peek.Type == eflintLexer.Symbols()["False"]:
 		val, err := strconv.ParseBool(lex.Next().Value)
 		if err != nil {
 			return nil, err
 		}
-		return Bool{val}, nil
+		return Bool{Value: val, Pos: peek.Pos}, nil
 	case peek.Value == "(":
 		lex.Next()
 		expr, err := parseExpression(lex)
@@ -457,6 +637,19 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 			Left:     expr,
 			Operator: "!",
 			Right:    nil,
+			Pos:      peek.Pos,
+		}, nil
+	case peek.Value == "-":
+		lex.Next()
+		expr, err := parseExpressionAtom(lex)
+		if err != nil {
+			return nil, err
+		}
+		return Operator{
+			Left:     expr,
+			Operator: "NEG",
+			Right:    nil,
+			Pos:      peek.Pos,
 		}, nil
 	default:
 		return nil, participle.NextMatch
@@ -464,6 +657,7 @@ func parseExpressionAtom(lex *lexer.PeekingLexer) (Expression, error) {
 }
 
 func parseExpressionPrec(lex *lexer.PeekingLexer, minPrec int) (Expression, error) {
+	start := lex.Peek().Pos
 	lhs, err := parseExpressionAtom(lex)
 	if err != nil {
 		return nil, err
@@ -481,13 +675,14 @@ func parseExpressionPrec(lex *lexer.PeekingLexer, minPrec int) (Expression, erro
 		if err != nil {
 			return nil, err
 		}
-		lhs = Operator{lhs, op, rhs}
+		lhs = Operator{Left: lhs, Operator: op, Right: rhs, Pos: start}
 	}
 
 	return lhs, nil
 }
 
 func parseExpression(lex *lexer.PeekingLexer) (Expression, error) {
+	start := lex.Peek().Pos
 	expr, err := parseExpressionPrec(lex, 0)
 
 	if err != nil {
@@ -496,20 +691,21 @@ func parseExpression(lex *lexer.PeekingLexer) (Expression, error) {
 
 	if lex.Peek().Value == "." {
 		// TODO: Projections are ambiguous due to triggers.
+		check := lex.MakeCheckpoint()
 		lex.Next()
 		if lex.Peek().Type == eflintLexer.Symbols()["FactID"] || lex.Peek().Type == eflintLexer.Symbols()["DecoratedFactID"] {
-			check := lex.MakeCheckpoint()
-
 			id := lex.Next()
 			if lex.Peek().Value != "(" {
 				return Projection{
 					Parameter: id.Value,
 					Operand:   expr,
+					Pos:       start,
 				}, nil
 			}
-
-			lex.LoadCheckpoint(check)
 		}
+
+		// The dot ends the phrase instead
+		lex.LoadCheckpoint(check)
 	} else if lex.Peek().Value == "When" {
 		lex.Next()
 		rhs, err := parseExpression(lex)
@@ -520,6 +716,7 @@ func parseExpression(lex *lexer.PeekingLexer) (Expression, error) {
 			Left:     expr,
 			Operator: "WHEN",
 			Right:    rhs,
+			Pos:      start,
 		}, nil
 	}
 
@@ -530,12 +727,16 @@ type Iterator struct { // TODO: Only a foreach can be inside an iterator
 	Iterator   string     `json:"iterator"`
 	Binds      []string   `json:"binds"`
 	Expression Expression `json:"expression"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (i Iterator) expression() {}
 
 type String struct {
-	Value string `parser:"@String"`
+	Value string `parser:"@(String | QuotedString)"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (s String) expression() {}
@@ -547,6 +748,8 @@ func (s String) MarshalJSON() ([]byte, error) {
 
 type Int struct {
 	Value int64 `parser:"@Int"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (i Int) expression() {}
@@ -558,6 +761,8 @@ func (i Int) MarshalJSON() ([]byte, error) {
 
 type Bool struct {
 	Value bool
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (b Bool) expression() {}
@@ -568,6 +773,8 @@ func (b Bool) MarshalJSON() ([]byte, error) {
 
 type Reference struct {
 	Value string `parser:"@FactID"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (r Reference) expression() {}
@@ -579,6 +786,8 @@ func (r Reference) MarshalJSON() ([]byte, error) {
 type ConstructorApplication struct {
 	Identifier string       `json:"identifier" parser:"@FactID"`
 	Operands   []Expression `json:"operands"   parser:"( LParen (@@ (Comma @@)*)? RParen )+"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (c ConstructorApplication) expression() {}
@@ -587,6 +796,8 @@ type Operator struct {
 	Left     Expression `json:"left"`
 	Operator string     `json:"operator"`
 	Right    Expression `json:"right"`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (o Operator) expression() {}
@@ -611,9 +822,32 @@ func (o Operator) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// Conditional is If condition Then expression Else expression.
+type Conditional struct {
+	Condition Expression
+	Then      Expression
+	Else      Expression
+
+	Pos lexer.Position `json:"-" parser:""`
+}
+
+func (c Conditional) expression() {}
+
+func (c Conditional) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Operator string       `json:"operator"`
+		Operands []Expression `json:"operands"`
+	}{
+		Operator: "IF",
+		Operands: []Expression{c.Condition, c.Then, c.Else},
+	})
+}
+
 type Projection struct {
 	Parameter string     `json:"parameter" parser:""`
 	Operand   Expression `json:"operand" parser:""`
+
+	Pos lexer.Position `json:"-" parser:""`
 }
 
 func (p Projection) expression() {}
@@ -636,9 +870,10 @@ func parseRangeValues(r []Range, tokens []lexer.Token) ([]Range, error) {
 				return nil, fmt.Errorf("invalid range")
 			}
 
-			r = []Range{Int{lower}}
+			pos := r[0].(Int).Pos
+			r = []Range{Int{Value: lower, Pos: pos}}
 			for i := lower + 1; i <= upper; i++ {
-				r = append(r, Int{i})
+				r = append(r, Int{Value: i, Pos: pos})
 			}
 		}
 	}
@@ -669,109 +904,255 @@ func parseRangeType(r []Range) (string, bool) {
 	return rangeType, true
 }
 
-func ParseFile(filename string, file *os.File) ([]byte, error) {
+// Diagnostic is a problem in a source file in eFLINT syntax, at the position of
+// the token that caused it.
+type Diagnostic struct {
+	Pos     lexer.Position
+	Message string
+}
+
+// Error formats the diagnostic in the form "[<filename>:][<line>:<column>:] <message>".
+func (d Diagnostic) Error() string {
+	position := ""
+	if d.Pos.Filename != "" {
+		position += d.Pos.Filename + ":"
+	}
+	if d.Pos.Line != 0 || d.Pos.Column != 0 {
+		position += fmt.Sprintf("%d:%d:", d.Pos.Line, d.Pos.Column)
+	}
+
+	if position == "" {
+		return d.Message
+	}
+
+	return position + " " + d.Message
+}
+
+// Parse parses a source file in eFLINT syntax. The phrases of the input are
+// completed with the fields that are implied by the syntax, such as their
+// kinds. If the file contains a syntax error, only that error is returned and
+// the input is nil, otherwise every phrase that is not valid gets its own
+// diagnostic. Included files are read from disk, see ParseWith.
+func Parse(filename string, file io.Reader) (*Input, []Diagnostic) {
+	return ParseWith(filename, file, OpenFile)
+}
+
+// ParseWith parses a source file in eFLINT syntax like Parse, and replaces
+// every #include and #require directive by the phrases of the file it refers
+// to, which is opened by load. A file that is included by itself, directly or
+// through other files, is reported as a cycle. If load is nil, directives are
+// not allowed.
+func ParseWith(filename string, file io.Reader, load Loader) (ini *Input, diagnostics []Diagnostic) {
+	// The parser should return an error for any input, but editors call it on
+	// every keystroke, so a bug in it must not take them down
+	defer func() {
+		if p := recover(); p != nil {
+			ini = nil
+			diagnostics = []Diagnostic{{Pos: lexer.Position{Filename: filename}, Message: fmt.Sprintf("internal error: %v", p)}}
+		}
+	}()
+
+	includes := &includer{load: load, required: map[string]bool{filepath.Clean(filename): true}}
+	phrases, diagnostics, ok := includes.parse(filename, file, nil)
+	if !ok {
+		return nil, diagnostics
+	}
+
+	return &Input{Version: version, Kind: kind, Phrases: phrases, Updates: updates}, diagnostics
+}
+
+// parseSource parses a single source file, without resolving its directives.
+func parseSource(filename string, file io.Reader) (ini *Input, diagnostics []Diagnostic) {
 	ini, err := parser.Parse(filename, file)
 	if err != nil {
-		panic(err)
+		var located participle.Error
+		if errors.As(err, &located) {
+			return nil, []Diagnostic{{Pos: located.Position(), Message: located.Message()}}
+		}
+
+		return nil, []Diagnostic{{Pos: lexer.Position{Filename: filename}, Message: err.Error()}}
 	}
-	// Add metadata
-	ini.Version = version
-	ini.Kind = kind
-	ini.Updates = updates
 
 	// Fill in missing fields
-	for i, phrase := range (*ini).Phrases {
-		switch phrase.(type) {
-		case Fact:
-			f := phrase.(Fact)
-			if len(f.IdentifiedBy) > 0 {
-				// Composite fact
-				f.Kind = "cfact"
-			} else {
-				// Atomic fact
-				f.Kind = "afact"
-
-				if f.Type == "" {
-					if len(f.Range) > 0 {
-						rangeType, ok := parseRangeType(f.Range)
-						if !ok {
-							panic("range type mismatch")
-						}
-						f.Type = rangeType
-						rangeValues, err := parseRangeValues(f.Range, f.Tokens)
-						if err != nil {
-							panic(err)
-						}
-						f.Range = rangeValues
-					} else {
-						f.Type = "String"
+	for i, phrase := range ini.Phrases {
+		completed, err := completePhrase(phrase)
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{Pos: PhrasePosition(phrase), Message: err.Error()})
+			continue
+		}
+
+		ini.Phrases[i] = completed
+	}
+
+	return ini, diagnostics
+}
+
+// ParseFile parses a source file in eFLINT syntax and returns its phrases in
+// the JSON format of the server, together with their positions. Only the
+// first diagnostic is returned.
+func ParseFile(filename string, file io.Reader) ([]byte, error) {
+	ini, diagnostics := Parse(filename, file)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics[0]
+	}
+
+	return eflint.MarshalLocated(Convert(ini), "  ")
+}
+
+// PhrasePosition returns the position at which a phrase starts.
+func PhrasePosition(phrase Phrase) lexer.Position {
+	switch p := phrase.(type) {
+	case Fact:
+		return p.Pos
+	case Query:
+		return p.Pos
+	case Statement:
+		return p.Pos
+	case Placeholder:
+		return p.Pos
+	case Predicate:
+		return p.Pos
+	case Event:
+		return p.Pos
+	case Act:
+		return p.Pos
+	case Duty:
+		return p.Pos
+	case ExtendFactDuty:
+		return p.Pos
+	case ExtendEventAct:
+		return p.Pos
+	case Include:
+		return p.Pos
+	}
+
+	return lexer.Position{}
+}
+
+// ExpressionPosition returns the position at which an expression starts.
+func ExpressionPosition(expression Expression) lexer.Position {
+	switch e := expression.(type) {
+	case String:
+		return e.Pos
+	case Int:
+		return e.Pos
+	case Bool:
+		return e.Pos
+	case Reference:
+		return e.Pos
+	case ConstructorApplication:
+		return e.Pos
+	case Operator:
+		return e.Pos
+	case Iterator:
+		return e.Pos
+	case Conditional:
+		return e.Pos
+	case Projection:
+		return e.Pos
+	}
+
+	return lexer.Position{}
+}
+
+// completePhrase fills in the fields of a phrase that are implied by its
+// syntax.
+func completePhrase(phrase Phrase) (Phrase, error) {
+	switch phrase.(type) {
+	case Fact:
+		f := phrase.(Fact)
+		if len(f.IdentifiedBy) > 0 {
+			// Composite fact
+			f.Kind = "cfact"
+		} else {
+			// Atomic fact
+			f.Kind = "afact"
+
+			if f.Type == "" {
+				if len(f.Range) > 0 {
+					rangeType, ok := parseRangeType(f.Range)
+					if !ok {
+						return nil, fmt.Errorf("range of fact %s mixes strings and integers", f.Name)
+					}
+					f.Type = rangeType
+					rangeValues, err := parseRangeValues(f.Range, f.Tokens)
+					if err != nil {
+						return nil, err
 					}
+					f.Range = rangeValues
+				} else {
+					f.Type = "String"
 				}
 			}
+		}
 
-			ini.Phrases[i] = f
-		case Query:
-			q := phrase.(Query)
-			if q.Kind == "?" {
-				q.Kind = "bquery"
-			} else if q.Kind == "?-" {
-				q.Kind = "iquery"
-			} else if q.Kind == "?--" {
-				q.Kind = "iquery"
-				q.WhenTrue = true
-			} else {
-				panic("unknown query type")
-			}
-			ini.Phrases[i] = q
-		case Statement:
-			s := phrase.(Statement)
-			if s.Kind == "+" {
-				s.Kind = "create"
-			} else if s.Kind == "-" {
-				s.Kind = "terminate"
-			} else if s.Kind == "~" {
-				s.Kind = "obfuscate"
-			} else {
-				s.Kind = "trigger"
-			}
-			ini.Phrases[i] = s
-		case Placeholder:
-			p := phrase.(Placeholder)
-			p.Kind = "placeholder"
-			ini.Phrases[i] = p
-		case Predicate:
-			p := phrase.(Predicate)
-			p.Kind = "predicate"
-			ini.Phrases[i] = p
-		case Event:
-			e := phrase.(Event)
-			e.Kind = "event"
-			ini.Phrases[i] = e
-		case Act:
-			a := phrase.(Act)
-			a.Kind = "act"
-			if a.Recipient != "" {
-				a.RelatedTo = append([]string{a.Recipient}, a.RelatedTo...)
-			}
-			if a.Actor == "" {
-				a.Actor = "actor"
-			}
-			ini.Phrases[i] = a
-		case Duty:
-			d := phrase.(Duty)
-			d.Kind = "duty"
-			ini.Phrases[i] = d
-		case ExtendEventAct:
-			e := phrase.(ExtendEventAct)
-			e.Kind = "extend"
-			ini.Phrases[i] = e
-		case ExtendFactDuty:
-			e := phrase.(ExtendFactDuty)
-			e.Kind = "extend"
-			e.ParentKind = strings.ToLower(e.ParentKind)
-			ini.Phrases[i] = e
+		return f, nil
+	case Query:
+		q := phrase.(Query)
+		if q.Kind == "?" {
+			q.Kind = "bquery"
+		} else if q.Kind == "?-" {
+			q.Kind = "iquery"
+		} else if q.Kind == "?--" {
+			q.Kind = "iquery"
+			q.WhenTrue = true
+		} else {
+			return nil, fmt.Errorf("unknown query type %s", q.Kind)
+		}
+		return q, nil
+	case Statement:
+		s := phrase.(Statement)
+		if s.Kind == "+" {
+			s.Kind = "create"
+		} else if s.Kind == "-" {
+			s.Kind = "terminate"
+		} else if s.Kind == "~" {
+			s.Kind = "obfuscate"
+		} else {
+			s.Kind = "trigger"
+		}
+		return s, nil
+	case Placeholder:
+		p := phrase.(Placeholder)
+		p.Kind = "placeholder"
+		return p, nil
+	case Predicate:
+		p := phrase.(Predicate)
+		p.Kind = "predicate"
+		return p, nil
+	case Event:
+		e := phrase.(Event)
+		e.Kind = "event"
+		return e, nil
+	case Act:
+		a := phrase.(Act)
+		a.Kind = "act"
+		if a.Recipient != "" {
+			a.RelatedTo = append([]string{a.Recipient}, a.RelatedTo...)
+		}
+		if a.Actor == "" {
+			a.Actor = "actor"
 		}
+		return a, nil
+	case Duty:
+		d := phrase.(Duty)
+		d.Kind = "duty"
+		return d, nil
+	case ExtendEventAct:
+		e := phrase.(ExtendEventAct)
+		e.Kind = "extend"
+		e.ParentKind = strings.ToLower(e.ParentKind)
+		return e, nil
+	case ExtendFactDuty:
+		e := phrase.(ExtendFactDuty)
+		e.Kind = "extend"
+		e.ParentKind = strings.ToLower(e.ParentKind)
+		return e, nil
+	case Include:
+		i := phrase.(Include)
+		i.Kind = strings.TrimPrefix(i.Kind, "#")
+		return i, nil
 	}
 
-	return json.MarshalIndent(ini, "", "  ")
+	return phrase, nil
 }
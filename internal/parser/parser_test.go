@@ -0,0 +1,327 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestConvert(t *testing.T) {
+	paths, _ := filepath.Glob("../../cmd/eflint-server/tests/*/*.eflint")
+	if len(paths) == 0 {
+		t.Fatal("Expected test files in cmd/eflint-server/tests")
+	}
+
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ini, diagnostics := Parse(path, strings.NewReader(string(source)))
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", path, diagnostics)
+			continue
+		}
+
+		// Decoding the JSON of a file must give the same phrases as the
+		// conversion, including the positions
+		data, err := ParseFile(path, strings.NewReader(string(source)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded eflint.Input
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(path, err)
+		}
+
+		converted := Convert(ini)
+		expected, _ := eflint.MarshalLocated(converted, "")
+		actual, _ := eflint.MarshalLocated(decoded, "")
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: expected the JSON to keep the positions, got:\n%s\nexpected:\n%s", path, actual, expected)
+		}
+
+		// The conversion must give the same phrases as the JSON of the
+		// parsed phrases, apart from the positions
+		tree, _ := json.Marshal(ini)
+		decoded = eflint.Input{}
+		if err := json.Unmarshal(tree, &decoded); err != nil {
+			t.Fatal(path, err)
+		}
+
+		for i := range converted.Phrases {
+			if converted.Phrases[i].Position == nil {
+				t.Errorf("%s: expected phrase %d to have a position", path, i+1)
+			}
+			converted.Phrases[i].Position = nil
+		}
+
+		expected, _ = json.Marshal(decoded)
+		actual, _ = json.Marshal(converted)
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: expected the conversion to match the JSON, got:\n%s\nexpected:\n%s", path, actual, expected)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	ini, diagnostics := Parse("case.eflint", strings.NewReader("Fact person Identified by String.\n+person(Alice"))
+	if ini != nil || len(diagnostics) != 1 {
+		t.Fatal("Expected a single syntax error, got", diagnostics)
+	}
+	if diagnostics[0].Error() != "case.eflint:2:14: expected )" {
+		t.Error("Expected a syntax error at the end of the file, got", diagnostics[0])
+	}
+
+	_, diagnostics = Parse("case.eflint", strings.NewReader("Fact age Identified by 1, Bob.\nFact size Identified by 5..1."))
+	if len(diagnostics) != 2 || diagnostics[0].Pos.Line != 1 || diagnostics[1].Pos.Line != 2 {
+		t.Fatal("Expected a diagnostic for every invalid range, got", diagnostics)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	ini, diagnostics := Parse("", strings.NewReader("Fact person Identified by String.\n?person(Alice) && True."))
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	query := ini.Phrases[1].(Query)
+	if position := PhrasePosition(query); position.Line != 2 || position.Column != 1 {
+		t.Error("Expected the query to start at 2:1, got", position)
+	}
+
+	and := query.Operand.(Operator)
+	application := and.Left.(ConstructorApplication)
+	if and.Pos.Column != 2 || application.Pos.Column != 2 || application.Operands[0].(String).Pos.Column != 9 || and.Right.(Bool).Pos.Column != 19 {
+		t.Errorf("Expected the positions of the expressions, got %v %v %v", and.Pos, application.Pos, and.Right.(Bool).Pos)
+	}
+
+	converted := Convert(ini).Phrases[1]
+	if *converted.Position != (eflint.Position{Line: 2, Column: 1}) || *converted.Expression.Operands[1].Position != (eflint.Position{Line: 2, Column: 19}) {
+		t.Error("Expected the positions to be converted, got", converted.Position, converted.Expression.Operands[1].Position)
+	}
+}
+
+func TestIdentifiersAndStrings(t *testing.T) {
+	ini, diagnostics := Parse("", strings.NewReader(`Fact [natural person] Identified by String.
+Fact art6-consent Identified by [natural person] * person'.
++art6-consent("Alice Smith", "GDPR-Art.6 \"lawful\"\n").
+?Holds(person1) && [article 6](Bob_2).
+Fact Factory`))
+	if ini != nil || len(diagnostics) != 1 || diagnostics[0].Pos.Line != 5 {
+		t.Fatal("Expected Factory not to be read as the keyword Fact, got", diagnostics)
+	}
+
+	ini, diagnostics = Parse("", strings.NewReader(`Fact [natural person] Identified by String.
+Fact art6-consent Identified by [natural person] * person'.
++art6-consent("Alice Smith", "GDPR-Art.6 \"lawful\"\n").
+?Holds(person1) && [article 6](Bob_2).`))
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	if name := ini.Phrases[0].(Fact).Name; name != "natural person" {
+		t.Errorf("Expected the escaped identifier natural person, got %q", name)
+	}
+	if params := ini.Phrases[1].(Fact).IdentifiedBy; params[0] != "natural person" || params[1] != "person'" {
+		t.Errorf("Expected the parameters natural person and person', got %q", params)
+	}
+
+	operands := ini.Phrases[2].(Statement).Operand.(ConstructorApplication).Operands
+	if operands[0].(String).Value != "Alice Smith" || operands[1].(String).Value != "GDPR-Art.6 \"lawful\"\n" {
+		t.Errorf("Expected the strings to be unquoted, got %q and %q", operands[0].(String).Value, operands[1].(String).Value)
+	}
+
+	and := ini.Phrases[3].(Query).Operand.(Operator)
+	if reference := and.Left.(Operator).Left.(Reference).Value; reference != "person1" {
+		t.Errorf("Expected the decorated reference person1, got %q", reference)
+	}
+	if application := and.Right.(ConstructorApplication); application.Identifier != "article 6" || application.Operands[0].(String).Value != "Bob_2" {
+		t.Errorf("Expected [article 6](Bob_2), got %v", application)
+	}
+
+	// Decorated identifiers cannot be applied
+	if _, diagnostics := Parse("", strings.NewReader("+person'(Alice).")); len(diagnostics) != 1 {
+		t.Error("Expected an error for the application of a decorated identifier")
+	}
+}
+
+func TestKeywordsAsStrings(t *testing.T) {
+	ini, diagnostics := Parse("", strings.NewReader(`Fact status Identified by Present, Absent, If, Then, Else, Exists, Abs, Violated.
+Fact x Identified by String.
++x("Count").
++x("Abs").
++x("If").
++x("Foreach").
++status(Present).
+?x(If) == x(Then) || status(Exists).
+?If Present(status(Absent)) Then Abs(-1) == 1 Else Exists x : x == x("Exists").`))
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	expected := []string{
+		`Fact status Identified by "Present", "Absent", "If", "Then", "Else", "Exists", "Abs", "Violated".`,
+		`Fact x Identified by String.`,
+		`+x("Count").`,
+		`+x("Abs").`,
+		`+x("If").`,
+		`+x("Foreach").`,
+		`+status("Present").`,
+		`?x("If") == x("Then") || status("Exists").`,
+		`?If Present(status("Absent")) Then Abs(-1) == 1 Else Exists x : x == x("Exists").`,
+	}
+
+	for i, phrase := range Convert(ini).Phrases {
+		if formatted, err := eflint.FormatPhrase(phrase); err != nil || formatted != expected[i] {
+			t.Errorf("Expected phrase %d to be %s, got %s (%v)", i, expected[i], formatted, err)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	library := Library(fstest.MapFS{
+		"definitions.eflint": {Data: []byte("Fact person Identified by String.")},
+		"gdpr/base.eflint":   {Data: []byte("#require \"../definitions.eflint\".\nFact consent Identified by person.")},
+		"gdpr/cycle.eflint":  {Data: []byte("#include \"../main.eflint\".")},
+		"gdpr/broken.eflint": {Data: []byte("Fact consent Identified by (")},
+	})
+
+	ini, diagnostics := ParseWith("main.eflint", strings.NewReader(`#require "definitions.eflint".
+#require "gdpr/base.eflint"
+#include "definitions.eflint".
++person(Alice).`), library)
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	names := make([]string, 0)
+	for _, phrase := range ini.Phrases {
+		if fact, ok := phrase.(Fact); ok {
+			names = append(names, fact.Name)
+		}
+	}
+	if len(ini.Phrases) != 4 || strings.Join(names, " ") != "person consent person" {
+		t.Fatal("Expected required files to be included once, got", ini.Phrases)
+	}
+	if position := PhrasePosition(ini.Phrases[1]); position.Filename != "gdpr/base.eflint" || position.Line != 2 {
+		t.Error("Expected the phrases to have the position in their own file, got", position)
+	}
+
+	tests := []struct {
+		directive string
+		message   string
+	}{
+		{`#include "gdpr/cycle.eflint".`, "1:1: cannot include main.eflint, it is included by itself: main.eflint -> gdpr/cycle.eflint -> main.eflint"},
+		{`#include "missing.eflint".`, "main.eflint:1:1: cannot include missing.eflint: file does not exist"},
+		{`#include "../secrets.eflint".`, "main.eflint:1:1: cannot include ../secrets.eflint: the file is outside of the library"},
+		{`#include "gdpr/broken.eflint".`, "gdpr/broken.eflint:1:28: unexpected token \"(\""},
+	}
+
+	for _, test := range tests {
+		_, diagnostics := ParseWith("main.eflint", strings.NewReader(test.directive), library)
+		if len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Error(), test.message) {
+			t.Errorf("Expected %s to fail with %q, got %v", test.directive, test.message, diagnostics)
+		}
+	}
+
+	if _, diagnostics := ParseWith("", strings.NewReader(`#include "definitions.eflint".`), nil); len(diagnostics) != 1 {
+		t.Error("Expected directives not to be allowed without a loader, got", diagnostics)
+	}
+}
+
+// reparse formats the phrases and parses them again.
+func reparse(t *testing.T, phrases []eflint.Phrase) []eflint.Phrase {
+	formatted := make([]string, 0, len(phrases))
+	for _, phrase := range phrases {
+		text, err := eflint.FormatPhrase(phrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted = append(formatted, text)
+	}
+
+	source := strings.Join(formatted, "\n")
+	ini, diagnostics := Parse("", strings.NewReader(source))
+	if len(diagnostics) > 0 {
+		t.Fatalf("%v in:\n%s", diagnostics, source)
+	}
+
+	return Convert(ini).Phrases
+}
+
+// samePhrases compares phrases apart from their positions.
+func samePhrases(a []eflint.Phrase, b []eflint.Phrase) bool {
+	for _, phrases := range [][]eflint.Phrase{a, b} {
+		for i := range phrases {
+			phrases[i].Position = nil
+		}
+	}
+
+	expected, _ := json.Marshal(a)
+	actual, _ := json.Marshal(b)
+	return bytes.Equal(expected, actual)
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	paths, _ := filepath.Glob("../../cmd/eflint-server/tests/*/*.eflint")
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ini, diagnostics := Parse(path, file)
+		file.Close()
+		if len(diagnostics) > 0 {
+			t.Fatal(path, diagnostics)
+		}
+
+		phrases := Convert(ini).Phrases
+		if reparsed := reparse(t, phrases); !samePhrases(phrases, reparsed) {
+			t.Errorf("%s: expected the formatted phrases to be parsed as the same phrases", path)
+		}
+	}
+}
+
+func TestFormatExpressions(t *testing.T) {
+	tests := map[string]string{
+		"(a || b) && c":                      "(a || b) && c",
+		"a || b && c":                        "a || b && c",
+		"(a - b) - c":                        "(a - b) - c",
+		"a - (b - c)":                        "a - b - c",
+		"(a == b) && !(c && d)":              "a == b && !(c && d)",
+		"(Exists x, y' : x(y')) && z":        "(Exists x, y' : x(y')) && z",
+		"z && Exists x : x":                  "z && Exists x : x",
+		"Count(Foreach x : x When x > 1)":    "Count(Foreach x : x When x > 1)",
+		"f((a When b), (c.d), [e f](\"g\"))": "f(a When b,c.d,[e f](\"g\"))",
+		"(a + b).c":                          "(a + b).c",
+		"Holds(f(True)) && Enabled(g(1))":    "Holds(f(True)) && Enabled(g(1))",
+		"(-a) + -(b.c)":                      "-a + -(b.c)",
+		"Abs(a - b) < c":                     "Abs(a - b) < c",
+		"(If a Then b Else c) + 1":           "(If a Then b Else c) + 1",
+		"1 + If a Then b Else c When d":      "1 + If a Then b Else c When d",
+		"Violated(f(a)) || !Absent(g(b))":    "Violated(f(a)) || !Absent(g(b))",
+	}
+
+	for source, expected := range tests {
+		ini, diagnostics := Parse("", strings.NewReader("?"+source+"."))
+		if len(diagnostics) > 0 {
+			t.Fatal(source, diagnostics)
+		}
+
+		phrases := Convert(ini).Phrases
+		if formatted := eflint.FormatExpression(*phrases[0].Expression); formatted != expected {
+			t.Errorf("Expected %s to be formatted as %s, got %s", source, expected, formatted)
+		}
+		if reparsed := reparse(t, phrases); !samePhrases(phrases, reparsed) {
+			t.Errorf("Expected %s to be parsed as the same expression after formatting", source)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+	"io"
+	"strings"
+)
+
+// Token is a token of a source file in eFLINT syntax.
+type Token struct {
+	// Type is the name of the rule of the lexer that matched the token, such
+	// as FactID or Fact.
+	Type  string
+	Value string
+	Pos   lexer.Position
+}
+
+// Identifier returns the name of the fact that an identifier refers to, as
+// it is written, and whether the token is an identifier at all.
+func (t Token) Identifier() (string, bool) {
+	switch t.Type {
+	case "FactID":
+		return t.Value, true
+	case "EscapedFactID":
+		return strings.TrimSpace(t.Value[1 : len(t.Value)-1]), true
+	}
+
+	return "", false
+}
+
+// Tokenize splits a source file in eFLINT syntax into its tokens, leaving out
+// comments. If part of the file cannot be split into tokens, the tokens before
+// it are returned together with the error.
+func Tokenize(filename string, source io.Reader) ([]Token, error) {
+	lex, err := eflintLexer.Lex(filename, source)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[lexer.TokenType]string)
+	for name, tokenType := range eflintLexer.Symbols() {
+		names[tokenType] = name
+	}
+
+	tokens := make([]Token, 0)
+	for {
+		token, err := lex.Next()
+		if err != nil {
+			return tokens, err
+		}
+		if token.EOF() {
+			return tokens, nil
+		}
+
+		if names[token.Type] != "Comment" {
+			tokens = append(tokens, Token{Type: names[token.Type], Value: token.Value, Pos: token.Pos})
+		}
+	}
+}
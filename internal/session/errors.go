@@ -0,0 +1,18 @@
+package session
+
+import "github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+
+// ErrUnknownSession is returned when no session exists with the given id.
+var ErrUnknownSession = eflint.Error{Id: "unknown-session", Message: "unknown session"}
+
+// ErrSessionExists is returned when a session is created with an id that is
+// already in use.
+var ErrSessionExists = eflint.Error{Id: "session-exists", Message: "session already exists"}
+
+// ErrSessionClosed is returned when a session is used after it was deleted,
+// by a request that got hold of it before.
+var ErrSessionClosed = eflint.Error{Id: "session-closed", Message: "session was deleted"}
+
+// ErrInvalidSession is returned when a session id cannot be used, for example
+// because it cannot be stored.
+var ErrInvalidSession = eflint.Error{Id: "invalid-session", Message: "invalid session id"}
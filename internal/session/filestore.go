@@ -0,0 +1,319 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore stores every session in a directory of its own. The phrases of
+// every request are appended to a write-ahead log, which is replaced by a
+// snapshot of the state every now and then:
+//   - session.json holds the id and creation time of the session, and
+//     whether it records its history
+//   - snapshot.json holds the last snapshot of the state
+//   - log.jsonl holds one line for every request after that snapshot
+//
+// Every request gets a sequence number and the snapshot records the last
+// request it includes. If the server stops after writing a snapshot but
+// before clearing the log, those requests are not interpreted twice.
+type FileStore struct {
+	dir string
+
+	lock      sync.Mutex
+	sequences map[string]int
+}
+
+type sessionFile struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	History bool      `json:"history,omitempty"`
+}
+
+type snapshotFile struct {
+	Sequence int          `json:"sequence"`
+	State    eflint.State `json:"state"`
+}
+
+type logEntry struct {
+	Sequence int             `json:"sequence"`
+	Phrases  []eflint.Phrase `json:"phrases"`
+}
+
+const (
+	sessionFileName  = "session.json"
+	snapshotFileName = "snapshot.json"
+	logFileName      = "log.jsonl"
+)
+
+// NewFileStore creates a store that keeps the sessions in the given
+// directory, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		dir:       dir,
+		sequences: make(map[string]int),
+	}, nil
+}
+
+// path returns the path of a file of the session. The id becomes the name of
+// a directory, so it must not be able to point anywhere else.
+func (f *FileStore) path(id string, name string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", ErrInvalidSession.Errorf("invalid session id: %q", id)
+	}
+
+	return filepath.Join(f.dir, id, name), nil
+}
+
+// nextSequence returns the sequence number for the next request of a session.
+func (f *FileStore) nextSequence(id string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.sequences[id]++
+	return f.sequences[id]
+}
+
+func (f *FileStore) sequence(id string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.sequences[id]
+}
+
+// writeFile replaces a file as a whole, so that a crash never leaves a file
+// that is only partly written.
+func writeFile(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// Create creates the directory of a new session.
+func (f *FileStore) Create(id string, created time.Time, history bool) error {
+	path, err := f.path(id, sessionFileName)
+	if err != nil {
+		return err
+	}
+
+	// Anything left behind by a session that was not created completely is
+	// discarded first
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.sequences[id] = 0
+	f.lock.Unlock()
+
+	return writeFile(path, sessionFile{Id: id, Created: created, History: history})
+}
+
+// Append adds the phrases of a request to the log of the session.
+func (f *FileStore) Append(id string, phrases []eflint.Phrase) error {
+	path, err := f.path(id, logFileName)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(logEntry{Sequence: f.nextSequence(id), Phrases: phrases})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// Snapshot writes the state of the session and clears its log.
+func (f *FileStore) Snapshot(id string, state eflint.State) error {
+	path, err := f.path(id, snapshotFileName)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(path, snapshotFile{Sequence: f.sequence(id), State: state}); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(filepath.Dir(path), logFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the directory of the session.
+func (f *FileStore) Delete(id string) error {
+	path, err := f.path(id, sessionFileName)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	delete(f.sequences, id)
+	f.lock.Unlock()
+
+	return os.RemoveAll(filepath.Dir(path))
+}
+
+// Load reads all sessions from the directory of the store.
+func (f *FileStore) Load() ([]Stored, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Stored, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		stored, err := f.load(entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			// The server stopped while the session was being created
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, stored)
+	}
+
+	return sessions, nil
+}
+
+func (f *FileStore) load(id string) (Stored, error) {
+	path, err := f.path(id, sessionFileName)
+	if err != nil {
+		return Stored{}, err
+	}
+	dir := filepath.Dir(path)
+
+	var session sessionFile
+	if err := readFile(path, &session); err != nil {
+		return Stored{}, err
+	}
+
+	stored := Stored{Id: session.Id, Created: session.Created, History: session.History}
+	sequence := 0
+
+	var snapshot snapshotFile
+	if err := readFile(filepath.Join(dir, snapshotFileName), &snapshot); err == nil {
+		stored.Snapshot = &snapshot.State
+		sequence = snapshot.Sequence
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return Stored{}, err
+	}
+
+	entries, err := readLog(filepath.Join(dir, logFileName))
+	if err != nil {
+		return Stored{}, err
+	}
+
+	for _, entry := range entries {
+		// Requests that are part of the snapshot already are skipped
+		if entry.Sequence <= sequence {
+			continue
+		}
+
+		stored.Requests = append(stored.Requests, entry.Phrases)
+		sequence = entry.Sequence
+	}
+
+	f.lock.Lock()
+	f.sequences[id] = sequence
+	f.lock.Unlock()
+
+	return stored, nil
+}
+
+func readFile(path string, value interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// readLog reads the entries of a log. A last line that is not complete is
+// removed, as the server stopped while it was written and the request was
+// never interpreted.
+func readLog(path string) ([]logEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]logEntry, 0)
+	reader := bufio.NewReader(file)
+	size := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return entries, os.Truncate(path, size)
+			}
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+		size += int64(len(line))
+	}
+}
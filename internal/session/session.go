@@ -0,0 +1,329 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a knowledge base that phrases can be sent to over multiple
+// requests. Every session has its own state, isolated from other sessions.
+// The engine of a session must only be used while holding its lock.
+type Session struct {
+	Id      string         `json:"id"`
+	Created time.Time      `json:"created"`
+	History bool           `json:"history"`
+	Engine  *eflint.Engine `json:"-"`
+
+	lock   sync.Mutex
+	closed bool
+
+	// Persistence of the session, store is nil for sessions in memory only
+	store            Store
+	snapshotInterval int
+	logged           int
+}
+
+// Lock acquires exclusive access to the engine of the session. It fails if
+// the session was deleted in the meantime, in which case the lock is not held.
+func (s *Session) Lock() error {
+	s.lock.Lock()
+
+	if s.closed {
+		s.lock.Unlock()
+		return ErrSessionClosed.Errorf("session %s was deleted", s.Id)
+	}
+
+	return nil
+}
+
+// Unlock releases the access to the engine of the session.
+func (s *Session) Unlock() {
+	s.lock.Unlock()
+}
+
+// Log records the phrases of a request in the store of the session before
+// they are interpreted. Queries and stateless phrases are left out, as they
+// do not change the state of the session.
+func (s *Session) Log(phrases []eflint.Phrase) error {
+	if s.store == nil {
+		return nil
+	}
+
+	changes := make([]eflint.Phrase, 0, len(phrases))
+	for _, phrase := range phrases {
+		if phrase.Stateless || phrase.Kind == "bquery" || phrase.Kind == "iquery" {
+			continue
+		}
+
+		changes = append(changes, phrase)
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := s.store.Append(s.Id, changes); err != nil {
+		return err
+	}
+
+	s.logged++
+
+	return nil
+}
+
+// Checkpoint stores a snapshot of the state of the session once enough
+// requests have been logged since the last one, so that recovering the
+// session does not require interpreting all of its requests again.
+func (s *Session) Checkpoint() error {
+	if s.store == nil || s.logged < s.snapshotInterval {
+		return nil
+	}
+
+	if err := s.store.Snapshot(s.Id, s.Engine.Snapshot()); err != nil {
+		return err
+	}
+
+	s.logged = 0
+
+	return nil
+}
+
+// Import replaces the state of the session by the one that is built up by the
+// phrases. The log of the session no longer applies to the new state, so a
+// snapshot of it is stored right away.
+func (s *Session) Import(phrases []eflint.Phrase) error {
+	if err := s.Engine.Import(phrases); err != nil {
+		return err
+	}
+
+	return s.replaced()
+}
+
+// Revert restores a state from the history of the session.
+func (s *Session) Revert(number int) error {
+	if err := s.Engine.Revert(number); err != nil {
+		return err
+	}
+
+	return s.replaced()
+}
+
+// Undo reverts the session to the state before the current one.
+func (s *Session) Undo() error {
+	if err := s.Engine.Undo(); err != nil {
+		return err
+	}
+
+	return s.replaced()
+}
+
+// Redo returns the session to the state after the current one.
+func (s *Session) Redo() error {
+	if err := s.Engine.Redo(); err != nil {
+		return err
+	}
+
+	return s.replaced()
+}
+
+// Branch starts a new line of history from a state of the session.
+func (s *Session) Branch(number int) (int, error) {
+	line, err := s.Engine.Branch(number)
+	if err != nil {
+		return 0, err
+	}
+
+	return line, s.replaced()
+}
+
+// replaced stores a snapshot after the state of the session was replaced
+// without interpreting any phrases, as the log no longer applies to it.
+func (s *Session) replaced() error {
+	if s.store == nil {
+		return nil
+	}
+
+	if err := s.store.Snapshot(s.Id, s.Engine.Snapshot()); err != nil {
+		return err
+	}
+
+	s.logged = 0
+
+	return nil
+}
+
+// Manager keeps track of all the sessions of a server.
+type Manager struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+
+	store            Store
+	snapshotInterval int
+}
+
+// NewManager creates a manager without any sessions. The sessions are only
+// kept in memory.
+func NewManager() *Manager {
+	return &Manager{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// OpenManager creates a manager that persists its sessions in the given
+// store, and recovers all sessions that were stored before. A snapshot of a
+// session is stored after every snapshotInterval requests that changed it.
+func OpenManager(store Store, snapshotInterval int) (*Manager, error) {
+	m := &Manager{
+		sessions:         make(map[string]*Session),
+		store:            store,
+		snapshotInterval: snapshotInterval,
+	}
+
+	stored, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stored {
+		session := m.newSession(s.Id, s.Created, s.History)
+
+		if s.Snapshot != nil {
+			session.Engine.Restore(*s.Snapshot)
+		}
+		for _, phrases := range s.Requests {
+			session.Engine.Interpret(phrases, false)
+			session.logged++
+		}
+
+		// The history is not stored, so it starts from the recovered state
+		if session.History {
+			session.Engine.EnableHistory()
+		}
+
+		log.Printf("Recovered session %s (%d requests after the last snapshot)", s.Id, len(s.Requests))
+		m.sessions[s.Id] = session
+	}
+
+	return m, nil
+}
+
+func (m *Manager) newSession(id string, created time.Time, history bool) *Session {
+	session := &Session{
+		Id:               id,
+		Created:          created,
+		History:          history,
+		Engine:           eflint.NewEngine(),
+		store:            m.store,
+		snapshotInterval: m.snapshotInterval,
+	}
+
+	if history {
+		session.Engine.EnableHistory()
+	}
+
+	return session
+}
+
+func generateId() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// Create creates a new session with an empty specification. If no id is
+// given, a random one is generated. The history of the session is only
+// recorded if it is asked for, as it keeps the changes of every phrase.
+func (m *Manager) Create(id string, history bool) (*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if id == "" {
+		var err error
+		if id, err = generateId(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := m.sessions[id]; ok {
+		return nil, ErrSessionExists
+	}
+
+	session := m.newSession(id, time.Now(), history)
+	if m.store != nil {
+		if err := m.store.Create(id, session.Created, history); err != nil {
+			return nil, err
+		}
+	}
+	m.sessions[id] = session
+
+	return session, nil
+}
+
+// Get returns the session with the given id.
+func (m *Manager) Get(id string) (*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+
+	return session, nil
+}
+
+// List returns all sessions, ordered by their creation time.
+func (m *Manager) List() []*Session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+
+	return sessions
+}
+
+// Delete removes the session with the given id, discarding its state. It
+// waits for the request that is using the session, and requests that are
+// still waiting for the session fail afterwards. The id stays in use until
+// the session is removed from the store, so a new session with the same id
+// cannot be stored in the meantime.
+func (m *Manager) Delete(id string) error {
+	session, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := session.Lock(); err != nil {
+		return ErrUnknownSession
+	}
+	defer session.Unlock()
+
+	if m.store != nil {
+		if err := m.store.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	session.closed = true
+
+	m.lock.Lock()
+	delete(m.sessions, id)
+	m.lock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package session
+
+import (
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"time"
+)
+
+// Store persists sessions, so that they can be recovered when the server is
+// restarted. A store is only used while holding the lock of the session it
+// is called for, so calls for the same session never overlap.
+type Store interface {
+	// Create records that a session was created, and whether it records its
+	// history.
+	Create(id string, created time.Time, history bool) error
+
+	// Append records the phrases of a request, before they are interpreted.
+	Append(id string, phrases []eflint.Phrase) error
+
+	// Snapshot records the complete state of a session. The phrases that were
+	// appended before are no longer needed to recover the session.
+	Snapshot(id string, state eflint.State) error
+
+	// Delete removes everything that was recorded for a session.
+	Delete(id string) error
+
+	// Load returns all the sessions that were recorded.
+	Load() ([]Stored, error)
+}
+
+// Stored is a session as it was recorded by a store. It is recovered by
+// restoring the snapshot, if any, and interpreting the phrases that were
+// appended after it in order.
+type Stored struct {
+	Id       string
+	Created  time.Time
+	History  bool
+	Snapshot *eflint.State
+	Requests [][]eflint.Phrase
+}
@@ -0,0 +1,74 @@
+// Package eflint exposes the eFLINT reasoner of the server as a library, so
+// that Go programs can interpret eFLINT phrases without going over HTTP.
+//
+// Every Engine has a knowledge base of its own:
+//
+//	engine := eflint.NewEngine()
+//	if errors := engine.TypecheckPhrases(input.Phrases); len(errors) == 0 {
+//		results := engine.Interpret(input.Phrases, input.Updates)
+//	}
+package eflint
+
+import (
+	"github.com/Olaf-Erkemeij/eflint-server/internal/eflint"
+	"github.com/Olaf-Erkemeij/eflint-server/internal/parser"
+	"io"
+)
+
+type (
+	// Engine interprets phrases in a knowledge base of its own.
+	Engine = eflint.Engine
+	// State is a copy of the knowledge base of an engine.
+	State = eflint.State
+
+	Input        = eflint.Input
+	Output       = eflint.Output
+	Phrase       = eflint.Phrase
+	PhraseResult = eflint.PhraseResult
+	Expression   = eflint.Expression
+	Trigger      = eflint.Trigger
+	Violation    = eflint.Violation
+	Error        = eflint.Error
+	Position     = eflint.Position
+
+	// Diagnostic is a problem in a source file in eFLINT syntax.
+	Diagnostic = parser.Diagnostic
+)
+
+// NewEngine creates an engine with a knowledge base that only contains the
+// default facts.
+func NewEngine() *Engine {
+	return eflint.NewEngine()
+}
+
+// Typecheck checks that the input is valid.
+func Typecheck(input Input) error {
+	return eflint.Typecheck(input)
+}
+
+// GenerateJSON generates the JSON response for the given output.
+func GenerateJSON(output Output) ([]byte, error) {
+	return eflint.GenerateJSON(output)
+}
+
+// Parse parses phrases in eFLINT syntax. The input is only valid if there are
+// no diagnostics. Included files are read from disk, relative to the filename.
+func Parse(filename string, source io.Reader) (Input, []Diagnostic) {
+	ini, diagnostics := parser.Parse(filename, source)
+	if len(diagnostics) > 0 {
+		return Input{}, diagnostics
+	}
+
+	return parser.Convert(ini), nil
+}
+
+// FormatPhrase formats a phrase in eFLINT syntax, such that parsing it gives
+// the same phrase.
+func FormatPhrase(phrase Phrase) (string, error) {
+	return eflint.FormatPhrase(phrase)
+}
+
+// FormatExpression formats an expression in eFLINT syntax.
+func FormatExpression(expression Expression) string {
+	return eflint.FormatExpression(expression)
+}
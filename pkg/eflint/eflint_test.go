@@ -0,0 +1,119 @@
+package eflint_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Olaf-Erkemeij/eflint-server/pkg/eflint"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleEngine() {
+	var input eflint.Input
+	err := json.Unmarshal([]byte(`{
+		"version": "0.1.0",
+		"kind": "phrases",
+		"phrases": [
+			{"kind": "afact", "name": "person", "type": "String"},
+			{"kind": "create", "operand": {"identifier": "person", "operands": ["Alice"]}}
+		]
+	}`), &input)
+	if err != nil {
+		panic(err)
+	}
+
+	first, second := eflint.NewEngine(), eflint.NewEngine()
+	first.Interpret(input.Phrases, false)
+	second.Interpret(input.Phrases[:1], false)
+
+	query := eflint.Expression{Value: []string{"person"}}
+	found, _ := first.Query(query)
+	missing, _ := second.Query(query)
+	fmt.Println(len(found), len(missing))
+	// Output: 1 0
+}
+
+func ExampleParse() {
+	input, diagnostics := eflint.Parse("case.eflint", strings.NewReader(`
+Fact person Identified by String.
++person(Alice).
+?person(Alice).`))
+	if len(diagnostics) > 0 {
+		panic(diagnostics[0])
+	}
+
+	results := eflint.NewEngine().Interpret(input.Phrases, input.Updates)
+	fmt.Println(results[2].Result)
+
+	_, diagnostics = eflint.Parse("case.eflint", strings.NewReader("+person(Alice"))
+	fmt.Println(diagnostics[0])
+	// Output:
+	// true
+	// case.eflint:1:14: expected )
+}
+
+// Phrases that are interpreted without typechecking them first must fail
+// instead of crashing the program.
+func TestUncheckedOperands(t *testing.T) {
+	for _, operator := range []string{"COUNT", "SUM", "MAX", "MIN", "HOLDS"} {
+		var input eflint.Input
+		err := json.Unmarshal([]byte(`{
+			"version": "0.1.0",
+			"kind": "phrases",
+			"phrases": [
+				{"kind": "bquery", "expression": {"operator": "EQ", "operands": [{"operator": "`+operator+`", "operands": []}, 0]}}
+			]
+		}`), &input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := eflint.NewEngine().Interpret(input.Phrases, false)
+		if len(results) != 1 || results[0].Success || len(results[0].Errors) != 1 || results[0].Errors[0].Id != "invalid-expression" {
+			t.Errorf("Expected %s without operands to be invalid, got %+v", operator, results)
+		}
+	}
+}
+
+// Queries that stop before all instances of a fact are visited must not leave
+// the iteration over the instances behind.
+func TestShortCircuitGoroutines(t *testing.T) {
+	input, diagnostics := eflint.Parse("case.eflint", strings.NewReader(`
+Fact person Identified by String.
++person(Alice).
++person(Bob).`))
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+
+	engine := eflint.NewEngine()
+	engine.Interpret(input.Phrases, false)
+
+	queries, diagnostics := eflint.Parse("case.eflint", strings.NewReader(`
+?Exists person : person == person(Alice).
+?person.`))
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics[0])
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		for _, result := range engine.Interpret(queries.Phrases, false) {
+			if !result.Success {
+				t.Fatal("Expected the query to succeed, got", result.Errors)
+			}
+		}
+	}
+
+	// The goroutines of the last queries may still be finishing
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > before+10 && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if after > before+10 {
+		t.Errorf("Expected the number of goroutines to stay around %d, got %d", before, after)
+	}
+}